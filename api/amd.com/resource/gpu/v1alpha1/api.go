@@ -51,13 +51,44 @@ const (
 // Decoder implements a decoder for objects in this API group.
 var Decoder runtime.Decoder
 
+// VisibleDevicesStyle selects how the devices of a claim are listed in the
+// ROCR_VISIBLE_DEVICES environment variable of its containers.
+type VisibleDevicesStyle string
+
+// These constants represent the styles of ROCR_VISIBLE_DEVICES.
+const (
+	// UUIDVisibleDevices lists GPUs by UUID, e.g. GPU-9c1a3b4fe2d07a11.
+	// Partitions, which share the UUID of their GPU, and GPUs without a
+	// UUID are listed by index.
+	UUIDVisibleDevices VisibleDevicesStyle = "UUID"
+	// IndexVisibleDevices lists GPUs and partitions by their index among
+	// the GPUs and partitions of the claim, which is how ROCm numbers them
+	// in its containers.
+	IndexVisibleDevices VisibleDevicesStyle = "Index"
+)
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // GpuConfig holds the set of parameters for configuring a GPU.
-// No configs are supported yet.
 type GpuConfig struct {
 	metav1.TypeMeta `json:",inline"`
+	// Partitioning requests compute and memory partition modes for the GPUs
+	// of the claim. It is applied during Prepare.
+	Partitioning *PartitioningConfig `json:"partitioning,omitempty"`
+	// Performance requests power and performance settings for the GPUs of
+	// the claim. It is applied during Prepare.
+	Performance *PerformanceConfig `json:"performance,omitempty"`
+	// Sharing sets how the devices of the claim are shared with other
+	// claims. Defaults to TimeSlicing.
+	Sharing *GpuSharing `json:"sharing,omitempty"`
+	// VisibleDevices selects how the devices are listed in
+	// ROCR_VISIBLE_DEVICES. Defaults to UUID.
+	VisibleDevices VisibleDevicesStyle `json:"visibleDevices,omitempty"`
+	// TopologyFile mounts a JSON file with the NUMA nodes and local CPUs of
+	// every device of the claim into its containers, at the path given in
+	// AMD_GPU_TOPOLOGY_FILE.
+	TopologyFile bool `json:"topologyFile,omitempty"`
 }
 
 // DefaultGpuConfig provides the default GPU configuration.
@@ -67,6 +98,9 @@ func DefaultGpuConfig() *GpuConfig {
 			APIVersion: GroupName + "/" + Version,
 			Kind:       GpuConfigKind,
 		},
+		Sharing: &GpuSharing{
+			Strategy: TimeSlicingStrategy,
+		},
 	}
 }
 
@@ -75,6 +109,17 @@ func (c *GpuConfig) Normalize() error {
 	if c == nil {
 		return fmt.Errorf("config is 'nil'")
 	}
+	if c.Partitioning != nil {
+		c.Partitioning.Normalize()
+	}
+	if c.Performance != nil {
+		c.Performance.Normalize()
+	}
+	if c.Sharing == nil {
+		c.Sharing = &GpuSharing{
+			Strategy: TimeSlicingStrategy,
+		}
+	}
 	return nil
 }
 
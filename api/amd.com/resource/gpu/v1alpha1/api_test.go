@@ -51,12 +51,46 @@ func TestGpuConfigNormalize(t *testing.T) {
 		},
 		"empty GpuConfig": {
 			gpuConfig: &GpuConfig{},
-			expected:  &GpuConfig{},
+			expected: &GpuConfig{
+				Sharing: &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+		},
+		"sharing is kept": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{
+					Strategy:                SpacePartitioningStrategy,
+					SpacePartitioningConfig: &SpacePartitioningConfig{PartitionCount: 2},
+				},
+			},
+			expected: &GpuConfig{
+				Sharing: &GpuSharing{
+					Strategy:                SpacePartitioningStrategy,
+					SpacePartitioningConfig: &SpacePartitioningConfig{PartitionCount: 2},
+				},
+			},
 		},
 		"default GpuConfig is already normalized": {
 			gpuConfig: DefaultGpuConfig(),
 			expected:  DefaultGpuConfig(),
 		},
+		"partition modes are upper cased": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: "cpx", MemoryMode: "nps4"},
+			},
+			expected: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: CPXComputePartition, MemoryMode: NPS4MemoryPartition},
+				Sharing:      &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+		},
+		"performance level is lower cased and power profile upper cased": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{PerformanceLevel: "High", PowerProfile: "compute"},
+			},
+			expected: &GpuConfig{
+				Performance: &PerformanceConfig{PerformanceLevel: HighPerformanceLevel, PowerProfile: "COMPUTE"},
+				Sharing:     &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+		},
 	}
 
 	for name, test := range tests {
@@ -0,0 +1,84 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ComputePartitionMode is the number of compute partitions (XCPs) a GPU is
+// split into.
+type ComputePartitionMode string
+
+// MemoryPartitionMode is the number of NUMA partitions the VRAM of a GPU is
+// split into.
+type MemoryPartitionMode string
+
+// These constants represent the compute partition modes supported by MI300
+// series GPUs.
+const (
+	// SPXComputePartition exposes the GPU as a single partition.
+	SPXComputePartition ComputePartitionMode = "SPX"
+	// DPXComputePartition splits the GPU into two partitions.
+	DPXComputePartition ComputePartitionMode = "DPX"
+	// QPXComputePartition splits the GPU into four partitions.
+	QPXComputePartition ComputePartitionMode = "QPX"
+	// CPXComputePartition splits the GPU into one partition per XCD.
+	CPXComputePartition ComputePartitionMode = "CPX"
+)
+
+// These constants represent the memory partition modes supported by MI300
+// series GPUs.
+const (
+	// NPS1MemoryPartition interleaves VRAM across the whole GPU.
+	NPS1MemoryPartition MemoryPartitionMode = "NPS1"
+	// NPS4MemoryPartition splits VRAM into four NUMA partitions.
+	NPS4MemoryPartition MemoryPartitionMode = "NPS4"
+)
+
+// PartitioningConfig requests partition modes for the GPUs of a claim. The
+// driver repartitions a GPU during Prepare when none of its devices is in use
+// by another claim. A mode that is not set leaves the current mode unchanged.
+type PartitioningConfig struct {
+	ComputeMode ComputePartitionMode `json:"computeMode,omitempty"`
+	MemoryMode  MemoryPartitionMode  `json:"memoryMode,omitempty"`
+}
+
+// Normalize converts the partition modes to upper case.
+func (p *PartitioningConfig) Normalize() {
+	p.ComputeMode = ComputePartitionMode(strings.ToUpper(string(p.ComputeMode)))
+	p.MemoryMode = MemoryPartitionMode(strings.ToUpper(string(p.MemoryMode)))
+}
+
+// Validate ensures that PartitioningConfig has a valid set of values.
+func (p *PartitioningConfig) Validate() error {
+	switch p.ComputeMode {
+	case "", SPXComputePartition, DPXComputePartition, QPXComputePartition, CPXComputePartition:
+	default:
+		return fmt.Errorf("unknown compute partition mode: %v", p.ComputeMode)
+	}
+	switch p.MemoryMode {
+	case "", NPS1MemoryPartition, NPS4MemoryPartition:
+	default:
+		return fmt.Errorf("unknown memory partition mode: %v", p.MemoryMode)
+	}
+	if p.ComputeMode == "" && p.MemoryMode == "" {
+		return fmt.Errorf("no compute or memory partition mode set")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2023 The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PerformanceLevel is the DPM performance level a GPU is forced to, as in its
+// power_dpm_force_performance_level sysfs file.
+type PerformanceLevel string
+
+// These constants represent the performance levels supported by amdgpu.
+const (
+	// AutoPerformanceLevel lets the driver pick clocks dynamically.
+	AutoPerformanceLevel PerformanceLevel = "auto"
+	// LowPerformanceLevel forces the lowest clocks.
+	LowPerformanceLevel PerformanceLevel = "low"
+	// HighPerformanceLevel forces the highest clocks.
+	HighPerformanceLevel PerformanceLevel = "high"
+	// ManualPerformanceLevel allows the clocks and the power profile to be
+	// set by hand.
+	ManualPerformanceLevel PerformanceLevel = "manual"
+	// ProfileStandardPerformanceLevel fixes clocks for stable profiling.
+	ProfileStandardPerformanceLevel PerformanceLevel = "profile_standard"
+	// ProfileMinSclkPerformanceLevel fixes the shader clock to its minimum.
+	ProfileMinSclkPerformanceLevel PerformanceLevel = "profile_min_sclk"
+	// ProfileMinMclkPerformanceLevel fixes the memory clock to its minimum.
+	ProfileMinMclkPerformanceLevel PerformanceLevel = "profile_min_mclk"
+	// ProfilePeakPerformanceLevel fixes all clocks to their maximum.
+	ProfilePeakPerformanceLevel PerformanceLevel = "profile_peak"
+	// PerfDeterminismPerformanceLevel caps the shader clock for deterministic
+	// performance across GPUs.
+	PerfDeterminismPerformanceLevel PerformanceLevel = "perf_determinism"
+)
+
+// CustomPowerProfile is the power profile whose heuristics are set by hand,
+// which a claim cannot select.
+const CustomPowerProfile = "CUSTOM"
+
+// powerProfilePattern matches the names of the power profiles listed in
+// pp_power_profile_mode, e.g. COMPUTE or 3D_FULL_SCREEN.
+var powerProfilePattern = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+// PerformanceConfig requests power and performance settings for the GPUs of
+// a claim. They are applied during Prepare and restored when the claim is
+// unprepared. The settings apply to the whole GPU, so they are only changed
+// if no other claim uses the GPU or any of its partitions. A setting that is
+// not set is left unchanged.
+type PerformanceConfig struct {
+	// PowerCap is the power cap of the GPUs in watts. It must be within the
+	// power1_cap_min and power1_cap_max of each GPU.
+	PowerCap *int `json:"powerCap,omitempty"`
+	// PerformanceLevel is the DPM performance level of the GPUs.
+	PerformanceLevel PerformanceLevel `json:"performanceLevel,omitempty"`
+	// PowerProfile is the name of a power profile listed in the
+	// pp_power_profile_mode of the GPUs, e.g. COMPUTE.
+	PowerProfile string `json:"powerProfile,omitempty"`
+}
+
+// Normalize converts the performance level to lower case and the power
+// profile to upper case.
+func (p *PerformanceConfig) Normalize() {
+	p.PerformanceLevel = PerformanceLevel(strings.ToLower(string(p.PerformanceLevel)))
+	p.PowerProfile = strings.ToUpper(p.PowerProfile)
+}
+
+// Validate ensures that PerformanceConfig has a valid set of values.
+func (p *PerformanceConfig) Validate() error {
+	if p.PowerCap != nil && *p.PowerCap < 1 {
+		return fmt.Errorf("invalid power cap: %d", *p.PowerCap)
+	}
+	switch p.PerformanceLevel {
+	case "", AutoPerformanceLevel, LowPerformanceLevel, HighPerformanceLevel, ManualPerformanceLevel,
+		ProfileStandardPerformanceLevel, ProfileMinSclkPerformanceLevel, ProfileMinMclkPerformanceLevel,
+		ProfilePeakPerformanceLevel, PerfDeterminismPerformanceLevel:
+	default:
+		return fmt.Errorf("unknown performance level: %v", p.PerformanceLevel)
+	}
+	switch {
+	case p.PowerProfile == "":
+	case p.PowerProfile == CustomPowerProfile:
+		return fmt.Errorf("power profile %s is not supported", CustomPowerProfile)
+	case !powerProfilePattern.MatchString(p.PowerProfile):
+		return fmt.Errorf("invalid power profile: %v", p.PowerProfile)
+	}
+	if p.PowerCap == nil && p.PerformanceLevel == "" && p.PowerProfile == "" {
+		return fmt.Errorf("no power cap, performance level or power profile set")
+	}
+	return nil
+}
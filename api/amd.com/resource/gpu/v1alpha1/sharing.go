@@ -0,0 +1,107 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+)
+
+// GpuSharingStrategy is the way a device is shared by the claims it is
+// allocated to.
+type GpuSharingStrategy string
+
+// These constants represent the sharing strategies supported by the driver.
+const (
+	// TimeSlicingStrategy lets claims take turns on the whole device, which
+	// is time-sliced between their processes by the GPU scheduler.
+	TimeSlicingStrategy GpuSharingStrategy = "TimeSlicing"
+	// SpacePartitioningStrategy gives every claim a disjoint set of the
+	// compute units of the device, enforced with HSA_CU_MASK.
+	SpacePartitioningStrategy GpuSharingStrategy = "SpacePartitioning"
+)
+
+// GpuSharing sets how the devices of a claim are shared with other claims
+// they are prepared for at the same time. A device is only prepared for
+// claims that share it with the same strategy. Devices are only allocated to
+// several claims when the kubelet plugin publishes them as shareable.
+type GpuSharing struct {
+	Strategy                GpuSharingStrategy       `json:"strategy"`
+	SpacePartitioningConfig *SpacePartitioningConfig `json:"spacePartitioningConfig,omitempty"`
+}
+
+// SpacePartitioningConfig sets the share of the compute units of a device a
+// claim gets: the CUs are split into PartitionCount equal parts and the claim
+// gets one of them.
+type SpacePartitioningConfig struct {
+	PartitionCount int `json:"partitionCount"`
+}
+
+// IsTimeSlicing checks if the TimeSlicing strategy is applied.
+func (s *GpuSharing) IsTimeSlicing() bool {
+	if s == nil {
+		return false
+	}
+	return s.Strategy == TimeSlicingStrategy
+}
+
+// IsSpacePartitioning checks if the SpacePartitioning strategy is applied.
+func (s *GpuSharing) IsSpacePartitioning() bool {
+	if s == nil {
+		return false
+	}
+	return s.Strategy == SpacePartitioningStrategy
+}
+
+// GetSpacePartitioningConfig returns the space partitioning config that
+// applies to the given strategy.
+func (s *GpuSharing) GetSpacePartitioningConfig() (*SpacePartitioningConfig, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no sharing set to get config from")
+	}
+	if s.Strategy != SpacePartitioningStrategy {
+		return nil, fmt.Errorf("strategy is not set to '%v'", SpacePartitioningStrategy)
+	}
+	if s.SpacePartitioningConfig == nil {
+		return nil, fmt.Errorf("no space partitioning config set")
+	}
+	return s.SpacePartitioningConfig, nil
+}
+
+// Validate ensures that GpuSharing has a valid set of values.
+func (s *GpuSharing) Validate() error {
+	switch s.Strategy {
+	case TimeSlicingStrategy:
+		return nil
+	case SpacePartitioningStrategy:
+		config, err := s.GetSpacePartitioningConfig()
+		if err != nil {
+			return err
+		}
+		return config.Validate()
+	case "":
+		return fmt.Errorf("no sharing strategy set")
+	}
+	return fmt.Errorf("unknown GPU sharing strategy: %v", s.Strategy)
+}
+
+// Validate ensures that SpacePartitioningConfig has a valid set of values.
+func (s *SpacePartitioningConfig) Validate() error {
+	if s.PartitionCount < 1 {
+		return fmt.Errorf("invalid partition count: %d", s.PartitionCount)
+	}
+	return nil
+}
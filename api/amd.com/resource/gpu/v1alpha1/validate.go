@@ -32,7 +32,35 @@ limitations under the License.
 
 package v1alpha1
 
+import "fmt"
+
 // Validate ensures that GpuConfig has a valid set of values.
 func (c *GpuConfig) Validate() error {
+	switch c.VisibleDevices {
+	case "", UUIDVisibleDevices, IndexVisibleDevices:
+	default:
+		return fmt.Errorf("unknown visible devices style: %v", c.VisibleDevices)
+	}
+	if c.Partitioning != nil {
+		if err := c.Partitioning.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Performance != nil {
+		if err := c.Performance.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Sharing == nil {
+		return fmt.Errorf("no sharing strategy set")
+	}
+	if err := c.Sharing.Validate(); err != nil {
+		return err
+	}
+	// A GPU repartitioned for a claim is replaced by several devices, while
+	// a compute unit mask applies to a single one.
+	if c.Partitioning != nil && c.Sharing.IsSpacePartitioning() {
+		return fmt.Errorf("space partitioning cannot be combined with partitioning")
+	}
 	return nil
 }
@@ -37,6 +37,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/ptr"
 )
 
 func TestGpuConfigValidate(t *testing.T) {
@@ -52,6 +53,144 @@ func TestGpuConfigValidate(t *testing.T) {
 			gpuConfig: DefaultGpuConfig(),
 			expected:  nil,
 		},
+		"compute and memory partitioning": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: CPXComputePartition, MemoryMode: NPS4MemoryPartition},
+				Sharing:      &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+			expected: nil,
+		},
+		"compute partitioning only": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: QPXComputePartition},
+				Sharing:      &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+			expected: nil,
+		},
+		"empty partitioning": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{},
+			},
+			expected: errors.New("no compute or memory partition mode set"),
+		},
+		"unknown compute partition mode": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: "TPX"},
+			},
+			expected: errors.New("unknown compute partition mode: TPX"),
+		},
+		"unknown memory partition mode": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{MemoryMode: "NPS2"},
+			},
+			expected: errors.New("unknown memory partition mode: NPS2"),
+		},
+		"time slicing": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+			expected: nil,
+		},
+		"no sharing strategy": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{},
+			},
+			expected: errors.New("no sharing strategy set"),
+		},
+		"space partitioning": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{
+					Strategy:                SpacePartitioningStrategy,
+					SpacePartitioningConfig: &SpacePartitioningConfig{PartitionCount: 4},
+				},
+			},
+			expected: nil,
+		},
+		"space partitioning without config": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{Strategy: SpacePartitioningStrategy},
+			},
+			expected: errors.New("no space partitioning config set"),
+		},
+		"invalid partition count": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{
+					Strategy:                SpacePartitioningStrategy,
+					SpacePartitioningConfig: &SpacePartitioningConfig{PartitionCount: 0},
+				},
+			},
+			expected: errors.New("invalid partition count: 0"),
+		},
+		"unknown sharing strategy": {
+			gpuConfig: &GpuConfig{
+				Sharing: &GpuSharing{Strategy: "MPS"},
+			},
+			expected: errors.New("unknown GPU sharing strategy: MPS"),
+		},
+		"space partitioning and partitioning": {
+			gpuConfig: &GpuConfig{
+				Partitioning: &PartitioningConfig{ComputeMode: CPXComputePartition},
+				Sharing: &GpuSharing{
+					Strategy:                SpacePartitioningStrategy,
+					SpacePartitioningConfig: &SpacePartitioningConfig{PartitionCount: 2},
+				},
+			},
+			expected: errors.New("space partitioning cannot be combined with partitioning"),
+		},
+		"performance": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{
+					PowerCap:         ptr.To(500),
+					PerformanceLevel: ManualPerformanceLevel,
+					PowerProfile:     "COMPUTE",
+				},
+				Sharing: &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+			expected: nil,
+		},
+		"empty performance": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{},
+			},
+			expected: errors.New("no power cap, performance level or power profile set"),
+		},
+		"invalid power cap": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{PowerCap: ptr.To(0)},
+			},
+			expected: errors.New("invalid power cap: 0"),
+		},
+		"unknown performance level": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{PerformanceLevel: "turbo"},
+			},
+			expected: errors.New("unknown performance level: turbo"),
+		},
+		"custom power profile": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{PowerProfile: CustomPowerProfile},
+			},
+			expected: errors.New("power profile CUSTOM is not supported"),
+		},
+		"invalid power profile": {
+			gpuConfig: &GpuConfig{
+				Performance: &PerformanceConfig{PowerProfile: "MEMORY-BOUND"},
+			},
+			expected: errors.New("invalid power profile: MEMORY-BOUND"),
+		},
+		"index visible devices": {
+			gpuConfig: &GpuConfig{
+				VisibleDevices: IndexVisibleDevices,
+				Sharing:        &GpuSharing{Strategy: TimeSlicingStrategy},
+			},
+			expected: nil,
+		},
+		"unknown visible devices style": {
+			gpuConfig: &GpuConfig{
+				VisibleDevices: "Ordinal",
+			},
+			expected: errors.New("unknown visible devices style: Ordinal"),
+		},
 	}
 
 	for name, test := range tests {
@@ -44,6 +44,21 @@ import (
 func (in *GpuConfig) DeepCopyInto(out *GpuConfig) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
+	if in.Partitioning != nil {
+		in, out := &in.Partitioning, &out.Partitioning
+		*out = new(PartitioningConfig)
+		**out = **in
+	}
+	if in.Performance != nil {
+		in, out := &in.Performance, &out.Performance
+		*out = new(PerformanceConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Sharing != nil {
+		in, out := &in.Sharing, &out.Sharing
+		*out = new(GpuSharing)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GpuConfig.
@@ -63,3 +78,73 @@ func (in *GpuConfig) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GpuSharing) DeepCopyInto(out *GpuSharing) {
+	*out = *in
+	if in.SpacePartitioningConfig != nil {
+		in, out := &in.SpacePartitioningConfig, &out.SpacePartitioningConfig
+		*out = new(SpacePartitioningConfig)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GpuSharing.
+func (in *GpuSharing) DeepCopy() *GpuSharing {
+	if in == nil {
+		return nil
+	}
+	out := new(GpuSharing)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PartitioningConfig) DeepCopyInto(out *PartitioningConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PartitioningConfig.
+func (in *PartitioningConfig) DeepCopy() *PartitioningConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PartitioningConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PerformanceConfig) DeepCopyInto(out *PerformanceConfig) {
+	*out = *in
+	if in.PowerCap != nil {
+		in, out := &in.PowerCap, &out.PowerCap
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PerformanceConfig.
+func (in *PerformanceConfig) DeepCopy() *PerformanceConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PerformanceConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpacePartitioningConfig) DeepCopyInto(out *SpacePartitioningConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpacePartitioningConfig.
+func (in *SpacePartitioningConfig) DeepCopy() *SpacePartitioningConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SpacePartitioningConfig)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -25,13 +25,15 @@ import (
 // AllocatableDevices represents a collection of allocatable devices mapped by their canonical names
 type AllocatableDevices map[string]*AllocatableDevice
 
-// AllocatableDevice wraps either a full AMD GPU or a partition
+// AllocatableDevice wraps either a full AMD GPU, a partition or all GPUs of
+// an XGMI hive
 type AllocatableDevice struct {
 	AmdGpu       *AmdGpuInfo
 	AmdPartition *AmdPartitionInfo
+	AmdHive      *AmdHiveInfo
 }
 
-// Type returns the device type (amdgpu or amdgpu-partition)
+// Type returns the device type (amdgpu, amdgpu-partition or amdgpu-hive)
 func (d *AllocatableDevice) Type() string {
 	if d.AmdGpu != nil {
 		return AmdGpuDeviceType
@@ -39,6 +41,9 @@ func (d *AllocatableDevice) Type() string {
 	if d.AmdPartition != nil {
 		return AmdPartitionDeviceType
 	}
+	if d.AmdHive != nil {
+		return AmdHiveDeviceType
+	}
 	return UnknownDeviceType
 }
 
@@ -49,6 +54,170 @@ func (d *AllocatableDevice) CanonicalName() string {
 		return d.AmdGpu.CanonicalName()
 	case AmdPartitionDeviceType:
 		return d.AmdPartition.CanonicalName()
+	case AmdHiveDeviceType:
+		return d.AmdHive.CanonicalName()
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// PCIAddress returns the PCI address of the GPU, or of the parent GPU for a
+// partition. It is empty for a hive, which spans several GPUs, see GPUs.
+func (d *AllocatableDevice) PCIAddress() string {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.PCIAddress
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.Parent.PCIAddress
+	case AmdHiveDeviceType:
+		return ""
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// GPUs returns the PCI addresses of the GPUs the device is on: that of the
+// GPU or parent GPU, or those of all GPUs of a hive.
+func (d *AllocatableDevice) GPUs() []string {
+	if d.Type() == AmdHiveDeviceType {
+		pciAddrs := make([]string, len(d.AmdHive.GPUs))
+		for i, gpu := range d.AmdHive.GPUs {
+			pciAddrs[i] = gpu.PCIAddress
+		}
+		return pciAddrs
+	}
+	return []string{d.PCIAddress()}
+}
+
+// ProductName returns the product name of the GPU, or of the parent GPU for a
+// partition, or of the GPUs of a hive
+func (d *AllocatableDevice) ProductName() string {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.ProductName
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.Parent.ProductName
+	case AmdHiveDeviceType:
+		return d.AmdHive.GPUs[0].ProductName
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// DRMNodes returns the DRM card and render indices currently backing the device.
+// These may change across reboots and must be looked up rather than derived
+// from the device name. They are -1 for a partition of a layout the GPU is not
+// currently in, and for a hive, which is backed by the devices of its GPUs.
+func (d *AllocatableDevice) DRMNodes() (card, render int) {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.CardIndex, d.AmdGpu.RenderIndex
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.CardIndex, d.AmdPartition.RenderIndex
+	case AmdHiveDeviceType:
+		return -1, -1
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// KFDGPUID returns the KFD gpu_id of the device, which identifies it in
+// /sys/class/kfd/kfd/proc, or 0 if it is unknown or the device is a hive.
+func (d *AllocatableDevice) KFDGPUID() int {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.KFDGPUID
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.KFDGPUID
+	case AmdHiveDeviceType:
+		return 0
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// Ordinal returns the ROCm device index of the device on the node, which
+// orders it in ROCR_VISIBLE_DEVICES, or -1 if it is unknown or the device is
+// a hive.
+func (d *AllocatableDevice) Ordinal() int {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.Ordinal
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.Ordinal
+	case AmdHiveDeviceType:
+		return -1
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// NumaNode returns the NUMA node of the device, i.e. of its memory for a
+// partition, or -1 if it is unknown or the device is a hive, which is backed
+// by the devices of its GPUs.
+func (d *AllocatableDevice) NumaNode() int {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.NumaNode
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.NumaNode
+	case AmdHiveDeviceType:
+		return -1
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// LocalCPUs returns the CPUs local to the device in kernel list format, or ""
+// if they are unknown or the device is a hive.
+func (d *AllocatableDevice) LocalCPUs() string {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.LocalCPUs
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.LocalCPUs
+	case AmdHiveDeviceType:
+		return ""
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// ComputeUnits returns the number of compute units and SIMDs of the device,
+// which are 0 if unknown.
+func (d *AllocatableDevice) ComputeUnits() (cus, simds int) {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.ComputeUnits, d.AmdGpu.SimdUnits
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.ComputeUnits, d.AmdPartition.SimdUnits
+	case AmdHiveDeviceType:
+		for _, gpu := range d.AmdHive.GPUs {
+			cus += gpu.ComputeUnits
+			simds += gpu.SimdUnits
+		}
+		return cus, simds
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// PartitionLayout returns the partition layout a partitionable device belongs
+// to, or nil if the device was discovered in the current layout of its GPU.
+func (d *AllocatableDevice) PartitionLayout() *partitionLayout {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.Layout
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.Layout
+	case AmdHiveDeviceType:
+		return nil
+	}
+	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
+}
+
+// CounterSet returns the counters shared by the partitionable devices of the
+// GPU, or by the devices of the hive of the GPU, or nil if the device
+// consumes no counters.
+func (d *AllocatableDevice) CounterSet() *resourceapi.CounterSet {
+	switch d.Type() {
+	case AmdGpuDeviceType:
+		return d.AmdGpu.CounterSet
+	case AmdPartitionDeviceType:
+		return d.AmdPartition.Parent.CounterSet
+	case AmdHiveDeviceType:
+		return d.AmdHive.CounterSet
 	}
 	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
 }
@@ -60,6 +229,8 @@ func (d *AllocatableDevice) GetDevice() resourceapi.Device {
 		return d.AmdGpu.GetDevice()
 	case AmdPartitionDeviceType:
 		return d.AmdPartition.GetDevice()
+	case AmdHiveDeviceType:
+		return d.AmdHive.GetDevice()
 	}
 	panic(fmt.Sprintf("unexpected device type: %s", d.Type()))
 }
@@ -0,0 +1,130 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// memoryCapacityStep is the granularity in which allocations of a shared
+// device consume its memory.
+var memoryCapacityStep = resource.MustParse("1Gi")
+
+// capacityRequestPolicy returns how allocations of a shared device consume
+// one of its capacities: memory in steps of memoryCapacityStep, compute units
+// one by one and SIMD units by the SIMDs of a compute unit, up to the capacity
+// of the device rounded down to a whole step, as the API requires. A capacity
+// smaller than its step has no valid range. Allocations that do not request a
+// capacity consume none of it, rather than all of it.
+func capacityRequestPolicy(device *resourceapi.Device, name resourceapi.QualifiedName) *resourceapi.CapacityRequestPolicy {
+	capacity := device.Capacity[name]
+	var step *resource.Quantity
+	switch name {
+	case "memory":
+		step = ptrToCopy(memoryCapacityStep)
+	case "computeUnits":
+		step = resource.NewQuantity(1, resource.BinarySI)
+	case "simdUnits":
+		computeUnits := device.Capacity["computeUnits"]
+		cus := computeUnits.Value.Value()
+		if simds := capacity.Value.Value(); cus > 0 && simds%cus == 0 {
+			step = resource.NewQuantity(simds/cus, resource.BinarySI)
+		}
+	}
+	policy := &resourceapi.CapacityRequestPolicy{
+		Default: resource.NewQuantity(0, resource.BinarySI),
+	}
+	max := ptrToCopy(capacity.Value)
+	if step != nil {
+		if capacity.Value.Cmp(*step) < 0 {
+			return policy
+		}
+		max = resource.NewQuantity(capacity.Value.Value()/step.Value()*step.Value(), resource.BinarySI)
+	}
+	policy.ValidRange = &resourceapi.CapacityRequestPolicyRange{
+		Min:  resource.NewQuantity(0, resource.BinarySI),
+		Max:  max,
+		Step: step,
+	}
+	return policy
+}
+
+// ptrToCopy returns a pointer to a copy of a quantity.
+func ptrToCopy(q resource.Quantity) *resource.Quantity {
+	return &q
+}
+
+// capacityLimitsEnv returns environment variables with the capacities each
+// device of a claim consumed, named after the capacity and suffixed with the
+// HIP index of the device, e.g. AMD_GPU_MEMORY_LIMIT_0=25769803776 for 24Gi
+// of memory. Applications can use them to stay within their share of a
+// shared device. hipIndices maps ROCm device indices to HIP indices.
+func capacityLimitsEnv(devices PreparedDevices, hipIndices map[int]int) []string {
+	// A claim may get several allocations of the same device, which add up.
+	limits := make(map[int]map[resourceapi.QualifiedName]resource.Quantity)
+	for _, device := range devices {
+		// Capacity is consumed from devices that are not repartitioned,
+		// which are backed by a single device.
+		if len(device.ConsumedCapacity) == 0 || len(device.VisibleDevices) != 1 {
+			continue
+		}
+		index, exists := hipIndices[device.VisibleDevices[0].Ordinal]
+		if !exists {
+			continue
+		}
+		if limits[index] == nil {
+			limits[index] = make(map[resourceapi.QualifiedName]resource.Quantity)
+		}
+		for name, quantity := range device.ConsumedCapacity {
+			total := limits[index][name]
+			total.Add(quantity)
+			limits[index][name] = total
+		}
+	}
+
+	var env []string
+	for _, index := range slices.Sorted(maps.Keys(limits)) {
+		for _, name := range slices.Sorted(maps.Keys(limits[index])) {
+			quantity := limits[index][name]
+			if name == replicasCapacity || quantity.IsZero() {
+				continue
+			}
+			env = append(env, fmt.Sprintf("AMD_GPU_%s_LIMIT_%d=%d", capacityEnvName(name), index, quantity.Value()))
+		}
+	}
+	return env
+}
+
+// capacityEnvName converts a capacity name to upper snake case, e.g.
+// "computeUnits" to "COMPUTE_UNITS".
+func capacityEnvName(name resourceapi.QualifiedName) string {
+	var b strings.Builder
+	for i, r := range string(name) {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
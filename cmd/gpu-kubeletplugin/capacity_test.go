@@ -0,0 +1,148 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+func TestCapacityEnvName(t *testing.T) {
+	tests := map[resourceapi.QualifiedName]string{
+		"memory":       "MEMORY",
+		"computeUnits": "COMPUTE_UNITS",
+		"simdUnits":    "SIMD_UNITS",
+	}
+
+	for name, expected := range tests {
+		t.Run(string(name), func(t *testing.T) {
+			assert.Equal(t, expected, capacityEnvName(name))
+		})
+	}
+}
+
+// validateCapacityRequestPolicy returns the violations of the rules the API
+// server checks the request policy of a capacity against, see
+// validateRequestPolicyRange in k8s.io/kubernetes/pkg/apis/resource/validation.
+func validateCapacityRequestPolicy(capacity resourceapi.DeviceCapacity) []string {
+	policy := capacity.RequestPolicy
+	if policy == nil {
+		return nil
+	}
+	if policy.ValidRange == nil {
+		return nil
+	}
+	if policy.Default == nil {
+		return []string{"default required"}
+	}
+	r, value, def := policy.ValidRange, capacity.Value, *policy.Default
+	if r.Min == nil {
+		return []string{"min required"}
+	}
+	var errs []string
+	if r.Min.Cmp(value) > 0 {
+		errs = append(errs, fmt.Sprintf("min %s is larger than capacity %s", r.Min, &value))
+	}
+	if def.Cmp(*r.Min) < 0 {
+		errs = append(errs, fmt.Sprintf("default %s is less than min %s", &def, r.Min))
+	}
+	if r.Max != nil {
+		if r.Min.Cmp(*r.Max) > 0 {
+			errs = append(errs, fmt.Sprintf("min %s is larger than max %s", r.Min, r.Max))
+		}
+		if r.Max.Cmp(value) > 0 {
+			errs = append(errs, fmt.Sprintf("max %s is larger than capacity %s", r.Max, &value))
+		}
+		if def.Cmp(*r.Max) > 0 {
+			errs = append(errs, fmt.Sprintf("default %s is more than max %s", &def, r.Max))
+		}
+	}
+	if r.Step != nil {
+		added := r.Min.DeepCopy()
+		added.Add(*r.Step)
+		if added.Cmp(value) > 0 {
+			errs = append(errs, fmt.Sprintf("one step %s is larger than capacity %s", &added, &value))
+		}
+		if (def.Value()-r.Min.Value())%r.Step.Value() != 0 {
+			errs = append(errs, fmt.Sprintf("default %s is not a multiple of step %s", &def, r.Step))
+		}
+		if r.Max != nil && (r.Max.Value()-r.Min.Value())%r.Step.Value() != 0 {
+			errs = append(errs, fmt.Sprintf("max %s is not a multiple of step %s", r.Max, r.Step))
+		}
+	}
+	return errs
+}
+
+func TestCapacityRequestPolicy(t *testing.T) {
+	tests := map[string]struct {
+		memory       int64
+		computeUnits int64
+		simdUnits    int64
+		maxMemory    *int64 // nil if memory has no valid range
+	}{
+		"whole GiB": {
+			memory:       192 << 30,
+			computeUnits: 304,
+			simdUnits:    1216,
+			maxMemory:    ptr.To(int64(192 << 30)),
+		},
+		// VRAM sizes reported by the driver are rarely whole GiB.
+		"not a multiple of the step": {
+			memory:       (191 << 30) + (742 << 20),
+			computeUnits: 38,
+			simdUnits:    152,
+			maxMemory:    ptr.To(int64(191 << 30)),
+		},
+		"smaller than the step": {
+			memory:       512 << 20,
+			computeUnits: 1,
+			simdUnits:    3,
+		},
+		"zero": {
+			memory: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			device := &resourceapi.Device{
+				Name: "gpu-0",
+				Capacity: map[resourceapi.QualifiedName]resourceapi.DeviceCapacity{
+					"memory":       {Value: *resource.NewQuantity(test.memory, resource.BinarySI)},
+					"computeUnits": {Value: *resource.NewQuantity(test.computeUnits, resource.BinarySI)},
+					"simdUnits":    {Value: *resource.NewQuantity(test.simdUnits, resource.BinarySI)},
+				},
+			}
+			shareDevice(device, 4)
+			for name, capacity := range device.Capacity {
+				assert.Empty(t, validateCapacityRequestPolicy(capacity), name)
+			}
+
+			memory := device.Capacity["memory"].RequestPolicy
+			if test.maxMemory == nil {
+				assert.Nil(t, memory.ValidRange)
+			} else {
+				assert.Equal(t, *test.maxMemory, memory.ValidRange.Max.Value())
+			}
+		})
+	}
+}
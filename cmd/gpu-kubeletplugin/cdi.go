@@ -35,6 +35,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 	klog "k8s.io/klog/v2"
@@ -53,18 +55,27 @@ const (
 )
 
 type CDIHandler struct {
-	cache *cdiapi.Cache
+	cache   *cdiapi.Cache
+	cdiRoot string
+	// topologyRoot holds the topology files of the claims. It is below the
+	// plugin directory, which has the same path on the host.
+	topologyRoot string
 }
 
 func NewCDIHandler(config *Config) (*CDIHandler, error) {
+	// The cache is only used to write and remove spec files, refreshing it
+	// on every spec file written would read all of them again.
 	cache, err := cdiapi.NewCache(
 		cdiapi.WithSpecDirs(config.flags.cdiRoot),
+		cdiapi.WithAutoRefresh(false),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create a new CDI cache: %w", err)
 	}
 	handler := &CDIHandler{
-		cache: cache,
+		cache:        cache,
+		cdiRoot:      config.flags.cdiRoot,
+		topologyRoot: filepath.Join(config.DriverPluginPath(), "topology"),
 	}
 
 	return handler, nil
@@ -103,9 +114,27 @@ func (cdi *CDIHandler) CreateCommonSpecFile() error {
 func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices PreparedDevices) error {
 	specName := cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, claimUID)
 
+	// The claim-wide edits apply to every container that gets any device of
+	// the claim and list all of its GPUs and partitions and their NUMA nodes.
 	spec := &cdispec.Spec{
 		Kind:    cdiKind,
 		Devices: []cdispec.Device{},
+		ContainerEdits: cdispec.ContainerEdits{
+			Env: append(visibleDevicesEnv(devices), numaEnv(devices)...),
+		},
+	}
+
+	if topologyFileRequested(devices) {
+		hostPath, err := cdi.writeTopologyFile(claimUID, devices)
+		if err != nil {
+			return err
+		}
+		spec.ContainerEdits.Mounts = []*cdispec.Mount{{
+			HostPath:      hostPath,
+			ContainerPath: topologyFileContainerPath,
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		}}
+		spec.ContainerEdits.Env = append(spec.ContainerEdits.Env, "AMD_GPU_TOPOLOGY_FILE="+topologyFileContainerPath)
 	}
 
 	for _, device := range devices {
@@ -132,9 +161,52 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices PreparedDevi
 
 func (cdi *CDIHandler) DeleteClaimSpecFile(claimUID string) error {
 	specName := cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, claimUID)
+	if err := os.Remove(cdi.topologyFilePath(claimUID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove topology file: %w", err)
+	}
 	return cdi.cache.RemoveSpec(specName)
 }
 
+func (cdi *CDIHandler) topologyFilePath(claimUID string) string {
+	return filepath.Join(cdi.topologyRoot, claimUID+".json")
+}
+
+// writeTopologyFile writes the topology file of a claim and returns its path.
+// It is readable by all users since containers need not run as root.
+func (cdi *CDIHandler) writeTopologyFile(claimUID string, devices PreparedDevices) (string, error) {
+	content, err := topologyFile(devices)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode topology file: %w", err)
+	}
+	if err := os.MkdirAll(cdi.topologyRoot, 0755); err != nil {
+		return "", fmt.Errorf("unable to create topology file directory: %w", err)
+	}
+	path := cdi.topologyFilePath(claimUID)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return "", fmt.Errorf("unable to write topology file: %w", err)
+	}
+	return path, nil
+}
+
+// ListClaimSpecFiles returns the UIDs of the claims that have a CDI spec file
+// in the CDI root. The spec file for common edits is named like a claim spec
+// file and is left out.
+func (cdi *CDIHandler) ListClaimSpecFiles() ([]string, error) {
+	entries, err := os.ReadDir(cdi.cdiRoot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list CDI spec files: %w", err)
+	}
+	prefix := cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, "")
+	var claimUIDs []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if uid, found := strings.CutPrefix(name, prefix); found && !entry.IsDir() && uid != "" && uid != cdiCommonDeviceName {
+			claimUIDs = append(claimUIDs, uid)
+		}
+	}
+	return claimUIDs, nil
+}
+
 func (cdi *CDIHandler) GetClaimDevices(claimUID string, devices []string) []string {
 	cdiDevices := []string{
 		cdiparser.QualifiedName(cdiVendor, cdiClass, cdiCommonDeviceName),
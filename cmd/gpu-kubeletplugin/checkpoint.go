@@ -33,29 +33,105 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager/checksum"
 )
 
+// ClaimCheckpointState is the phase of preparing or unpreparing a claim that
+// was reached. Prepare and Unprepare record the phase they start before
+// touching any device, so that a plugin restart in the middle of either can
+// tell what is left to finish or roll back.
+type ClaimCheckpointState string
+
+// These constants represent the checkpoint states of a claim.
+const (
+	// ClaimCheckpointStatePrepareStarted is recorded before a claim is
+	// prepared. A claim left in this state is rolled back.
+	ClaimCheckpointStatePrepareStarted ClaimCheckpointState = "PrepareStarted"
+	// ClaimCheckpointStatePrepareCompleted is recorded once the devices and
+	// the CDI spec of a claim are prepared.
+	ClaimCheckpointStatePrepareCompleted ClaimCheckpointState = "PrepareCompleted"
+	// ClaimCheckpointStateUnprepareStarted is recorded before a claim is
+	// unprepared. A claim left in this state is unprepared again.
+	ClaimCheckpointStateUnprepareStarted ClaimCheckpointState = "UnprepareStarted"
+)
+
 type Checkpoint struct {
 	Checksum checksum.Checksum `json:"checksum"`
 	V1       *CheckpointV1     `json:"v1,omitempty"`
+	V2       *CheckpointV2     `json:"v2,omitempty"`
 }
 
+// CheckpointV1 is the checkpoint of earlier versions of the plugin, which
+// only recorded claims once they were prepared. It is migrated to
+// CheckpointV2 when read.
 type CheckpointV1 struct {
+	PreparedClaims map[string]PreparedDevices `json:"preparedClaims,omitempty"`
+}
+
+type CheckpointV2 struct {
 	PreparedClaims PreparedClaims `json:"preparedClaims,omitempty"`
 }
 
+// PreparedClaim is the checkpoint of a claim that is being prepared, is
+// prepared or is being unprepared.
+type PreparedClaim struct {
+	CheckpointState ClaimCheckpointState `json:"checkpointState"`
+	Namespace       string               `json:"namespace,omitempty"`
+	Name            string               `json:"name,omitempty"`
+
+	PrepareStarted   time.Time `json:"prepareStarted,omitzero"`
+	PrepareCompleted time.Time `json:"prepareCompleted,omitzero"`
+	UnprepareStarted time.Time `json:"unprepareStarted,omitzero"`
+
+	// PreparedDevices are set once the claim is prepared.
+	PreparedDevices PreparedDevices `json:"preparedDevices,omitempty"`
+	// Changes are the sysfs settings of GPUs changed while preparing the
+	// claim, with the values they had before. Each one is recorded before
+	// the change is made, so that a prepare that did not complete can be
+	// rolled back.
+	Changes []DeviceSettings `json:"changes,omitempty"`
+}
+
 func newCheckpoint() *Checkpoint {
 	pc := &Checkpoint{
 		Checksum: 0,
-		V1: &CheckpointV1{
+		V2: &CheckpointV2{
 			PreparedClaims: make(PreparedClaims),
 		},
 	}
 	return pc
 }
 
+// ToLatestVersion converts a checkpoint to CheckpointV2. Claims of a V1
+// checkpoint were recorded once prepared, so they become PrepareCompleted
+// claims without name, namespace or timestamps. They are not migrated as
+// PrepareStarted, since the plugin rolls those back at startup and would tear
+// down claims that running pods use. A zero PrepareStarted never counts as
+// started after a listing of the ResourceClaims, so the first reconciliation
+// checks migrated claims against the API server and unprepares the ones that
+// are no longer live; Prepare returns the devices of the others as recorded.
+func (cp *Checkpoint) ToLatestVersion() *Checkpoint {
+	latest := newCheckpoint()
+	if cp.V2 != nil {
+		for uid, claim := range cp.V2.PreparedClaims {
+			latest.V2.PreparedClaims[uid] = claim
+		}
+		return latest
+	}
+	if cp.V1 != nil {
+		for uid, devices := range cp.V1.PreparedClaims {
+			latest.V2.PreparedClaims[uid] = &PreparedClaim{
+				CheckpointState: ClaimCheckpointStatePrepareCompleted,
+				PreparedDevices: devices,
+			}
+		}
+	}
+	return latest
+}
+
 func (cp *Checkpoint) MarshalCheckpoint() ([]byte, error) {
 	cp.Checksum = 0
 	out, err := json.Marshal(*cp)
@@ -82,3 +158,40 @@ func (cp *Checkpoint) VerifyChecksum() error {
 	}
 	return ck.Verify(out)
 }
+
+// loadCheckpoint reads the checkpoint file of the plugin, migrated to the
+// latest version, into memory.
+func (s *DeviceState) loadCheckpoint() error {
+	checkpoint := &Checkpoint{}
+	if err := s.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
+		return fmt.Errorf("unable to sync from checkpoint: %v", err)
+	}
+	s.checkpoint = checkpoint.ToLatestVersion()
+	return nil
+}
+
+// saveCheckpoint writes the in-memory checkpoint of the plugin. Must be
+// called with the state locked.
+func (s *DeviceState) saveCheckpoint() error {
+	start := time.Now()
+	err := s.checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, s.checkpoint)
+	checkpointWriteDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return withReason(reasonCheckpointFailed, fmt.Errorf("unable to sync to checkpoint: %v", err))
+	}
+	recordPreparedClaims(s.checkpoint)
+	return nil
+}
+
+// recordChange records a sysfs setting of a GPU, with the value it has
+// before it is changed for a claim being prepared. Changes are only recorded
+// for claims that started to prepare, and are written right away. Must be
+// called with the state locked.
+func (s *DeviceState) recordChange(claimUID string, change DeviceSettings) error {
+	claim := s.checkpoint.V2.PreparedClaims[claimUID]
+	if claim == nil || claim.CheckpointState != ClaimCheckpointStatePrepareStarted {
+		return nil
+	}
+	claim.Changes = append(claim.Changes, change)
+	return s.saveCheckpoint()
+}
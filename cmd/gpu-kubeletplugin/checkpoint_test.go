@@ -0,0 +1,156 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	"k8s.io/utils/ptr"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestCheckpointToLatestVersion(t *testing.T) {
+	devices := PreparedDevices{{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}}}
+	started := &PreparedClaim{CheckpointState: ClaimCheckpointStatePrepareStarted, Name: "claim"}
+
+	tests := map[string]struct {
+		checkpoint *Checkpoint
+		expected   PreparedClaims
+	}{
+		"empty": {
+			checkpoint: &Checkpoint{},
+			expected:   PreparedClaims{},
+		},
+		"V1": {
+			checkpoint: &Checkpoint{
+				V1: &CheckpointV1{PreparedClaims: map[string]PreparedDevices{"claim-uid": devices}},
+			},
+			expected: PreparedClaims{
+				"claim-uid": {
+					CheckpointState: ClaimCheckpointStatePrepareCompleted,
+					PreparedDevices: devices,
+				},
+			},
+		},
+		"V2": {
+			checkpoint: &Checkpoint{
+				V2: &CheckpointV2{PreparedClaims: PreparedClaims{"claim-uid": started}},
+			},
+			expected: PreparedClaims{"claim-uid": started},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			latest := test.checkpoint.ToLatestVersion()
+			assert.Nil(t, latest.V1)
+			assert.Equal(t, test.expected, latest.V2.PreparedClaims)
+		})
+	}
+}
+
+func newTestCDIHandler(t testing.TB) (*CDIHandler, string) {
+	cdiRoot := t.TempDir()
+	cdi, err := NewCDIHandler(&Config{flags: &Flags{cdiRoot: cdiRoot, kubeletPluginsDirectoryPath: t.TempDir()}})
+	require.NoError(t, err)
+	return cdi, cdiRoot
+}
+
+func TestDeviceStateRecoverCheckpointMigratesV1(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	devices := PreparedDevices{{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}}}
+	require.NoError(t, state.checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, &Checkpoint{
+		V1: &CheckpointV1{PreparedClaims: map[string]PreparedDevices{"live": devices, "stale": devices}},
+	}))
+
+	require.NoError(t, state.recoverCheckpoint())
+
+	checkpoint := &Checkpoint{}
+	require.NoError(t, state.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint))
+	assert.Nil(t, checkpoint.V1)
+	assert.Equal(t, PreparedClaims{"live": preparedClaim(devices), "stale": preparedClaim(devices)}, checkpoint.V2.PreparedClaims)
+	for _, claim := range checkpoint.V2.PreparedClaims {
+		assert.True(t, claim.PrepareStarted.IsZero())
+	}
+
+	// Migrated claims are checked by the first reconciliation, whenever the
+	// claims were listed.
+	cdi, _ := newTestCDIHandler(t)
+	state.cdi = cdi
+	changed, err := state.Reconcile(sets.New("live"), time.Time{})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	checkpoint = &Checkpoint{}
+	require.NoError(t, state.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint))
+	assert.Equal(t, PreparedClaims{"live": preparedClaim(devices)}, checkpoint.V2.PreparedClaims)
+}
+
+func TestDeviceStateRecoverCheckpoint(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	cdi, cdiRoot := newTestCDIHandler(t)
+	state.cdi = cdi
+
+	// A prepare that changed the power cap of a GPU and wrote the CDI spec
+	// of the claim, but did not complete.
+	checkpoint := newCheckpoint()
+	checkpoint.V2.PreparedClaims["started"] = &PreparedClaim{CheckpointState: ClaimCheckpointStatePrepareStarted}
+	checkpoint.V2.PreparedClaims["unpreparing"] = &PreparedClaim{
+		CheckpointState: ClaimCheckpointStateUnprepareStarted,
+		PreparedDevices: PreparedDevices{{Device: drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"}}},
+	}
+	checkpoint.V2.PreparedClaims["completed"] = preparedClaim(PreparedDevices{
+		{Device: drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"}},
+	})
+	state.checkpoint = checkpoint
+	require.NoError(t, state.saveCheckpoint())
+	_, err := state.applyPerformance("started", &configapi.PerformanceConfig{PowerCap: ptr.To(500)}, []string{"0000:03:00.0"}, checkpoint)
+	require.NoError(t, err)
+	require.NoError(t, cdi.CreateClaimSpecFile("started", PreparedDevices{{
+		Device:         drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"},
+		ContainerEdits: &cdiapi.ContainerEdits{ContainerEdits: &cdispec.ContainerEdits{Env: []string{"FOO=bar"}}},
+	}}))
+	specFiles := filepath.Join(cdiRoot, cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, "started")+".*")
+	matches, err := filepath.Glob(specFiles)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+
+	require.NoError(t, state.recoverCheckpoint())
+
+	settings, err := amdgpu.GetPowerSettings("0000:03:00.0", state.hostRoot)
+	require.NoError(t, err)
+	assert.Equal(t, ptr.To[int64](750000000), settings.PowerCap)
+	matches, err = filepath.Glob(specFiles)
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	checkpoint = &Checkpoint{}
+	require.NoError(t, state.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint))
+	assert.Equal(t, []string{"completed"}, slices.Collect(maps.Keys(checkpoint.V2.PreparedClaims)))
+}
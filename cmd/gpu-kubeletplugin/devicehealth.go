@@ -0,0 +1,216 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
+)
+
+const (
+	// RASTaintKey is the key of the taint put on devices whose RAS counters
+	// exceeded a threshold. Its value names the first exceeded condition,
+	// e.g. "umc_ue".
+	RASTaintKey = consts.DriverName + "/ras-error"
+
+	// DefaultRASThresholds treats any uncorrectable error as fatal.
+	DefaultRASThresholds = "ue=1"
+
+	// rasBadPagesThreshold is the threshold key for retired VRAM pages.
+	rasBadPagesThreshold = "bad_pages"
+)
+
+// rasThresholds maps a condition to the count at which it becomes fatal. Keys
+// are "ue" and "ce" for the uncorrectable and correctable errors of any RAS
+// block, "<block>_ue" and "<block>_ce" (e.g. "umc_ce") to override them for a
+// single block, and "bad_pages" for retired and pending VRAM pages. A
+// threshold of 0 disables the condition.
+type rasThresholds map[string]uint64
+
+// parseRASThresholds parses a comma separated list of <condition>=<count>.
+func parseRASThresholds(spec string) (rasThresholds, error) {
+	thresholds := make(rasThresholds)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid RAS threshold %q: expected <condition>=<count>", entry)
+		}
+		key = strings.TrimSpace(key)
+		if key != rasBadPagesThreshold && key != "ue" && key != "ce" &&
+			!strings.HasSuffix(key, "_ue") && !strings.HasSuffix(key, "_ce") {
+			return nil, fmt.Errorf("invalid RAS threshold %q: unknown condition %q", entry, key)
+		}
+		count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RAS threshold %q: %w", entry, err)
+		}
+		thresholds[key] = count
+	}
+	return thresholds, nil
+}
+
+// limit returns the threshold of an error kind ("ue" or "ce") for a block.
+func (t rasThresholds) limit(block, kind string) uint64 {
+	if limit, exists := t[block+"_"+kind]; exists {
+		return limit
+	}
+	return t[kind]
+}
+
+// exceeded returns the conditions of a RAS status that reached their
+// threshold, ordered by name.
+func (t rasThresholds) exceeded(status *amdgpu.RASStatus) []string {
+	var conditions []string
+	for _, block := range slices.Sorted(maps.Keys(status.ErrorCounts)) {
+		count := status.ErrorCounts[block]
+		if limit := t.limit(block, "ce"); limit > 0 && count.Correctable >= limit {
+			conditions = append(conditions, block+"_ce")
+		}
+		if limit := t.limit(block, "ue"); limit > 0 && count.Uncorrectable >= limit {
+			conditions = append(conditions, block+"_ue")
+		}
+	}
+	if limit := t[rasBadPagesThreshold]; limit > 0 && uint64(status.BadPages+status.PendingBadPages) >= limit {
+		conditions = append(conditions, rasBadPagesThreshold)
+	}
+	slices.Sort(conditions)
+	return conditions
+}
+
+// parseTaintEffect validates the effect of RAS taints.
+func parseTaintEffect(effect string) (resourceapi.DeviceTaintEffect, error) {
+	switch e := resourceapi.DeviceTaintEffect(effect); e {
+	case resourceapi.DeviceTaintEffectNoSchedule, resourceapi.DeviceTaintEffectNoExecute:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid taint effect %q: must be %s or %s", effect,
+		resourceapi.DeviceTaintEffectNoSchedule, resourceapi.DeviceTaintEffectNoExecute)
+}
+
+// UpdateHealth reads the RAS counters of all GPUs and updates the taints of
+// the GPUs and their partitions. GPUs whose counters cannot be read keep
+// their taints. It reports whether any taint or the set of
+// GPUs whose counters could not be read changed.
+func (s *DeviceState) UpdateHealth() bool {
+	s.Lock()
+	pciAddrs := make(map[string]struct{})
+	for _, device := range s.allocatable {
+		for _, pciAddr := range device.GPUs() {
+			pciAddrs[pciAddr] = struct{}{}
+		}
+	}
+	s.Unlock()
+
+	conditions := make(map[string][]string)
+	read := sets.New[string]()
+	unknown := sets.New[string]()
+	for pciAddr := range pciAddrs {
+		status, err := amdgpu.GetRASStatus(pciAddr, s.hostRoot)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			klog.Warningf("Failed to read RAS status of %s: %v", pciAddr, err)
+			unknown.Insert(pciAddr)
+			continue
+		}
+		read.Insert(pciAddr)
+		if exceeded := s.rasThresholds.exceeded(status); len(exceeded) > 0 {
+			conditions[pciAddr] = exceeded
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	changed := !unknown.Equal(s.rasUnknown)
+	s.rasUnknown = unknown
+
+	// A taint is only removed once the counters of its GPU are read again
+	// and are below the thresholds, not when they cannot be read.
+	for pciAddr, taint := range s.rasTaints {
+		if _, exists := conditions[pciAddr]; !exists && !read.Has(pciAddr) {
+			continue
+		} else if !exists {
+			klog.Infof("GPU %s is no longer exceeding RAS thresholds, removing taint", pciAddr)
+			delete(s.rasTaints, pciAddr)
+			changed = true
+		} else if taint.Value != conditions[pciAddr][0] || taint.Effect != s.rasTaintEffect {
+			delete(s.rasTaints, pciAddr)
+		}
+	}
+	for pciAddr, exceeded := range conditions {
+		if _, exists := s.rasTaints[pciAddr]; exists {
+			continue
+		}
+		klog.Warningf("GPU %s exceeded RAS thresholds %v, tainting it and its partitions with effect %s",
+			pciAddr, exceeded, s.rasTaintEffect)
+		s.rasTaints[pciAddr] = &resourceapi.DeviceTaint{
+			Key:       RASTaintKey,
+			Value:     exceeded[0],
+			Effect:    s.rasTaintEffect,
+			TimeAdded: &metav1.Time{Time: time.Now().Truncate(time.Second)},
+		}
+		changed = true
+	}
+	return changed
+}
+
+// rasMonitor periodically polls the RAS counters of all GPUs.
+type rasMonitor struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startRASMonitor calls update every interval until stopped.
+func startRASMonitor(ctx context.Context, interval time.Duration, update func(ctx context.Context)) *rasMonitor {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &rasMonitor{cancel: cancel}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		wait.UntilWithContext(ctx, update, interval)
+	}()
+	return m
+}
+
+// Stop stops the monitor and waits for it to finish.
+func (m *rasMonitor) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
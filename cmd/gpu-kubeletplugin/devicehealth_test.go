@@ -0,0 +1,192 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestParseRASThresholds(t *testing.T) {
+	tests := map[string]struct {
+		spec     string
+		expected rasThresholds
+		wantErr  bool
+	}{
+		"default": {
+			spec:     DefaultRASThresholds,
+			expected: rasThresholds{"ue": 1},
+		},
+		"per block overrides and bad pages": {
+			spec:     "ue=1, umc_ce=1000,sdma_ue=0,bad_pages=64",
+			expected: rasThresholds{"ue": 1, "umc_ce": 1000, "sdma_ue": 0, "bad_pages": 64},
+		},
+		"empty": {
+			spec:     "",
+			expected: rasThresholds{},
+		},
+		"missing count": {
+			spec:    "ue",
+			wantErr: true,
+		},
+		"unknown condition": {
+			spec:    "umc=1",
+			wantErr: true,
+		},
+		"negative count": {
+			spec:    "ce=-1",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			thresholds, err := parseRASThresholds(test.spec)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, thresholds)
+		})
+	}
+}
+
+func TestRASThresholdsExceeded(t *testing.T) {
+	status := &amdgpu.RASStatus{
+		ErrorCounts: map[string]amdgpu.RASErrorCount{
+			"umc":  {Uncorrectable: 2, Correctable: 12},
+			"sdma": {Correctable: 5},
+			"gfx":  {},
+		},
+		BadPages:        2,
+		PendingBadPages: 1,
+	}
+
+	tests := map[string]struct {
+		thresholds rasThresholds
+		expected   []string
+	}{
+		"uncorrectable errors": {
+			thresholds: rasThresholds{"ue": 1},
+			expected:   []string{"umc_ue"},
+		},
+		"block override disables a condition": {
+			thresholds: rasThresholds{"ue": 1, "umc_ue": 0},
+		},
+		"correctable errors and bad pages": {
+			thresholds: rasThresholds{"ce": 10, "sdma_ce": 5, "bad_pages": 3},
+			expected:   []string{"bad_pages", "sdma_ce", "umc_ce"},
+		},
+		"below thresholds": {
+			thresholds: rasThresholds{"ue": 3, "ce": 100, "bad_pages": 4},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.thresholds.exceeded(status))
+		})
+	}
+}
+
+func TestParseTaintEffect(t *testing.T) {
+	effect, err := parseTaintEffect("NoExecute")
+	require.NoError(t, err)
+	assert.Equal(t, resourceapi.DeviceTaintEffectNoExecute, effect)
+
+	_, err = parseTaintEffect("PreferNoSchedule")
+	assert.Error(t, err)
+}
+
+func TestDeviceStateUpdateHealth(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XRAS))
+
+	assert.True(t, state.UpdateHealth())
+	assert.False(t, state.UpdateHealth(), "unchanged RAS counters")
+
+	taints := make(map[string][]resourceapi.DeviceTaint)
+	for _, device := range state.PublishedDevices() {
+		taints[device.Name] = device.Taints
+	}
+	require.Len(t, taints["gpu-43d0a94e5d4cf437"], 1)
+	taint := taints["gpu-43d0a94e5d4cf437"][0]
+	assert.Equal(t, RASTaintKey, taint.Key)
+	assert.Equal(t, "umc_ue", taint.Value)
+	assert.Equal(t, resourceapi.DeviceTaintEffectNoSchedule, taint.Effect)
+	assert.NotNil(t, taint.TimeAdded)
+	assert.Empty(t, taints["gpu-9c1a3b4fe2d07a11"], "correctable errors only")
+}
+
+func TestDeviceStateUpdateHealthPartitions(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+	state := newTestDeviceState(t, root)
+	state.rasTaintEffect = resourceapi.DeviceTaintEffectNoExecute
+	assert.False(t, state.UpdateHealth())
+
+	umc := filepath.Join(root, "sys/bus/pci/devices/0000:23:00.0/ras/umc_err_count")
+	require.NoError(t, os.WriteFile(umc, []byte("ue: 1\nce: 0\n"), 0644))
+	assert.True(t, state.UpdateHealth())
+
+	// All partitions of the failing GPU are tainted, the other GPU is not.
+	tainted := 0
+	for _, device := range state.PublishedDevices() {
+		if device.Attributes["parentPciAddr"].StringValue != nil && *device.Attributes["parentPciAddr"].StringValue == "0000:23:00.0" {
+			require.Len(t, device.Taints, 1)
+			assert.Equal(t, resourceapi.DeviceTaintEffectNoExecute, device.Taints[0].Effect)
+			tainted++
+		} else {
+			assert.Empty(t, device.Taints)
+		}
+	}
+	assert.Equal(t, 8, tainted)
+
+	// The taint is removed once the counters are reset, e.g. by a GPU reset.
+	require.NoError(t, os.WriteFile(umc, []byte("ue: 0\nce: 0\n"), 0644))
+	assert.True(t, state.UpdateHealth())
+	for _, device := range state.PublishedDevices() {
+		assert.Empty(t, device.Taints)
+	}
+}
+
+func TestDeviceStateUpdateHealthReadFailure(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+	state := newTestDeviceState(t, root)
+	umc := filepath.Join(root, "sys/bus/pci/devices/0000:23:00.0/ras/umc_err_count")
+	require.NoError(t, os.WriteFile(umc, []byte("ue: 1\nce: 0\n"), 0644))
+	assert.True(t, state.UpdateHealth())
+	require.Contains(t, state.rasTaints, "0000:23:00.0")
+
+	// A GPU known to be bad stays tainted while its counters cannot be read.
+	require.NoError(t, os.WriteFile(umc, []byte("ue: garbage\n"), 0644))
+	assert.True(t, state.UpdateHealth(), "counters became unknown")
+	assert.Contains(t, state.rasTaints, "0000:23:00.0")
+	assert.True(t, state.rasUnknown.Has("0000:23:00.0"))
+
+	// It is untainted once a read finds the counters below the thresholds.
+	require.NoError(t, os.WriteFile(umc, []byte("ue: 0\nce: 0\n"), 0644))
+	assert.True(t, state.UpdateHealth())
+	assert.NotContains(t, state.rasTaints, "0000:23:00.0")
+}
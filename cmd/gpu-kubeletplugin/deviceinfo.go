@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	resourceapi "k8s.io/api/resource/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -30,6 +31,8 @@ type AmdGpuInfo struct {
 	UUID             string
 	RenderIndex      int
 	CardIndex        int
+	KFDGPUID         int // 0 if unknown
+	Ordinal          int // ROCm device index, -1 if unknown
 	ProductName      string
 	Family           string
 	DeviceID         string
@@ -42,23 +45,78 @@ type AmdGpuInfo struct {
 	SimdUnits        int
 	// PCIe root attribute for topology awareness
 	pcieRootAttr deviceattribute.DeviceAttribute
+	// XGMI hive of the GPU, 0 if it is in none, and the number of GPUs it
+	// has a direct XGMI link to
+	HiveID    uint64
+	XGMILinks int
+	// Upstream port of the nearest PCIe switch above the GPU, empty if it
+	// is directly below a root port, and the RDMA NICs below that switch
+	PCIeSwitch string
+	RDMANICs   []string
+	// NUMA node of the GPU, -1 if unknown, and the CPUs local to it
+	NumaNode  int
+	LocalCPUs string
+
+	// Set when partitionable devices are published: the partition layout
+	// the device belongs to, the counters it consumes and the counters
+	// shared by all devices of the GPU. When hive devices are published
+	// instead, the device consumes a counter of its GPU from the counters
+	// shared by the devices of its hive.
+	Layout           *partitionLayout
+	ConsumesCounters []resourceapi.DeviceCounterConsumption
+	CounterSet       *resourceapi.CounterSet
 }
 
 // AmdPartitionInfo represents a partition of an AMD GPU
 type AmdPartitionInfo struct {
 	Parent           *AmdGpuInfo // Reference to parent GPU
 	UUID             string
-	RenderIndex      int
-	CardIndex        int
+	Index            int
+	RenderIndex      int // -1 if the partition does not exist in the current layout
+	CardIndex        int // -1 if the partition does not exist in the current layout
+	KFDGPUID         int // 0 if unknown or the partition does not exist
+	Ordinal          int // ROCm device index, -1 if unknown or the partition does not exist
 	PartitionProfile string
 	MemoryBytes      uint64
 	ComputeUnits     int
 	SimdUnits        int
+	// NUMA node of the partition's memory, -1 if unknown, and the CPUs
+	// local to it. Those of the parent unless its VRAM is split into
+	// several memory partitions.
+	NumaNode  int
+	LocalCPUs string
+
+	// Set when partitionable or hive devices are published, see AmdGpuInfo.
+	Layout           *partitionLayout
+	ConsumesCounters []resourceapi.DeviceCounterConsumption
+}
+
+// AmdHiveInfo represents all GPUs of an XGMI hive, which are allocated
+// together
+type AmdHiveInfo struct {
+	HiveID uint64
+	GPUs   []*AmdGpuInfo // ordered by PCI address
+
+	// The counters shared by the hive device and the devices of its GPUs,
+	// of which the hive device consumes all.
+	CounterSet       *resourceapi.CounterSet
+	ConsumesCounters []resourceapi.DeviceCounterConsumption
+}
+
+// deviceNameReplacer maps the characters of a UUID that are not valid in a
+// DRA device name (a DNS label) to dashes.
+var deviceNameReplacer = strings.NewReplacer(":", "-", ".", "-", "_", "-")
+
+// deviceNameFromUUID derives a device name from a UUID, e.g.
+// "GPU-9c1a3b4fe2d07a11-XCP3" becomes "gpu-9c1a3b4fe2d07a11-xcp3". Unlike DRM
+// minor numbers the UUID does not change across reboots or driver reloads.
+func deviceNameFromUUID(uuid string) string {
+	return strings.ToLower(deviceNameReplacer.Replace(uuid))
 }
 
 // CanonicalName returns the canonical name for this GPU
 func (d *AmdGpuInfo) CanonicalName() string {
-	return fmt.Sprintf("gpu-%v-%v", d.CardIndex, d.RenderIndex)
+	return deviceNameFromUUID(d.UUID)
 }
 
 // GetDevice returns the DRA Device representation for a full AMD GPU
@@ -67,6 +125,9 @@ func (d *AmdGpuInfo) GetDevice() resourceapi.Device {
 		"type": {
 			StringValue: ptr.To(AmdGpuDeviceType),
 		},
+		"uuid": {
+			StringValue: ptr.To(d.UUID),
+		},
 		"pciAddr": {
 			StringValue: ptr.To(d.PCIAddress),
 		},
@@ -91,9 +152,11 @@ func (d *AmdGpuInfo) GetDevice() resourceapi.Device {
 		"driverSrcVersion": {
 			StringValue: ptr.To(d.DriverSrcVersion),
 		},
-		"partitionProfile": {
-			StringValue: ptr.To(d.PartitionProfile),
-		},
+	}
+
+	// GPUs that do not support partitioning have no partition profile
+	if d.PartitionProfile != "" {
+		attributes["partitionProfile"] = resourceapi.DeviceAttribute{StringValue: ptr.To(d.PartitionProfile)}
 	}
 
 	// Add PCIe root attribute if available
@@ -101,6 +164,10 @@ func (d *AmdGpuInfo) GetDevice() resourceapi.Device {
 		attributes[d.pcieRootAttr.Name] = d.pcieRootAttr.Value
 	}
 
+	d.addXGMIAttributes(attributes)
+	d.addPCIeSwitchAttributes(attributes)
+	addNumaAttributes(attributes, d.NumaNode, d.LocalCPUs)
+
 	return resourceapi.Device{
 		Name:       d.CanonicalName(),
 		Attributes: attributes,
@@ -115,12 +182,72 @@ func (d *AmdGpuInfo) GetDevice() resourceapi.Device {
 				Value: *resource.NewQuantity(int64(d.SimdUnits), resource.BinarySI),
 			},
 		},
+		ConsumesCounters: d.ConsumesCounters,
+	}
+}
+
+// addXGMIAttributes adds the XGMI hive of a GPU and its number of XGMI links
+// to the attributes of its devices, unless it is in no hive. Devices of the
+// same hive can then be picked with matchAttribute on xgmiHiveID.
+func (d *AmdGpuInfo) addXGMIAttributes(attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute) {
+	if d.HiveID == 0 {
+		return
 	}
+	attributes["xgmiHiveID"] = resourceapi.DeviceAttribute{StringValue: ptr.To(fmt.Sprintf("0x%016x", d.HiveID))}
+	attributes["xgmiLinks"] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(d.XGMILinks))}
 }
 
-// CanonicalName returns the canonical name for this partition
+// addPCIeSwitchAttributes adds the nearest PCIe switch above a GPU and the
+// RDMA NICs below it to the attributes of its devices, unless the GPU is
+// directly below a root port. A claim for a GPU and an RDMA NIC can then keep
+// both below the same switch for GPUDirect RDMA. The NICs are published as
+// their number and as their sorted PCI addresses joined by commas, which
+// claims split to match whole addresses. The addresses are left out if they
+// exceed the length of an attribute value, which would get the ResourceSlice
+// rejected.
+func (d *AmdGpuInfo) addPCIeSwitchAttributes(attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute) {
+	if d.PCIeSwitch == "" {
+		return
+	}
+	attributes["pcieSwitch"] = resourceapi.DeviceAttribute{StringValue: ptr.To(d.PCIeSwitch)}
+	if len(d.RDMANICs) == 0 {
+		return
+	}
+	attributes["rdmaNICCount"] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(len(d.RDMANICs)))}
+	if nics, ok := d.rdmaNICsValue(); ok {
+		attributes["rdmaNICs"] = resourceapi.DeviceAttribute{StringValue: ptr.To(nics)}
+	}
+}
+
+// rdmaNICsValue returns the value of the rdmaNICs attribute and whether it
+// fits into an attribute value.
+func (d *AmdGpuInfo) rdmaNICsValue() (string, bool) {
+	nics := strings.Join(d.RDMANICs, ",")
+	return nics, len(nics) <= resourceapi.DeviceAttributeMaxValueLength
+}
+
+// addNumaAttributes adds the NUMA node of a device and the CPUs local to it,
+// if known, so that claims can keep devices on the same NUMA node. The CPUs
+// are left out if they exceed the length of an attribute value, e.g. on hosts
+// that number CPUs alternately by socket; containers still get them through
+// AMD_GPU_LOCAL_CPUS.
+func addNumaAttributes(attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute, numaNode int, localCPUs string) {
+	if numaNode >= 0 {
+		attributes["numaNode"] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(numaNode))}
+	}
+	if localCPUs != "" && len(localCPUs) <= resourceapi.DeviceAttributeMaxValueLength {
+		attributes["localCPUList"] = resourceapi.DeviceAttribute{StringValue: ptr.To(localCPUs)}
+	}
+}
+
+// CanonicalName returns the canonical name for this partition. Partitionable
+// devices include their layout since every layout has a partition with the
+// same index, e.g. "gpu-9c1a3b4fe2d07a11-cpx-nps1-xcp3".
 func (d *AmdPartitionInfo) CanonicalName() string {
-	return fmt.Sprintf("gpu-%v-%v", d.CardIndex, d.RenderIndex)
+	if d.Layout != nil {
+		return fmt.Sprintf("%s-%s-xcp%d", d.Parent.CanonicalName(), d.Layout.name(), d.Index)
+	}
+	return deviceNameFromUUID(d.UUID)
 }
 
 // GetDevice returns the DRA Device representation for an AMD GPU partition
@@ -129,15 +256,12 @@ func (d *AmdPartitionInfo) GetDevice() resourceapi.Device {
 		"type": {
 			StringValue: ptr.To(AmdPartitionDeviceType),
 		},
+		"uuid": {
+			StringValue: ptr.To(d.UUID),
+		},
 		"parentPciAddr": {
 			StringValue: ptr.To(d.Parent.PCIAddress),
 		},
-		"cardIndex": {
-			IntValue: ptr.To(int64(d.CardIndex)),
-		},
-		"renderIndex": {
-			IntValue: ptr.To(int64(d.RenderIndex)),
-		},
 		"parentDeviceID": {
 			StringValue: ptr.To(d.Parent.DeviceID),
 		},
@@ -158,11 +282,24 @@ func (d *AmdPartitionInfo) GetDevice() resourceapi.Device {
 		},
 	}
 
+	// Partitions of other layouts have no DRM nodes until the GPU is
+	// repartitioned
+	if d.CardIndex >= 0 {
+		attributes["cardIndex"] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(d.CardIndex))}
+		attributes["renderIndex"] = resourceapi.DeviceAttribute{IntValue: ptr.To(int64(d.RenderIndex))}
+	}
+
 	// Add PCIe root attribute if available (inherited from parent)
 	if d.Parent.pcieRootAttr.Name != "" {
 		attributes[d.Parent.pcieRootAttr.Name] = d.Parent.pcieRootAttr.Value
 	}
 
+	// Partitions are linked to other GPUs by the XGMI links of their parent
+	// and share its PCIe switch
+	d.Parent.addXGMIAttributes(attributes)
+	d.Parent.addPCIeSwitchAttributes(attributes)
+	addNumaAttributes(attributes, d.NumaNode, d.LocalCPUs)
+
 	return resourceapi.Device{
 		Name:       d.CanonicalName(),
 		Attributes: attributes,
@@ -177,5 +314,71 @@ func (d *AmdPartitionInfo) GetDevice() resourceapi.Device {
 				Value: *resource.NewQuantity(int64(d.SimdUnits), resource.BinarySI),
 			},
 		},
+		ConsumesCounters: d.ConsumesCounters,
+	}
+}
+
+// hiveDeviceName returns the name of the device of an XGMI hive, e.g.
+// "hive-3b7d2a1e9f4c8065".
+func hiveDeviceName(hiveID uint64) string {
+	return fmt.Sprintf("hive-%016x", hiveID)
+}
+
+// CanonicalName returns the canonical name for this hive
+func (d *AmdHiveInfo) CanonicalName() string {
+	return hiveDeviceName(d.HiveID)
+}
+
+// GetDevice returns the DRA Device representation for an XGMI hive. Its
+// capacities are the sums of those of its GPUs.
+func (d *AmdHiveInfo) GetDevice() resourceapi.Device {
+	first := d.GPUs[0]
+	attributes := map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+		"type": {
+			StringValue: ptr.To(AmdHiveDeviceType),
+		},
+		"xgmiHiveID": {
+			StringValue: ptr.To(fmt.Sprintf("0x%016x", d.HiveID)),
+		},
+		"gpuCount": {
+			IntValue: ptr.To(int64(len(d.GPUs))),
+		},
+		"family": {
+			StringValue: ptr.To(first.Family),
+		},
+		"productName": {
+			StringValue: ptr.To(first.ProductName),
+		},
+		"driverVersion": {
+			VersionValue: ptr.To(first.DriverVersion),
+		},
+		"driverSrcVersion": {
+			StringValue: ptr.To(first.DriverSrcVersion),
+		},
+	}
+
+	var memoryBytes uint64
+	var computeUnits, simdUnits int
+	for _, gpu := range d.GPUs {
+		memoryBytes += gpu.MemoryBytes
+		computeUnits += gpu.ComputeUnits
+		simdUnits += gpu.SimdUnits
+	}
+
+	return resourceapi.Device{
+		Name:       d.CanonicalName(),
+		Attributes: attributes,
+		Capacity: map[resourceapi.QualifiedName]resourceapi.DeviceCapacity{
+			"memory": {
+				Value: *resource.NewQuantity(int64(memoryBytes), resource.BinarySI),
+			},
+			"computeUnits": {
+				Value: *resource.NewQuantity(int64(computeUnits), resource.BinarySI),
+			},
+			"simdUnits": {
+				Value: *resource.NewQuantity(int64(simdUnits), resource.BinarySI),
+			},
+		},
+		ConsumesCounters: d.ConsumesCounters,
 	}
 }
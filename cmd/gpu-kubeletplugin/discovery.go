@@ -34,137 +34,192 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/dynamic-resource-allocation/deviceattribute"
 	klog "k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
 )
 
-func parseDeviceName(name string) (int, int, error) {
-	var card, renderD int
-	_, err := fmt.Sscanf(name, "gpu-%d-%d", &card, &renderD)
+// getMemoryBytes returns the discovered VRAM size or a default if it is unknown.
+func getMemoryBytes(vramBytes, defaultBytes uint64, deviceType, pciAddr string) uint64 {
+	if vramBytes > 0 {
+		return vramBytes
+	}
+	// Fallback to default if VRAM parsing failed
+	klog.Warningf("VRAM info not available for %s %s, using default %dGB", deviceType, pciAddr, defaultBytes/(1024*1024*1024))
+	return defaultBytes
+}
+
+func getPcieInfo(pciAddr string, hostRoot string) (deviceattribute.DeviceAttribute, error) {
+	// Use the PCI address of the GPU (which is the parent's PCI address for partitions)
+	pcieRoot, err := amdgpu.GetPCIeRoot(pciAddr, hostRoot)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to parse device name %s: %v", name, err)
+		return deviceattribute.DeviceAttribute{}, fmt.Errorf("Failed to get PCIe root attribute for device %s: %v", pciAddr, err)
 	}
-	return card, renderD, nil
+
+	pcieRootAttr := deviceattribute.DeviceAttribute{
+		Name:  deviceattribute.StandardDeviceAttributePCIeRoot,
+		Value: resourceapi.DeviceAttribute{StringValue: ptr.To(pcieRoot)},
+	}
+	return pcieRootAttr, nil
 }
 
-// Helper function to extract topology information from GPU info map
-func extractTopologyInfo(gpuInfoMap map[string]interface{}) (simdUnits, computeUnits int) {
-	if simdCount, ok := gpuInfoMap["simdCount"].(int); ok {
-		simdUnits = simdCount
+// getPCIeSwitchInfo returns the upstream port of the nearest PCIe switch
+// above a GPU and the RDMA NICs below that switch.
+func getPCIeSwitchInfo(pciAddr string, hostRoot string) (string, []string, error) {
+	pcieSwitch, err := amdgpu.GetPCIeSwitch(pciAddr, hostRoot)
+	if err != nil || pcieSwitch == "" {
+		return "", nil, err
 	}
-	if cuCount, ok := gpuInfoMap["cuCount"].(int); ok {
-		computeUnits = cuCount
+	nics, err := amdgpu.GetRDMADevicesBelow(pcieSwitch, hostRoot)
+	if err != nil {
+		return pcieSwitch, nil, fmt.Errorf("Failed to list RDMA NICs below PCIe switch %s of device %s: %v", pcieSwitch, pciAddr, err)
 	}
-	return
+	return pcieSwitch, nics, nil
 }
 
-// Helper function to get memory bytes with fallback
-func getMemoryBytes(gpuInfoMap map[string]interface{}, defaultBytes uint64, deviceType, pciAddr string) uint64 {
-	if vramBytes, ok := gpuInfoMap["vramBytes"].(uint64); ok && vramBytes > 0 {
-		return vramBytes
+// getPartitionProfile returns the compute+memory profile of a GPU, e.g.
+// "spx_nps1", or an empty string for GPUs that do not support partitioning.
+func getPartitionProfile(gpu *amdgpu.GPU) string {
+	if gpu.ComputePartition == "" {
+		return ""
 	}
-	// Fallback to default if VRAM parsing failed
-	klog.Warningf("VRAM info not available for %s %s, using default %dGB", deviceType, pciAddr, defaultBytes/(1024*1024*1024))
-	return defaultBytes
+	if gpu.MemoryPartition == "" {
+		return gpu.ComputePartition
+	}
+	return fmt.Sprintf("%s_%s", gpu.ComputePartition, gpu.MemoryPartition)
 }
 
-func getPcieInfo(gpuInfoMap map[string]interface{}) (deviceattribute.DeviceAttribute, string, error) {
-	pciAddr := gpuInfoMap["pciAddr"].(string)
+// newAmdGpuInfo builds the device info of a full GPU from its discovered state.
+func newAmdGpuInfo(gpu *amdgpu.GPU, pcieRootAttr deviceattribute.DeviceAttribute) *AmdGpuInfo {
+	return &AmdGpuInfo{
+		UUID:             gpu.UUID(),
+		PCIAddress:       gpu.PCIAddress,
+		CardIndex:        gpu.CardIndex,
+		RenderIndex:      gpu.RenderIndex,
+		KFDGPUID:         gpu.KFDGPUID,
+		Ordinal:          gpu.Ordinal,
+		DeviceID:         gpu.UniqueID,
+		DriverVersion:    gpu.DriverVersion,
+		DriverSrcVersion: gpu.DriverSrcVersion,
+		PartitionProfile: getPartitionProfile(gpu),
+		Family:           gpu.Family,
+		ProductName:      gpu.ProductName,
+		pcieRootAttr:     pcieRootAttr,
+		HiveID:           gpu.HiveID,
+		XGMILinks:        len(gpu.XGMIPeers),
+		NumaNode:         gpu.NumaNode,
+		LocalCPUs:        gpu.LocalCPUs,
+		SimdUnits:        gpu.SimdCount,
+		ComputeUnits:     gpu.CUCount,
+		MemoryBytes:      getMemoryBytes(gpu.VramBytes, 80*1024*1024*1024, "device", gpu.PCIAddress),
+	}
+}
 
-	// Use the PCI address from the device info (which is the parent's PCI address for partitions)
-	pcieRootAttr, err := deviceattribute.GetPCIeRootAttributeByPCIBusID(pciAddr)
-	if err != nil {
-		return pcieRootAttr, "", fmt.Errorf("Failed to get PCIe root attribute for device %s (using PCI addr %s): %v", pciAddr, pciAddr, err)
+// newAmdPartitionInfo builds the device info of a compute partition of parent.
+func newAmdPartitionInfo(partition *amdgpu.Partition, parent *AmdGpuInfo) *AmdPartitionInfo {
+	return &AmdPartitionInfo{
+		Parent:           parent,
+		UUID:             partition.UUID(),
+		Index:            partition.Index,
+		CardIndex:        partition.CardIndex,
+		RenderIndex:      partition.RenderIndex,
+		KFDGPUID:         partition.KFDGPUID,
+		Ordinal:          partition.Ordinal,
+		PartitionProfile: parent.PartitionProfile,
+		SimdUnits:        partition.SimdCount,
+		ComputeUnits:     partition.CUCount,
+		MemoryBytes:      getMemoryBytes(partition.VramBytes, 20*1024*1024*1024, "partition", parent.PCIAddress),
+		NumaNode:         partition.NumaNode,
+		LocalCPUs:        partition.LocalCPUs,
 	}
+}
 
-	return pcieRootAttr, pciAddr, nil
+// warnLongLocalCPUs warns about the local CPUs of a GPU and its partitions
+// that are not published since they exceed the length of an attribute value.
+func warnLongLocalCPUs(gpu *amdgpu.GPU) {
+	cpuLists := sets.New(gpu.LocalCPUs)
+	for _, partition := range gpu.Partitions {
+		cpuLists.Insert(partition.LocalCPUs)
+	}
+	for _, cpus := range sets.List(cpuLists) {
+		if len(cpus) > resourceapi.DeviceAttributeMaxValueLength {
+			klog.Warningf("Not publishing the local CPUs %s of device %s, which exceed %d characters",
+				cpus, gpu.PCIAddress, resourceapi.DeviceAttributeMaxValueLength)
+		}
+	}
 }
 
-func enumerateAllPossibleDevices() (AllocatableDevices, error) {
+// enumerateAllPossibleDevices discovers the AMD GPUs and partitions below the
+// given host root (see amdgpu.DefaultHostRoot). If partitionable is set, GPUs
+// that report their supported partition layouts are published with a device
+// for every partition of every layout instead of their current partitions.
+// If hives is set, a device is added for every XGMI hive of the GPUs.
+func enumerateAllPossibleDevices(hostRoot string, partitionable, hives bool) (AllocatableDevices, error) {
+	start := time.Now()
 	alldevices := make(AllocatableDevices)
-	allAMDGPUs := amdgpu.GetAMDGPUs()
 
-	for pciAddr, gpuInfoMap := range allAMDGPUs {
-		// Get PCIe root attribute for this device using the PCI address from the device info
-		pcieRootAttr, pciAddrFromMap, err := getPcieInfo(gpuInfoMap)
+	for _, gpu := range amdgpu.GetAMDGPUs(hostRoot) {
+		// Get PCIe root attribute for this device using its PCI address
+		pcieRootAttr, err := getPcieInfo(gpu.PCIAddress, hostRoot)
 		if err != nil {
 			// Continue without PCIe root attribute rather than failing completely
 			klog.Warning(err.Error())
 		}
 
-		// Check compute partition type to determine device type
-		computePartitionType := gpuInfoMap["computePartitionType"].(string)
-		memoryPartitionType := gpuInfoMap["memoryPartitionType"].(string)
-
-		// Extract common topology information
-		simdUnits, computeUnits := extractTopologyInfo(gpuInfoMap)
-
-		if computePartitionType == "spx" {
-			// This is a full AMD GPU
-			amdGpuInfo := &AmdGpuInfo{
-				PCIAddress:       pciAddr,
-				CardIndex:        gpuInfoMap["card"].(int),
-				RenderIndex:      gpuInfoMap["renderD"].(int),
-				DeviceID:         gpuInfoMap["devID"].(string),
-				DriverVersion:    gpuInfoMap["driverVersion"].(string),
-				DriverSrcVersion: gpuInfoMap["driverSrcVersion"].(string),
-				PartitionProfile: fmt.Sprintf("%s_%s", computePartitionType, memoryPartitionType),
-				Family:           gpuInfoMap["family"].(string),
-				ProductName:      gpuInfoMap["productName"].(string),
-				pcieRootAttr:     pcieRootAttr,
-				SimdUnits:        simdUnits,
-				ComputeUnits:     computeUnits,
-				MemoryBytes:      getMemoryBytes(gpuInfoMap, 80*1024*1024*1024, "device", pciAddr),
-			}
+		amdGpuInfo := newAmdGpuInfo(gpu, pcieRootAttr)
+		amdGpuInfo.PCIeSwitch, amdGpuInfo.RDMANICs, err = getPCIeSwitchInfo(gpu.PCIAddress, hostRoot)
+		if err != nil {
+			klog.Warning(err.Error())
+		}
+		if _, ok := amdGpuInfo.rdmaNICsValue(); !ok {
+			klog.Warningf("Not publishing the addresses of the %d RDMA NICs below PCIe switch %s of device %s, which exceed %d characters",
+				len(amdGpuInfo.RDMANICs), amdGpuInfo.PCIeSwitch, gpu.PCIAddress, resourceapi.DeviceAttributeMaxValueLength)
+		}
+		warnLongLocalCPUs(gpu)
+
+		if partitionable && addPartitionableDevices(alldevices, gpu, amdGpuInfo) {
+			klog.Infof("Found partitionable AMD GPU: %s, compute types: %v, memory types: %v",
+				amdGpuInfo.CanonicalName(), gpu.AvailableComputePartitions, gpu.AvailableMemoryPartitions)
+			continue
+		}
 
-			// Create allocatable device for the full GPU
+		// Check compute partition type to determine device type
+		switch gpu.ComputePartition {
+		case "", "spx":
+			// This is a full AMD GPU. GPUs without partitioning support
+			// (e.g. Radeon, MI100, MI200) have no compute partition type.
 			device := &AllocatableDevice{
 				AmdGpu: amdGpuInfo,
 			}
 			alldevices[device.CanonicalName()] = device
 
-			klog.Infof("Found full AMD GPU: %s, compute type: %s, memory type: %s",
-				device.CanonicalName(), computePartitionType, memoryPartitionType)
-		} else if computePartitionType != "" {
-			// This is a partition - create both parent GPU info and partition info
-
-			// Create parent GPU info
-			parentGpuInfo := &AmdGpuInfo{
-				PCIAddress:       pciAddrFromMap,
-				DeviceID:         gpuInfoMap["devID"].(string),
-				DriverVersion:    gpuInfoMap["driverVersion"].(string),
-				DriverSrcVersion: gpuInfoMap["driverSrcVersion"].(string),
-				Family:           gpuInfoMap["family"].(string),
-				ProductName:      gpuInfoMap["productName"].(string),
-				pcieRootAttr:     pcieRootAttr,
-			}
-
-			// Create partition info
-			partitionInfo := &AmdPartitionInfo{
-				CardIndex:        gpuInfoMap["card"].(int),
-				RenderIndex:      gpuInfoMap["renderD"].(int),
-				Parent:           parentGpuInfo,
-				PartitionProfile: fmt.Sprintf("%s_%s", computePartitionType, memoryPartitionType),
-				SimdUnits:        simdUnits,
-				ComputeUnits:     computeUnits,
-				MemoryBytes:      getMemoryBytes(gpuInfoMap, 20*1024*1024*1024, "partition", pciAddr),
-			}
-
-			// Create allocatable device for the partition
-			device := &AllocatableDevice{
-				AmdPartition: partitionInfo,
+			klog.Infof("Found full AMD GPU: %s, compute type: %q, memory type: %q",
+				device.CanonicalName(), gpu.ComputePartition, gpu.MemoryPartition)
+		default:
+			// This GPU is partitioned - publish each of its partitions
+			for _, partition := range gpu.Partitions {
+				device := &AllocatableDevice{
+					AmdPartition: newAmdPartitionInfo(partition, amdGpuInfo),
+				}
+				alldevices[device.CanonicalName()] = device
+
+				klog.Infof("Found AMD GPU partition: %s, compute type: %s, memory type: %s",
+					device.CanonicalName(), gpu.ComputePartition, gpu.MemoryPartition)
 			}
-			alldevices[device.CanonicalName()] = device
-
-			klog.Infof("Found AMD GPU partition: %s, compute type: %s, memory type: %s",
-				device.CanonicalName(), computePartitionType, memoryPartitionType)
-		} else {
-			klog.Warningf("Unknown compute partition type '%s' for device %s, skipping", computePartitionType, pciAddr)
 		}
 	}
 
+	if hives {
+		addHiveDevices(alldevices)
+	}
+
 	klog.Infof("Discovered %d AMD GPU devices", len(alldevices))
+	discoveryDuration.Observe(time.Since(start).Seconds())
+	recordDiscoveredDevices(alldevices)
 	return alldevices, nil
 }
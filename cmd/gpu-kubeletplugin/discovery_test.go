@@ -0,0 +1,376 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/dynamic-resource-allocation/deviceattribute"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestEnumerateAllPossibleDevices(t *testing.T) {
+	tests := map[string]struct {
+		fixture  string
+		expected map[string]string // canonical name -> device type
+		profile  string
+	}{
+		"MI300X SPX NPS1": {
+			fixture: amdgputest.MI300XSPXNPS1,
+			expected: map[string]string{
+				"gpu-43d0a94e5d4cf437": AmdGpuDeviceType,
+				"gpu-9c1a3b4fe2d07a11": AmdGpuDeviceType,
+			},
+			profile: "spx_nps1",
+		},
+		"MI300X CPX NPS1": {
+			fixture: amdgputest.MI300XCPXNPS1,
+			expected: map[string]string{
+				"gpu-43d0a94e5d4cf437-xcp0": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp1": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp2": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp3": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp4": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp5": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp6": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp7": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp0": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp1": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp2": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp3": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp4": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp5": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp6": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp7": AmdPartitionDeviceType,
+			},
+			profile: "cpx_nps1",
+		},
+		"MI300X CPX NPS4": {
+			fixture: amdgputest.MI300XCPXNPS4,
+			expected: map[string]string{
+				"gpu-43d0a94e5d4cf437-xcp0": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp1": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp2": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp3": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp4": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp5": AmdPartitionDeviceType,
+				"gpu-43d0a94e5d4cf437-xcp6": AmdPartitionDeviceType, "gpu-43d0a94e5d4cf437-xcp7": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp0": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp1": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp2": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp3": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp4": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp5": AmdPartitionDeviceType,
+				"gpu-9c1a3b4fe2d07a11-xcp6": AmdPartitionDeviceType, "gpu-9c1a3b4fe2d07a11-xcp7": AmdPartitionDeviceType,
+			},
+			profile: "cpx_nps4",
+		},
+		"MI210 without partition support": {
+			fixture: amdgputest.MI210,
+			expected: map[string]string{
+				"gpu-6a1e0f92b3c4d5e6": AmdGpuDeviceType,
+				"gpu-1f2e3d4c5b6a7988": AmdGpuDeviceType,
+			},
+		},
+		"Radeon without partition support": {
+			fixture: amdgputest.Radeon,
+			expected: map[string]string{
+				"gpu-0000-2d-00-0": AmdGpuDeviceType,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, test.fixture), false, false)
+			require.NoError(t, err)
+
+			actual := make(map[string]string)
+			for name, device := range devices {
+				actual[name] = device.Type()
+
+				d := device.GetDevice()
+				assert.Equal(t, name, d.Name)
+				assert.Equal(t, name, deviceNameFromUUID(*d.Attributes["uuid"].StringValue))
+				if test.profile == "" {
+					assert.NotContains(t, d.Attributes, resourceapi.QualifiedName("partitionProfile"))
+				} else {
+					assert.Equal(t, test.profile, *d.Attributes["partitionProfile"].StringValue)
+				}
+				assert.Contains(t, d.Attributes, deviceattribute.StandardDeviceAttributePCIeRoot)
+			}
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestEnumerateAllPossibleDevicesPartialNode(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XPartial), false, false)
+	require.NoError(t, err)
+
+	// 0000:23:00.0 has no numa_node and 0000:83:00.0 has no KFD topology
+	// node; both are still published with whatever could be discovered.
+	require.Len(t, devices, 3)
+	require.Contains(t, devices, "gpu-43d0a94e5d4cf437")
+	require.Contains(t, devices, "gpu-9c1a3b4fe2d07a11")
+	require.Contains(t, devices, "gpu-2b8e6f1c7a5d3e90")
+
+	healthy := devices["gpu-43d0a94e5d4cf437"].AmdGpu
+	assert.Equal(t, 304, healthy.ComputeUnits)
+	assert.Equal(t, uint64(192<<30), healthy.MemoryBytes)
+	assert.Equal(t, "pci0000:00", *healthy.pcieRootAttr.Value.StringValue)
+
+	noNuma := devices["gpu-9c1a3b4fe2d07a11"].AmdGpu
+	assert.Equal(t, 304, noNuma.ComputeUnits)
+
+	noKFD := devices["gpu-2b8e6f1c7a5d3e90"].AmdGpu
+	assert.Equal(t, 0, noKFD.ComputeUnits)
+	assert.Equal(t, "GPU-2b8e6f1c7a5d3e90", noKFD.UUID)
+	assert.Equal(t, uint64(192<<30), noKFD.MemoryBytes)
+}
+
+func TestEnumerateAllPossibleDevicesSharedParent(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1), false, false)
+	require.NoError(t, err)
+
+	parents := make(map[string]*AmdGpuInfo)
+	for _, device := range devices {
+		require.NotNil(t, device.AmdPartition)
+		parent := device.AmdPartition.Parent
+		if p, exists := parents[parent.PCIAddress]; exists {
+			assert.Same(t, p, parent)
+		}
+		parents[parent.PCIAddress] = parent
+	}
+	assert.Len(t, parents, 2)
+	assert.Equal(t, 304, parents["0000:03:00.0"].ComputeUnits)
+}
+
+func TestEnumerateAllPossibleDevicesWithoutPartitioning(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI210), false, false)
+	require.NoError(t, err)
+	require.Contains(t, devices, "gpu-1f2e3d4c5b6a7988")
+
+	gpu := devices["gpu-1f2e3d4c5b6a7988"].AmdGpu
+	require.NotNil(t, gpu)
+	assert.Equal(t, "0000:63:00.0", gpu.PCIAddress)
+	assert.Empty(t, gpu.PartitionProfile)
+	assert.Equal(t, 104, gpu.ComputeUnits)
+	assert.Equal(t, uint64(64<<30), gpu.MemoryBytes)
+	assert.Equal(t, "AMD_Instinct_MI210", gpu.ProductName)
+	assert.Equal(t, "pci0000:60", *gpu.pcieRootAttr.Value.StringValue)
+}
+
+func TestEnumerateAllPossibleDevicesXGMIHive(t *testing.T) {
+	tests := map[string]struct {
+		fixture string
+		hiveID  string
+		links   int64
+	}{
+		"MI300X SPX": {
+			fixture: amdgputest.MI300XSPXNPS1,
+			hiveID:  "0x3b7d2a1e9f4c8065",
+			links:   1,
+		},
+		"MI300X CPX partitions": {
+			fixture: amdgputest.MI300XCPXNPS1,
+			hiveID:  "0x3b7d2a1e9f4c8065",
+			links:   1,
+		},
+		"MI210 without hive": {
+			fixture: amdgputest.MI210,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, test.fixture), false, false)
+			require.NoError(t, err)
+			require.NotEmpty(t, devices)
+
+			for name, device := range devices {
+				d := device.GetDevice()
+				if test.hiveID == "" {
+					assert.NotContains(t, d.Attributes, resourceapi.QualifiedName("xgmiHiveID"), name)
+					assert.NotContains(t, d.Attributes, resourceapi.QualifiedName("xgmiLinks"), name)
+					continue
+				}
+				assert.Equal(t, test.hiveID, *d.Attributes["xgmiHiveID"].StringValue, name)
+				assert.Equal(t, test.links, *d.Attributes["xgmiLinks"].IntValue, name)
+			}
+		})
+	}
+}
+
+func TestEnumerateAllPossibleDevicesPCIeSwitch(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1), false, false)
+	require.NoError(t, err)
+
+	// The first GPU shares its switch with a dual-port RDMA NIC.
+	gpu := devices["gpu-43d0a94e5d4cf437"].GetDevice()
+	assert.Equal(t, "0000:01:00.0", *gpu.Attributes["pcieSwitch"].StringValue)
+	assert.Equal(t, "0000:04:00.0,0000:04:00.1", *gpu.Attributes["rdmaNICs"].StringValue)
+	assert.Equal(t, int64(2), *gpu.Attributes["rdmaNICCount"].IntValue)
+
+	gpu = devices["gpu-9c1a3b4fe2d07a11"].GetDevice()
+	assert.Equal(t, "0000:21:00.0", *gpu.Attributes["pcieSwitch"].StringValue)
+	assert.NotContains(t, gpu.Attributes, resourceapi.QualifiedName("rdmaNICs"))
+	assert.NotContains(t, gpu.Attributes, resourceapi.QualifiedName("rdmaNICCount"))
+
+	// Partitions share the switch of their GPU.
+	devices, err = enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1), false, false)
+	require.NoError(t, err)
+	partition := devices["gpu-9c1a3b4fe2d07a11-xcp3"].GetDevice()
+	assert.Equal(t, "0000:21:00.0", *partition.Attributes["pcieSwitch"].StringValue)
+}
+
+func TestAddPCIeSwitchAttributes(t *testing.T) {
+	tests := map[string]struct {
+		nics     int
+		expected string
+	}{
+		"five NICs": {
+			nics:     5,
+			expected: "0000:04:00.0,0000:04:00.1,0000:04:00.2,0000:04:00.3,0000:04:00.4",
+		},
+		// Six addresses exceed the length of an attribute value.
+		"six NICs": {
+			nics: 6,
+		},
+		"dual-port NICs with VFs": {
+			nics: 16,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gpu := &AmdGpuInfo{PCIeSwitch: "0000:01:00.0"}
+			for i := range test.nics {
+				gpu.RDMANICs = append(gpu.RDMANICs, fmt.Sprintf("0000:04:%02x.%d", i/8, i%8))
+			}
+			attributes := make(map[resourceapi.QualifiedName]resourceapi.DeviceAttribute)
+			gpu.addPCIeSwitchAttributes(attributes)
+
+			assert.Equal(t, int64(test.nics), *attributes["rdmaNICCount"].IntValue)
+			if test.expected == "" {
+				assert.NotContains(t, attributes, resourceapi.QualifiedName("rdmaNICs"))
+				return
+			}
+			assert.Equal(t, test.expected, *attributes["rdmaNICs"].StringValue)
+			assert.LessOrEqual(t, len(test.expected), resourceapi.DeviceAttributeMaxValueLength)
+		})
+	}
+}
+
+func TestEnumerateAllPossibleDevicesNumaNode(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1), false, false)
+	require.NoError(t, err)
+	gpu := devices["gpu-43d0a94e5d4cf437"].GetDevice()
+	assert.Equal(t, int64(0), *gpu.Attributes["numaNode"].IntValue)
+	assert.Equal(t, "0-47,96-143", *gpu.Attributes["localCPUList"].StringValue)
+
+	// In NPS4 mode partitions report the NUMA node of their own memory.
+	devices, err = enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4), false, false)
+	require.NoError(t, err)
+	partition := devices["gpu-43d0a94e5d4cf437-xcp1"].GetDevice()
+	assert.Equal(t, int64(0), *partition.Attributes["numaNode"].IntValue)
+	assert.Equal(t, "0-47,96-143", *partition.Attributes["localCPUList"].StringValue)
+	partition = devices["gpu-43d0a94e5d4cf437-xcp5"].GetDevice()
+	assert.Equal(t, int64(1), *partition.Attributes["numaNode"].IntValue)
+	assert.Equal(t, "48-95,144-191", *partition.Attributes["localCPUList"].StringValue)
+
+	// GPUs with an unknown NUMA node publish neither attribute.
+	devices, err = enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.Radeon), false, false)
+	require.NoError(t, err)
+	gpu = devices["gpu-0000-2d-00-0"].GetDevice()
+	assert.NotContains(t, gpu.Attributes, resourceapi.QualifiedName("numaNode"))
+	assert.NotContains(t, gpu.Attributes, resourceapi.QualifiedName("localCPUList"))
+}
+
+func TestAddNumaAttributes(t *testing.T) {
+	// CPUs numbered alternately by socket do not fit into an attribute value.
+	var alternate []string
+	for cpu := 0; cpu < 96; cpu += 2 {
+		alternate = append(alternate, strconv.Itoa(cpu))
+	}
+
+	tests := map[string]struct {
+		localCPUs string
+		expected  bool
+	}{
+		"ranges": {
+			localCPUs: "0-47,96-143",
+			expected:  true,
+		},
+		"alternate CPUs": {
+			localCPUs: strings.Join(alternate, ","),
+		},
+		"unknown": {},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			attributes := make(map[resourceapi.QualifiedName]resourceapi.DeviceAttribute)
+			addNumaAttributes(attributes, 0, test.localCPUs)
+
+			assert.Equal(t, int64(0), *attributes["numaNode"].IntValue)
+			if !test.expected {
+				assert.NotContains(t, attributes, resourceapi.QualifiedName("localCPUList"))
+				return
+			}
+			assert.Equal(t, test.localCPUs, *attributes["localCPUList"].StringValue)
+		})
+	}
+}
+
+func TestEnumerateAllPossibleDevicesStableNames(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4), false, false)
+	require.NoError(t, err)
+
+	// Names do not depend on DRM minors, which are looked up instead.
+	device := devices["gpu-9c1a3b4fe2d07a11-xcp1"]
+	require.NotNil(t, device)
+	assert.Equal(t, "GPU-9c1a3b4fe2d07a11-XCP1", device.AmdPartition.UUID)
+	card, render := device.DRMNodes()
+	assert.Equal(t, 10, card)
+	assert.Equal(t, 137, render)
+}
+
+func TestDeviceNameFromUUID(t *testing.T) {
+	tests := map[string]struct {
+		uuid     string
+		expected string
+	}{
+		"GPU": {
+			uuid:     "GPU-43d0a94e5d4cf437",
+			expected: "gpu-43d0a94e5d4cf437",
+		},
+		"partition": {
+			uuid:     "GPU-43d0a94e5d4cf437-XCP7",
+			expected: "gpu-43d0a94e5d4cf437-xcp7",
+		},
+		"PCI address fallback": {
+			uuid:     "GPU-0000:2d:00.0",
+			expected: "gpu-0000-2d-00-0",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, deviceNameFromUUID(test.uuid))
+		})
+	}
+}
+
+func TestEnumerateAllPossibleDevicesNoDriver(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(t.TempDir(), false, false)
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+}
@@ -36,31 +36,58 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"maps"
+	"sync"
 
 	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	coreclientset "k8s.io/client-go/kubernetes"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
 	"k8s.io/dynamic-resource-allocation/resourceslice"
 	klog "k8s.io/klog/v2"
+	drahealthv1alpha1 "k8s.io/kubelet/pkg/apis/dra-health/v1alpha1"
 
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 )
 
 type driver struct {
+	drahealthv1alpha1.UnimplementedDRAResourceHealthServer
+
 	client      coreclientset.Interface
 	helper      *kubeletplugin.Helper
 	state       *DeviceState
 	healthcheck *healthcheck
-	cancelCtx   func(error)
+	metrics     *metricsServer
+	watcher     *deviceWatcher
+	rasMonitor  *rasMonitor
+	reconciler  *claimReconciler
+	// healthWatchers are notified whenever device health may have changed.
+	healthWatchers healthWatchers
+	cancelCtx      func(error)
+	nodeName       string
+	// expectedGPUs is the number of GPUs the node is expected to have, or
+	// zero if unknown.
+	expectedGPUs int
+
+	// publishMutex serializes publishing and guards published, the slices
+	// of the last successful publication.
+	publishMutex sync.Mutex
+	published    []resourceslice.Slice
+
+	// publishErr is the error of the last publication, or of publishing it
+	// in the background, if it failed.
+	publishErrMutex sync.Mutex
+	publishErr      error
 }
 
 func NewDriver(ctx context.Context, config *Config) (*driver, error) {
+	registerMetrics()
+
 	driver := &driver{
 		client:    config.coreclient,
 		cancelCtx: config.cancelMainCtx,
+		nodeName:  config.flags.nodeName,
 	}
 
 	state, err := NewDeviceState(config)
@@ -83,38 +110,143 @@ func NewDriver(ctx context.Context, config *Config) (*driver, error) {
 	}
 	driver.helper = helper
 
-	devices := make([]resourceapi.Device, 0, len(state.allocatable))
-	for device := range maps.Values(state.allocatable) {
-		devices = append(devices, device.GetDevice())
+	driver.expectedGPUs, err = expectedGPUCount(ctx, config)
+	if err != nil {
+		// The GPU count is then not checked.
+		klog.FromContext(ctx).Error(err, "Unable to get the expected number of GPUs")
+	}
+
+	driver.healthcheck, err = startHealthcheck(ctx, config, driver)
+	if err != nil {
+		return nil, fmt.Errorf("start healthcheck: %w", err)
+	}
+
+	driver.metrics, err = startMetricsServer(ctx, config.flags.metricsPort)
+	if err != nil {
+		return nil, fmt.Errorf("start metrics server: %w", err)
+	}
+
+	// Claims deleted while the plugin was down are never unprepared by
+	// kubelet.
+	driver.reconcileClaims(ctx)
+
+	if err := driver.publishResources(ctx); err != nil {
+		return nil, err
+	}
+
+	driver.watcher = startDeviceWatcher(ctx, config.flags.deviceResyncInterval, driver.rediscover)
+
+	if config.flags.rasPollInterval > 0 {
+		driver.rasMonitor = startRASMonitor(ctx, config.flags.rasPollInterval, driver.updateHealth)
+	}
+
+	if config.flags.claimReconcileInterval > 0 {
+		driver.reconciler = startClaimReconciler(ctx, config.flags.claimReconcileInterval, driver.reconcileClaims)
 	}
+
+	return driver, nil
+}
+
+// publishResources publishes the current devices in the ResourceSlices of the
+// node unless they did not change since the last publication.
+func (d *driver) publishResources(ctx context.Context) error {
+	d.publishMutex.Lock()
+	defer d.publishMutex.Unlock()
+
+	slices := d.state.PublishedSlices()
+	if d.published != nil && d.publishError() == nil && equality.Semantic.DeepEqual(slices, d.published) {
+		return nil
+	}
+
 	resources := resourceslice.DriverResources{
 		Pools: map[string]resourceslice.Pool{
-			config.flags.nodeName: {
-				Slices: []resourceslice.Slice{
-					{
-						Devices: devices,
-					},
-				},
+			d.nodeName: {
+				Slices: slices,
 			},
 		},
 	}
+	err := d.helper.PublishResources(ctx, resources)
+	resourceSlicePublishes.WithLabelValues(publishResult(err)).Inc()
+	d.setPublishError(err)
+	if err != nil {
+		return err
+	}
+	d.published = slices
+	return nil
+}
+
+// setPublishError records the result of the last publication.
+func (d *driver) setPublishError(err error) {
+	d.publishErrMutex.Lock()
+	defer d.publishErrMutex.Unlock()
+	d.publishErr = err
+}
+
+// publishError returns the error of the last publication if it failed.
+func (d *driver) publishError() error {
+	d.publishErrMutex.Lock()
+	defer d.publishErrMutex.Unlock()
+	return d.publishErr
+}
 
-	driver.healthcheck, err = startHealthcheck(ctx, config)
+// rediscover refreshes the device inventory and republishes it if it changed.
+func (d *driver) rediscover(ctx context.Context) error {
+	changed, err := d.state.Rediscover()
 	if err != nil {
-		return nil, fmt.Errorf("start healthcheck: %w", err)
+		return err
+	}
+	if !changed {
+		klog.V(4).Info("Devices unchanged after rediscovery")
+		if d.publishError() != nil {
+			// Retry, the last publication failed.
+			return d.publishResources(ctx)
+		}
+		return nil
 	}
+	d.healthWatchers.notify()
 
-	if err := helper.PublishResources(ctx, resources); err != nil {
-		return nil, err
+	klog.Info("Devices changed, republishing resources")
+	return d.publishResources(ctx)
+}
+
+// updateHealth refreshes the RAS taints of the devices and republishes them if
+// they changed.
+func (d *driver) updateHealth(ctx context.Context) {
+	if !d.state.UpdateHealth() {
+		return
 	}
+	d.healthWatchers.notify()
+	klog.Info("Device health changed, republishing resources")
+	if err := d.publishResources(ctx); err != nil {
+		klog.Errorf("Failed to publish resources: %v", err)
+	}
+}
 
-	return driver, nil
+// republish publishes the devices after claims were prepared or unprepared,
+// which may have changed them.
+func (d *driver) republish(ctx context.Context) {
+	d.healthWatchers.notify()
+	if err := d.publishResources(ctx); err != nil {
+		klog.Errorf("Failed to publish resources: %v", err)
+	}
 }
 
 func (d *driver) Shutdown(logger klog.Logger) error {
+	if d.reconciler != nil {
+		d.reconciler.Stop()
+	}
+	if d.rasMonitor != nil {
+		d.rasMonitor.Stop()
+	}
+	if d.watcher != nil {
+		d.watcher.Stop()
+	}
 	if d.healthcheck != nil {
 		d.healthcheck.Stop(logger)
 	}
+	if d.metrics != nil {
+		d.metrics.Stop(logger)
+	}
 	d.helper.Stop()
 	return nil
 }
@@ -123,22 +255,29 @@ func (d *driver) PrepareResourceClaims(ctx context.Context, claims []*resourceap
 	klog.Infof("PrepareResourceClaims is called: number of claims: %d", len(claims))
 	result := make(map[types.UID]kubeletplugin.PrepareResult)
 
-	for _, claim := range claims {
-		result[claim.UID] = d.prepareResourceClaim(ctx, claim)
+	results, changed := d.state.Prepare(claims)
+	for claimUID, prepared := range results {
+		result[types.UID(claimUID)] = prepareResult(types.UID(claimUID), prepared)
+	}
+
+	// Claims repartitioned GPUs. Empty batches, such as the ones of the
+	// healthcheck, change nothing.
+	if changed {
+		d.republish(ctx)
 	}
 
 	return result, nil
 }
 
-func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.ResourceClaim) kubeletplugin.PrepareResult {
-	preparedPBs, err := d.state.Prepare(claim)
-	if err != nil {
+// prepareResult converts the result of preparing a claim for kubelet.
+func prepareResult(claimUID types.UID, result PrepareResult) kubeletplugin.PrepareResult {
+	if result.Err != nil {
 		return kubeletplugin.PrepareResult{
-			Err: fmt.Errorf("error preparing devices for claim %v: %w", claim.UID, err),
+			Err: fmt.Errorf("error preparing devices for claim %v: %w", claimUID, result.Err),
 		}
 	}
 	var prepared []kubeletplugin.Device
-	for _, preparedPB := range preparedPBs {
+	for _, preparedPB := range result.Devices {
 		prepared = append(prepared, kubeletplugin.Device{
 			Requests:     preparedPB.GetRequestNames(),
 			PoolName:     preparedPB.GetPoolName(),
@@ -147,7 +286,7 @@ func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.Reso
 		})
 	}
 
-	klog.Infof("Returning newly prepared devices for claim '%v': %v", claim.UID, prepared)
+	klog.Infof("Returning newly prepared devices for claim '%v': %v", claimUID, prepared)
 	return kubeletplugin.PrepareResult{Devices: prepared}
 }
 
@@ -159,6 +298,9 @@ func (d *driver) UnprepareResourceClaims(ctx context.Context, claims []kubeletpl
 		result[claim.UID] = d.unprepareResourceClaim(ctx, claim)
 	}
 
+	// Devices withheld for the claims may be available again.
+	d.republish(ctx)
+
 	return result, nil
 }
 
@@ -172,6 +314,9 @@ func (d *driver) unprepareResourceClaim(_ context.Context, claim kubeletplugin.N
 
 func (d *driver) HandleError(ctx context.Context, err error, msg string) {
 	utilruntime.HandleErrorWithContext(ctx, err, msg)
+	// Background errors are those of publishing the ResourceSlices.
+	resourceSlicePublishes.WithLabelValues(publishResult(err)).Inc()
+	d.setPublishError(err)
 	if !errors.Is(err, kubeletplugin.ErrRecoverable) && d.cancelCtx != nil {
 		d.cancelCtx(fmt.Errorf("fatal background error: %w", err))
 	}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// gpuLocks serializes preparing and unpreparing claims per GPU, keyed by PCI
+// address, so that claims of different GPUs are prepared in parallel while a
+// claim sees the GPUs it uses, their partitions and the claims sharing them
+// unchanged until it is done. The zero value is ready to use.
+type gpuLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the given GPUs and returns a function that unlocks them. GPUs
+// are locked in order of their PCI address, so that claims sharing several
+// GPUs cannot deadlock. The state must not be locked while waiting for GPUs.
+func (l *gpuLocks) lock(pciAddrs []string) func() {
+	pciAddrs = slices.Compact(slices.Sorted(slices.Values(pciAddrs)))
+
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	locks := make([]*sync.Mutex, len(pciAddrs))
+	for i, pciAddr := range pciAddrs {
+		if l.locks[pciAddr] == nil {
+			l.locks[pciAddr] = &sync.Mutex{}
+		}
+		locks[i] = l.locks[pciAddr]
+	}
+	l.mutex.Unlock()
+
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for _, lock := range slices.Backward(locks) {
+			lock.Unlock()
+		}
+	}
+}
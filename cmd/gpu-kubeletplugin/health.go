@@ -34,18 +34,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
 
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	klog "k8s.io/klog/v2"
 	drapb "k8s.io/kubelet/pkg/apis/dra/v1beta1"
 	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
@@ -53,6 +60,32 @@ import (
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 )
 
+// expectedGPUsLabel is the node label with the number of GPUs the node is
+// expected to have, unless the --expected-gpus flag is set.
+const expectedGPUsLabel = consts.DriverName + "/expected-gpus"
+
+// Checks of the healthcheck service. Every check is also served as a service
+// of its own, so that a failing probe can be narrowed down to the check that
+// fails.
+const (
+	checkRegistration = "registration"
+	checkDRA          = "dra"
+	checkCheckpoint   = "checkpoint"
+	checkCDI          = "cdi"
+	checkKFD          = "kfd"
+	checkPublish      = "publish"
+	checkDevices      = "devices"
+)
+
+var (
+	// livenessChecks fail when the plugin is wedged, which restarting it
+	// may fix.
+	livenessChecks = []string{checkRegistration, checkDRA, checkCheckpoint, checkCDI}
+	// readinessChecks additionally fail when the node cannot serve claims,
+	// e.g. because a GPU is missing, which restarting the plugin does not fix.
+	readinessChecks = append(slices.Clone(livenessChecks), checkKFD, checkPublish, checkDevices)
+)
+
 type healthcheck struct {
 	grpc_health_v1.UnimplementedHealthServer
 
@@ -61,9 +94,12 @@ type healthcheck struct {
 
 	regClient registerapi.RegistrationClient
 	draClient drapb.DRAPluginClient
+
+	// checks maps the name of every check to the function running it.
+	checks map[string]func(context.Context) error
 }
 
-func startHealthcheck(ctx context.Context, config *Config) (*healthcheck, error) {
+func startHealthcheck(ctx context.Context, config *Config, driver *driver) (*healthcheck, error) {
 	log := klog.FromContext(ctx)
 
 	port := config.flags.healthcheckPort
@@ -111,6 +147,15 @@ func startHealthcheck(ctx context.Context, config *Config) (*healthcheck, error)
 		regClient: registerapi.NewRegistrationClient(regConn),
 		draClient: drapb.NewDRAPluginClient(draConn),
 	}
+	healthcheck.checks = map[string]func(context.Context) error{
+		checkRegistration: healthcheck.checkRegistration,
+		checkDRA:          healthcheck.checkDRA,
+		checkCheckpoint:   func(context.Context) error { return driver.state.checkCheckpoint() },
+		checkCDI:          func(context.Context) error { return driver.state.cdi.checkWritable() },
+		checkKFD:          func(context.Context) error { return driver.state.checkKFD() },
+		checkPublish:      func(context.Context) error { return driver.publishError() },
+		checkDevices:      func(context.Context) error { return driver.state.checkGPUCount(driver.expectedGPUs) },
+	}
 	grpc_health_v1.RegisterHealthServer(server, healthcheck)
 
 	healthcheck.wg.Add(1)
@@ -133,33 +178,130 @@ func (h *healthcheck) Stop(logger klog.Logger) {
 	h.wg.Wait()
 }
 
-// Check implements [grpc_health_v1.HealthServer].
+// Check implements [grpc_health_v1.HealthServer]. The liveness service, which
+// is also the default, runs the liveness checks, the readiness service runs
+// the readiness checks, and the service named after a check runs that check.
 func (h *healthcheck) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
 	log := klog.FromContext(ctx)
 
-	knownServices := map[string]struct{}{"": {}, "liveness": {}}
-	if _, known := knownServices[req.GetService()]; !known {
-		return nil, status.Error(codes.NotFound, "unknown service")
+	var checks []string
+	switch service := req.GetService(); service {
+	case "", "liveness":
+		checks = livenessChecks
+	case "readiness":
+		checks = readinessChecks
+	default:
+		if _, known := h.checks[service]; !known {
+			return nil, status.Error(codes.NotFound, "unknown service")
+		}
+		checks = []string{service}
 	}
 
 	status := &grpc_health_v1.HealthCheckResponse{
-		Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		Status: grpc_health_v1.HealthCheckResponse_SERVING,
+	}
+	for _, check := range checks {
+		if err := h.checks[check](ctx); err != nil {
+			log.Error(err, "Health check failed", "service", req.GetService(), "check", check)
+			status.Status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+			continue
+		}
+		log.V(5).Info("Health check succeeded", "service", req.GetService(), "check", check)
 	}
+	return status, nil
+}
 
+// checkRegistration returns an error if the registration service of the
+// plugin does not answer.
+func (h *healthcheck) checkRegistration(ctx context.Context) error {
 	info, err := h.regClient.GetInfo(ctx, &registerapi.InfoRequest{})
 	if err != nil {
-		log.Error(err, "failed to call GetInfo")
-		return status, nil
+		return fmt.Errorf("failed to call GetInfo: %w", err)
+	}
+	klog.FromContext(ctx).V(5).Info("Successfully invoked GetInfo", "info", info)
+	return nil
+}
+
+// checkDRA returns an error if the DRA service of the plugin does not answer.
+func (h *healthcheck) checkDRA(ctx context.Context) error {
+	if _, err := h.draClient.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{}); err != nil {
+		return fmt.Errorf("failed to call NodePrepareResources: %w", err)
 	}
-	log.V(5).Info("Successfully invoked GetInfo", "info", info)
+	return nil
+}
+
+// checkCheckpoint returns an error if the checkpoint cannot be read or its
+// checksum does not verify. The checkpoint is written atomically, so it is
+// read without locking the state, which preparing claims may hold for long.
+func (s *DeviceState) checkCheckpoint() error {
+	checkpoint := &Checkpoint{}
+	if err := s.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
+		return fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+	return nil
+}
 
-	_, err = h.draClient.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{})
+// checkWritable returns an error if CDI spec files cannot be written.
+func (cdi *CDIHandler) checkWritable() error {
+	if err := unix.Access(cdi.cdiRoot, unix.W_OK); err != nil {
+		return fmt.Errorf("CDI root %s is not writable: %w", cdi.cdiRoot, err)
+	}
+	return nil
+}
+
+// checkKFD returns an error if /dev/kfd, which every container of a claim
+// gets, is missing, e.g. because the amdgpu driver is not loaded.
+func (s *DeviceState) checkKFD() error {
+	path := filepath.Join(s.hostRoot, "dev/kfd")
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Error(err, "failed to call NodePrepareResources")
-		return status, nil
+		return err
 	}
-	log.V(5).Info("Successfully invoked NodePrepareResources")
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+	return nil
+}
 
-	status.Status = grpc_health_v1.HealthCheckResponse_SERVING
-	return status, nil
+// checkGPUCount returns an error if fewer or more GPUs than expected were
+// discovered. Nothing is expected if expected is zero.
+func (s *DeviceState) checkGPUCount(expected int) error {
+	if discovered := int(s.gpus.Load()); expected > 0 && discovered != expected {
+		return fmt.Errorf("discovered %d GPUs, expected %d", discovered, expected)
+	}
+	return nil
+}
+
+// countGPUs returns the number of GPUs of the given devices, leaving out the
+// retained ones.
+func countGPUs(allocatable AllocatableDevices, retained sets.Set[string]) int {
+	pciAddrs := sets.New[string]()
+	for name, device := range allocatable {
+		if !retained.Has(name) {
+			pciAddrs.Insert(device.GPUs()...)
+		}
+	}
+	return pciAddrs.Len()
+}
+
+// expectedGPUCount returns the number of GPUs the node is expected to have:
+// the --expected-gpus flag if set, otherwise the expectedGPUsLabel of the
+// node, or zero if neither is set.
+func expectedGPUCount(ctx context.Context, config *Config) (int, error) {
+	if config.flags.expectedGPUs > 0 {
+		return config.flags.expectedGPUs, nil
+	}
+	node, err := config.coreclient.CoreV1().Nodes().Get(ctx, config.flags.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("unable to get node %s: %w", config.flags.nodeName, err)
+	}
+	value, exists := node.Labels[expectedGPUsLabel]
+	if !exists {
+		return 0, nil
+	}
+	expected, err := strconv.Atoi(value)
+	if err != nil || expected < 0 {
+		return 0, errors.Join(fmt.Errorf("invalid label %s=%q of node %s", expectedGPUsLabel, value, config.flags.nodeName), err)
+	}
+	return expected, nil
 }
@@ -0,0 +1,140 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestHealthcheckCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		failing []string
+		want    grpc_health_v1.HealthCheckResponse_ServingStatus
+		wantErr codes.Code
+	}{
+		{
+			name: "default",
+			want: grpc_health_v1.HealthCheckResponse_SERVING,
+		},
+		{
+			name:    "liveness",
+			service: "liveness",
+			failing: []string{checkDRA},
+			want:    grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			name:    "liveness ignores missing GPUs",
+			service: "liveness",
+			failing: []string{checkKFD, checkDevices},
+			want:    grpc_health_v1.HealthCheckResponse_SERVING,
+		},
+		{
+			name:    "readiness with missing GPUs",
+			service: "readiness",
+			failing: []string{checkDevices},
+			want:    grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			name:    "readiness with wedged plugin",
+			service: "readiness",
+			failing: []string{checkCheckpoint},
+			want:    grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			name:    "single check",
+			service: checkPublish,
+			failing: []string{checkCDI},
+			want:    grpc_health_v1.HealthCheckResponse_SERVING,
+		},
+		{
+			name:    "failing single check",
+			service: checkPublish,
+			failing: []string{checkPublish},
+			want:    grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			name:    "unknown service",
+			service: "unknown",
+			wantErr: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthcheck{checks: make(map[string]func(context.Context) error)}
+			for _, check := range readinessChecks {
+				h.checks[check] = func(context.Context) error { return nil }
+			}
+			for _, check := range tt.failing {
+				h.checks[check] = func(context.Context) error { return errors.New("failed") }
+			}
+
+			resp, err := h.Check(t.Context(), &grpc_health_v1.HealthCheckRequest{Service: tt.service})
+			if tt.wantErr != codes.OK {
+				assert.Equal(t, tt.wantErr, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resp.GetStatus())
+		})
+	}
+}
+
+func TestDeviceStateHealthChecks(t *testing.T) {
+	hostRoot := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+	state := newTestDeviceState(t, hostRoot)
+	state.cdi, _ = newTestCDIHandler(t)
+
+	checkpointDir := t.TempDir()
+	checkpointManager, err := checkpointmanager.NewCheckpointManager(checkpointDir)
+	require.NoError(t, err)
+	state.checkpointManager = checkpointManager
+	assert.Error(t, state.checkCheckpoint(), "missing checkpoint")
+	require.NoError(t, state.saveCheckpoint())
+	assert.NoError(t, state.checkCheckpoint())
+	require.NoError(t, os.WriteFile(filepath.Join(checkpointDir, DriverPluginCheckpointFile), []byte(`{"checksum":1}`), 0o600))
+	assert.Error(t, state.checkCheckpoint(), "corrupt checkpoint")
+
+	assert.NoError(t, state.cdi.checkWritable())
+	state.cdi.cdiRoot = filepath.Join(t.TempDir(), "missing")
+	assert.Error(t, state.cdi.checkWritable())
+
+	// Fixtures capture device nodes as regular files.
+	assert.Error(t, state.checkKFD())
+	amdgputest.LinkDeviceNodes(t, hostRoot)
+	assert.NoError(t, state.checkKFD())
+	require.NoError(t, os.Remove(filepath.Join(hostRoot, "dev/kfd")))
+	assert.Error(t, state.checkKFD())
+
+	assert.NoError(t, state.checkGPUCount(0))
+	assert.NoError(t, state.checkGPUCount(2))
+	assert.EqualError(t, state.checkGPUCount(4), "discovered 2 GPUs, expected 4")
+}
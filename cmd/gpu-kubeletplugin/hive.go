@@ -0,0 +1,115 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"slices"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	klog "k8s.io/klog/v2"
+)
+
+// parentGPU returns the GPU of a GPU or partition device, or nil for a hive.
+func parentGPU(device *AllocatableDevice) *AmdGpuInfo {
+	switch device.Type() {
+	case AmdGpuDeviceType:
+		return device.AmdGpu
+	case AmdPartitionDeviceType:
+		return device.AmdPartition.Parent
+	}
+	return nil
+}
+
+// addHiveDevices adds a device for every XGMI hive of two or more of the
+// given GPUs to devices, which allocates all GPUs of the hive at once. It
+// must be called once all GPUs and partitions were added.
+//
+// The hive device and the devices of its GPUs consume from a counter set named
+// after the hive, which has a counter for every GPU holding its number of
+// devices. Each device of a GPU consumes 1 of the counter of its GPU and the
+// hive device all of them, so that either the hive device or devices of its
+// GPUs can be allocated.
+func addHiveDevices(devices AllocatableDevices) {
+	hives := make(map[uint64]map[*AmdGpuInfo][]*AllocatableDevice)
+	for _, device := range devices {
+		gpu := parentGPU(device)
+		if gpu == nil || gpu.HiveID == 0 {
+			continue
+		}
+		if hives[gpu.HiveID] == nil {
+			hives[gpu.HiveID] = make(map[*AmdGpuInfo][]*AllocatableDevice)
+		}
+		hives[gpu.HiveID][gpu] = append(hives[gpu.HiveID][gpu], device)
+	}
+
+	for hiveID, gpus := range hives {
+		name := hiveDeviceName(hiveID)
+		if len(gpus) < 2 {
+			continue
+		}
+		count := 1
+		for _, members := range gpus {
+			count += len(members)
+		}
+		if len(gpus) > resourceapi.ResourceSliceMaxSharedCounters ||
+			len(gpus) > resourceapi.ResourceSliceMaxCountersPerDevice ||
+			count > resourceapi.ResourceSliceMaxDevices {
+			klog.Warningf("XGMI hive %s has too many GPUs or devices to publish it as a device", name)
+			continue
+		}
+
+		hive := &AmdHiveInfo{
+			HiveID: hiveID,
+			CounterSet: &resourceapi.CounterSet{
+				Name:     name,
+				Counters: make(map[string]resourceapi.Counter),
+			},
+		}
+		for gpu, members := range gpus {
+			counter := gpu.CanonicalName()
+			hive.CounterSet.Counters[counter] = resourceapi.Counter{
+				Value: *resource.NewQuantity(int64(len(members)), resource.DecimalSI),
+			}
+			consumes := []resourceapi.DeviceCounterConsumption{{
+				CounterSet: name,
+				Counters: map[string]resourceapi.Counter{
+					counter: {Value: *resource.NewQuantity(1, resource.DecimalSI)},
+				},
+			}}
+			for _, member := range members {
+				if member.AmdGpu != nil {
+					member.AmdGpu.ConsumesCounters = consumes
+				} else {
+					member.AmdPartition.ConsumesCounters = consumes
+				}
+			}
+			gpu.CounterSet = hive.CounterSet
+			hive.GPUs = append(hive.GPUs, gpu)
+		}
+		slices.SortFunc(hive.GPUs, func(a, b *AmdGpuInfo) int { return cmp.Compare(a.PCIAddress, b.PCIAddress) })
+		hive.ConsumesCounters = []resourceapi.DeviceCounterConsumption{{
+			CounterSet: name,
+			Counters:   hive.CounterSet.Counters,
+		}}
+
+		device := &AllocatableDevice{AmdHive: hive}
+		devices[device.CanonicalName()] = device
+		klog.Infof("Found XGMI hive: %s, GPUs: %v", device.CanonicalName(), device.GPUs())
+	}
+}
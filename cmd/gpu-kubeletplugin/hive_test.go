@@ -0,0 +1,190 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+const testHiveDevice = "hive-3b7d2a1e9f4c8065"
+
+// useHiveDevices makes a DeviceState like newTestDeviceState publish hive
+// devices.
+func useHiveDevices(t *testing.T, state *DeviceState) {
+	allocatable, err := enumerateAllPossibleDevices(state.hostRoot, false, true)
+	require.NoError(t, err)
+	state.allocatable = allocatable
+	state.hiveDevices = true
+}
+
+func TestEnumerateHiveDevices(t *testing.T) {
+	tests := map[string]struct {
+		fixture string
+		count   int
+		hive    map[string]int64 // counter of each GPU of the hive
+	}{
+		"MI300X SPX NPS1": {
+			fixture: amdgputest.MI300XSPXNPS1,
+			count:   2 + 1,
+			hive:    map[string]int64{"gpu-43d0a94e5d4cf437": 1, "gpu-9c1a3b4fe2d07a11": 1},
+		},
+		"MI300X CPX NPS1": {
+			fixture: amdgputest.MI300XCPXNPS1,
+			count:   16 + 1,
+			hive:    map[string]int64{"gpu-43d0a94e5d4cf437": 8, "gpu-9c1a3b4fe2d07a11": 8},
+		},
+		"MI210 without hive": {
+			fixture: amdgputest.MI210,
+			count:   2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, test.fixture), false, true)
+			require.NoError(t, err)
+			assert.Len(t, devices, test.count)
+
+			hive, exists := devices[testHiveDevice]
+			if test.hive == nil {
+				assert.False(t, exists)
+				for _, device := range devices {
+					assert.Nil(t, device.CounterSet(), device.CanonicalName())
+					assert.Empty(t, device.GetDevice().ConsumesCounters, device.CanonicalName())
+				}
+				return
+			}
+			require.True(t, exists)
+			assert.Equal(t, AmdHiveDeviceType, hive.Type())
+			assert.Equal(t, []string{"0000:03:00.0", "0000:23:00.0"}, hive.GPUs())
+
+			counters := make(map[string]int64)
+			for name, counter := range hive.CounterSet().Counters {
+				counters[name] = quantityValue(counter.Value)
+			}
+			assert.Equal(t, test.hive, counters)
+			require.Len(t, hive.GetDevice().ConsumesCounters, 1)
+			assert.Equal(t, hive.CounterSet().Counters, hive.GetDevice().ConsumesCounters[0].Counters)
+
+			// Each device of a GPU takes one of the counter of its GPU.
+			for name, device := range devices {
+				if device == hive {
+					continue
+				}
+				consumes := device.GetDevice().ConsumesCounters
+				require.Len(t, consumes, 1, name)
+				assert.Equal(t, testHiveDevice, consumes[0].CounterSet, name)
+				require.Len(t, consumes[0].Counters, 1, name)
+				assert.Equal(t, int64(1), quantityValue(consumes[0].Counters[parentGPU(device).CanonicalName()].Value), name)
+				assert.Same(t, hive.CounterSet(), device.CounterSet(), name)
+			}
+		})
+	}
+}
+
+func TestHiveDevice(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1), false, true)
+	require.NoError(t, err)
+
+	hive := devices[testHiveDevice].AmdHive
+	require.Len(t, hive.GPUs, 2)
+	device := hive.GetDevice()
+	assert.Equal(t, testHiveDevice, device.Name)
+	assert.Equal(t, AmdHiveDeviceType, *device.Attributes["type"].StringValue)
+	assert.Equal(t, "0x3b7d2a1e9f4c8065", *device.Attributes["xgmiHiveID"].StringValue)
+	assert.Equal(t, int64(2), *device.Attributes["gpuCount"].IntValue)
+	assert.Equal(t, int64(hive.GPUs[0].MemoryBytes+hive.GPUs[1].MemoryBytes), quantityValue(device.Capacity["memory"].Value))
+	assert.Equal(t, int64(hive.GPUs[0].ComputeUnits+hive.GPUs[1].ComputeUnits), quantityValue(device.Capacity["computeUnits"].Value))
+	assert.NotZero(t, hive.GPUs[0].ComputeUnits)
+}
+
+func TestDeviceStatePublishedSlicesHive(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	useHiveDevices(t, state)
+
+	slices := state.PublishedSlices()
+	require.Len(t, slices, 1)
+	assert.Len(t, slices[0].Devices, 17)
+	require.Len(t, slices[0].SharedCounters, 1)
+	assert.Equal(t, testHiveDevice, slices[0].SharedCounters[0].Name)
+
+	// Devices outside of any hive share a slice without counters.
+	state = newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI210))
+	useHiveDevices(t, state)
+	slices = state.PublishedSlices()
+	require.Len(t, slices, 1)
+	assert.Len(t, slices[0].Devices, 2)
+	assert.Empty(t, slices[0].SharedCounters)
+}
+
+func TestDeviceStatePublishedDevicesHiveTaint(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	useHiveDevices(t, state)
+	state.rasTaints["0000:23:00.0"] = &resourceapi.DeviceTaint{Key: "taint", Effect: resourceapi.DeviceTaintEffectNoSchedule}
+
+	taints := make(map[string]int)
+	for _, device := range state.PublishedDevices() {
+		taints[device.Name] = len(device.Taints)
+	}
+	assert.Equal(t, map[string]int{
+		"gpu-43d0a94e5d4cf437": 0,
+		"gpu-9c1a3b4fe2d07a11": 1,
+		testHiveDevice:         1,
+	}, taints)
+}
+
+func TestDeviceStatePrepareHive(t *testing.T) {
+	state := newTestPrepareState(t, amdgputest.MI300XCPXNPS1)
+	useHiveDevices(t, state)
+
+	results, _ := state.Prepare([]*resourceapi.ResourceClaim{newTestClaim("claim-uid", testHiveDevice)})
+	require.NoError(t, results["claim-uid"].Err)
+	require.Len(t, results["claim-uid"].Devices, 1)
+
+	// The hive is prepared as a single device with the nodes of all
+	// partitions of its GPUs.
+	prepared := state.checkpoint.V2.PreparedClaims["claim-uid"].PreparedDevices
+	require.Len(t, prepared, 1)
+	assert.Len(t, prepared[0].ContainerEdits.DeviceNodes, 1+2*16)
+	assert.Len(t, prepared[0].VisibleDevices, 16)
+	assert.ElementsMatch(t, []string{"0000:03:00.0", "0000:23:00.0"}, state.preparedClaimGPUs(state.checkpoint.V2.PreparedClaims["claim-uid"]))
+	assert.Equal(t, "claim-uid", state.claimUsingGPU(state.checkpoint, "other", "0000:23:00.0"))
+
+	require.NoError(t, state.Unprepare("claim-uid"))
+	assert.Empty(t, state.checkpoint.V2.PreparedClaims)
+}
+
+func TestDeviceStateApplyConfigHive(t *testing.T) {
+	state := newTestPrepareState(t, amdgputest.MI300XCPXNPS1)
+	useHiveDevices(t, state)
+	results := []*resourceapi.DeviceRequestAllocationResult{{Request: "gpu", Pool: "node", Device: testHiveDevice}}
+
+	for name, config := range map[string]*configapi.GpuConfig{
+		"partitioning": {Partitioning: &configapi.PartitioningConfig{ComputeMode: "SPX"}},
+		"performance":  {Performance: &configapi.PerformanceConfig{PowerProfile: "COMPUTE"}},
+	} {
+		_, err := state.applyConfig("claim-uid", config, results)
+		assert.ErrorContains(t, err, "cannot be partitioned or have its performance configured", name)
+	}
+}
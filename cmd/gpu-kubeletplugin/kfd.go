@@ -0,0 +1,192 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+)
+
+const (
+	// kfdProcessPollInterval is how often KFD processes are listed while
+	// waiting for them to exit.
+	kfdProcessPollInterval = 100 * time.Millisecond
+	// kfdKillTimeout is how long killed processes are given to exit and
+	// release their GPU memory.
+	kfdKillTimeout = 5 * time.Second
+)
+
+// killProcess kills a process of the host. It is replaced in tests.
+var killProcess = func(pid int) error {
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// kfdProcessesUsing returns the KFD processes that use any of the GPUs or
+// partitions with the given KFD gpu_ids.
+func (s *DeviceState) kfdProcessesUsing(gpuIDs sets.Set[int]) ([]amdgpu.KFDProcess, error) {
+	if gpuIDs.Len() == 0 {
+		return nil, nil
+	}
+	processes, err := amdgpu.GetKFDProcesses(s.hostRoot)
+	if err != nil {
+		return nil, err
+	}
+	var using []amdgpu.KFDProcess
+	for _, process := range processes {
+		if slices.ContainsFunc(gpuIDs.UnsortedList(), process.Uses) {
+			using = append(using, process)
+		}
+	}
+	return using, nil
+}
+
+// waitForKFDProcesses waits up to timeout for the processes using any of the
+// given GPUs to exit and returns those that did not.
+func (s *DeviceState) waitForKFDProcesses(gpuIDs sets.Set[int], timeout time.Duration) ([]amdgpu.KFDProcess, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		processes, err := s.kfdProcessesUsing(gpuIDs)
+		if err != nil || len(processes) == 0 || !time.Now().Before(deadline) {
+			return processes, err
+		}
+		time.Sleep(kfdProcessPollInterval)
+	}
+}
+
+// checkKFDProcesses returns an error if a device about to be prepared is used
+// by a process. No container of the claim can be running yet, so such a
+// process belongs to someone else, e.g. a container of a claim that was
+// unprepared while the process kept running. Devices shared with other
+// prepared claims are skipped, their processes are expected.
+func (s *DeviceState) checkKFDProcesses(claimUID string, results []resourceapi.DeviceRequestAllocationResult) error {
+	s.Lock()
+	devices := make(map[int]string)
+	for _, result := range results {
+		device, exists := s.allocatable[result.Device]
+		if !exists || len(sharers(s.checkpoint, claimUID, result.Device)) > 0 {
+			continue
+		}
+		for _, backing := range s.backingDevices(result.Device, device.PCIAddress()) {
+			if gpuID := backing.KFDGPUID(); gpuID != 0 {
+				devices[gpuID] = result.Device
+			}
+		}
+	}
+	s.Unlock()
+	processes, err := s.kfdProcessesUsing(sets.KeySet(devices))
+	if err != nil {
+		return err
+	}
+	for _, process := range processes {
+		for _, gpuID := range slices.Sorted(maps.Keys(devices)) {
+			if process.Uses(gpuID) {
+				return fmt.Errorf("device %s is in use by process %d", devices[gpuID], process.PID)
+			}
+		}
+	}
+	return nil
+}
+
+// claimGPUIDs returns the KFD gpu_ids of the devices backing the prepared
+// devices of a claim.
+func (s *DeviceState) claimGPUIDs(devices PreparedDevices) sets.Set[int] {
+	gpuIDs := sets.New[int]()
+	for _, prepared := range devices {
+		device, exists := s.allocatable[prepared.DeviceName]
+		if !exists {
+			continue
+		}
+		for _, backing := range s.backingDevices(prepared.DeviceName, device.PCIAddress()) {
+			if gpuID := backing.KFDGPUID(); gpuID != 0 {
+				gpuIDs.Insert(gpuID)
+			}
+		}
+	}
+	return gpuIDs
+}
+
+// sharedDevices returns the names of the devices of a claim that are also
+// prepared for other claims in the checkpoint. Must be called with the state
+// locked; the result can be used once it is unlocked.
+func sharedDevices(checkpoint *Checkpoint, claimUID string, devices PreparedDevices) sets.Set[string] {
+	shared := sets.New[string]()
+	for _, device := range devices {
+		if len(sharers(checkpoint, claimUID, device.DeviceName)) > 0 {
+			shared.Insert(device.DeviceName)
+		}
+	}
+	return shared
+}
+
+// releaseKFDProcesses makes sure that no process uses the GPUs of a claim
+// being unprepared anymore. It waits up to kfdProcessTimeout for the processes
+// to exit and then kills them if killKFDProcesses is set. A process that is
+// still around holds on to GPU memory, so the claim must not be released; the
+// returned error makes kubelet retry Unprepare later. Devices still shared
+// with other prepared claims, as returned by sharedDevices, are skipped, since
+// the processes of those claims cannot be told apart from the ones of this
+// claim. Must be called without the state locked, which waiting would block.
+func (s *DeviceState) releaseKFDProcesses(claimUID string, devices PreparedDevices, shared sets.Set[string]) error {
+	s.Lock()
+	var exclusive PreparedDevices
+	for _, device := range devices {
+		if !shared.Has(device.DeviceName) {
+			exclusive = append(exclusive, device)
+		}
+	}
+	gpuIDs := s.claimGPUIDs(exclusive)
+	s.Unlock()
+	processes, err := s.waitForKFDProcesses(gpuIDs, s.kfdProcessTimeout)
+	if err != nil {
+		return err
+	}
+
+	if len(processes) > 0 && s.killKFDProcesses {
+		for _, process := range processes {
+			klog.Warningf("Killing process %d which still uses the GPUs of claim %s", process.PID, claimUID)
+			if err := killProcess(process.PID); err != nil {
+				return fmt.Errorf("unable to kill process %d: %w", process.PID, err)
+			}
+		}
+		processes, err = s.waitForKFDProcesses(gpuIDs, kfdKillTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(processes) > 0 {
+		pids := make([]int, len(processes))
+		for i, process := range processes {
+			pids[i] = process.PID
+		}
+		return fmt.Errorf("GPUs of claim %s are still in use by processes %v", claimUID, pids)
+	}
+	return nil
+}
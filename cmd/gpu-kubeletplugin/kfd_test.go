@@ -0,0 +1,177 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestDeviceStateCheckKFDProcesses(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	xcp0 := state.allocatable["gpu-43d0a94e5d4cf437-xcp0"].KFDGPUID()
+	xcp1 := state.allocatable["gpu-43d0a94e5d4cf437-xcp1"].KFDGPUID()
+	require.NotZero(t, xcp0)
+	require.NotEqual(t, xcp0, xcp1)
+
+	results := []resourceapi.DeviceRequestAllocationResult{
+		{Request: "gpu", Device: "gpu-43d0a94e5d4cf437-xcp0"},
+	}
+	assert.NoError(t, state.checkKFDProcesses("claim-uid", results))
+
+	// A process on another partition of the GPU does not matter.
+	amdgputest.AddKFDProcess(t, state.hostRoot, 1717, xcp1)
+	assert.NoError(t, state.checkKFDProcesses("claim-uid", results))
+
+	amdgputest.AddKFDProcess(t, state.hostRoot, 4242, xcp1, xcp0)
+	assert.EqualError(t, state.checkKFDProcesses("claim-uid", results), "device gpu-43d0a94e5d4cf437-xcp0 is in use by process 4242")
+
+	// The processes of a device shared with another claim are expected.
+	checkpoint := newCheckpoint()
+	checkpoint.V2.PreparedClaims["other-uid"] = preparedClaim(PreparedDevices{
+		{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437-xcp0"}},
+	})
+	state.checkpoint = checkpoint
+	assert.NoError(t, state.checkKFDProcesses("claim-uid", results))
+}
+
+func TestDeviceStateReleaseKFDProcesses(t *testing.T) {
+	tests := map[string]struct {
+		processes   map[int]string // PID -> device used
+		exitAfter   time.Duration  // the processes exit on their own
+		timeout     time.Duration
+		kill        bool
+		shared      bool // another claim shares the device
+		expectedErr string
+	}{
+		"no processes": {},
+		"process of another device": {
+			processes: map[int]string{1717: "gpu-9c1a3b4fe2d07a11"},
+		},
+		"process exits before the timeout": {
+			processes: map[int]string{4242: "gpu-43d0a94e5d4cf437"},
+			exitAfter: 50 * time.Millisecond,
+			timeout:   5 * time.Second,
+		},
+		"process keeps running": {
+			processes:   map[int]string{4242: "gpu-43d0a94e5d4cf437", 1717: "gpu-9c1a3b4fe2d07a11"},
+			timeout:     200 * time.Millisecond,
+			expectedErr: "GPUs of claim claim-uid are still in use by processes [4242]",
+		},
+		"process killed": {
+			processes: map[int]string{4242: "gpu-43d0a94e5d4cf437"},
+			kill:      true,
+		},
+		"process of a device shared with another claim": {
+			processes: map[int]string{4242: "gpu-43d0a94e5d4cf437"},
+			timeout:   5 * time.Second,
+			kill:      true,
+			shared:    true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+			state.kfdProcessTimeout = test.timeout
+			state.killKFDProcesses = test.kill
+
+			exits := make(map[int]func())
+			for pid, device := range test.processes {
+				exits[pid] = amdgputest.AddKFDProcess(t, state.hostRoot, pid, state.allocatable[device].KFDGPUID())
+			}
+			if test.exitAfter > 0 {
+				timer := time.AfterFunc(test.exitAfter, func() {
+					for _, exit := range exits {
+						exit()
+					}
+				})
+				defer timer.Stop()
+			}
+
+			var killed []int
+			defer func(kill func(int) error) { killProcess = kill }(killProcess)
+			killProcess = func(pid int) error {
+				killed = append(killed, pid)
+				exits[pid]()
+				return nil
+			}
+
+			devices := PreparedDevices{
+				{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}},
+			}
+			checkpoint := newCheckpoint()
+			checkpoint.V2.PreparedClaims["claim-uid"] = preparedClaim(devices)
+			if test.shared {
+				checkpoint.V2.PreparedClaims["other-uid"] = preparedClaim(devices)
+			}
+			err := state.releaseKFDProcesses("claim-uid", devices, sharedDevices(checkpoint, "claim-uid", devices))
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			if test.kill && !test.shared {
+				assert.Equal(t, []int{4242}, killed)
+			} else {
+				assert.Empty(t, killed)
+			}
+		})
+	}
+}
+
+func TestDeviceStateRestoreSettings(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+
+	// The claim repartitioned the whole first GPU, the other claim uses the
+	// second one.
+	require.NoError(t, amdgpu.SetPartitionModes("0000:03:00.0", amdgpu.PartitionModes{Compute: "CPX"}, state.hostRoot))
+	require.NoError(t, amdgpu.SetPartitionModes("0000:23:00.0", amdgpu.PartitionModes{Compute: "CPX"}, state.hostRoot))
+	spx := amdgpu.PartitionModes{Compute: "SPX", Memory: "NPS1"}
+	devices := PreparedDevices{
+		{
+			Device:  drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"},
+			Restore: &DeviceSettings{PCIAddress: "0000:03:00.0", PartitionModes: &spx},
+		},
+		{
+			Device:  drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"},
+			Restore: &DeviceSettings{PCIAddress: "0000:23:00.0", PartitionModes: &spx},
+		},
+	}
+	checkpoint := newCheckpoint()
+	checkpoint.V2.PreparedClaims["claim-uid"] = preparedClaim(devices)
+	checkpoint.V2.PreparedClaims["other-claim"] = preparedClaim(PreparedDevices{
+		{Device: drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"}},
+	})
+
+	require.NoError(t, state.restoreSettings("claim-uid", devices, checkpoint))
+
+	modes, err := amdgpu.GetPartitionModes("0000:03:00.0", state.hostRoot)
+	require.NoError(t, err)
+	assert.Equal(t, spx, modes)
+	modes, err = amdgpu.GetPartitionModes("0000:23:00.0", state.hostRoot)
+	require.NoError(t, err)
+	assert.Equal(t, "CPX", modes.Compute)
+}
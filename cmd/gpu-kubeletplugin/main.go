@@ -40,13 +40,16 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	cli "github.com/urfave/cli/v2"
 
+	resourceapi "k8s.io/api/resource/v1"
 	coreclientset "k8s.io/client-go/kubernetes"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
 	klog "k8s.io/klog/v2"
 
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/flags"
 )
@@ -61,9 +64,23 @@ type Flags struct {
 
 	nodeName                      string
 	cdiRoot                       string
+	hostRoot                      string
 	kubeletRegistrarDirectoryPath string
 	kubeletPluginsDirectoryPath   string
 	healthcheckPort               int
+	metricsPort                   int
+	expectedGPUs                  int
+	deviceResyncInterval          time.Duration
+	rasPollInterval               time.Duration
+	rasThresholds                 string
+	rasTaintEffect                string
+	claimReconcileInterval        time.Duration
+	partitionableDevices          bool
+	hiveDevices                   bool
+	deviceSharing                 bool
+	sharingReplicas               int
+	kfdProcessTimeout             time.Duration
+	killKFDProcesses              bool
 }
 
 type Config struct {
@@ -102,6 +119,13 @@ func newApp() *cli.App {
 			Destination: &flags.cdiRoot,
 			EnvVars:     []string{"CDI_ROOT"},
 		},
+		&cli.StringFlag{
+			Name:        "host-root",
+			Usage:       "Absolute path to the directory under which the host's /sys and /dev trees are found.",
+			Value:       amdgpu.DefaultHostRoot,
+			Destination: &flags.hostRoot,
+			EnvVars:     []string{"HOST_ROOT"},
+		},
 		&cli.StringFlag{
 			Name:        "kubelet-registrar-directory-path",
 			Usage:       "Absolute path to the directory where kubelet stores plugin registrations.",
@@ -123,6 +147,96 @@ func newApp() *cli.App {
 			Destination: &flags.healthcheckPort,
 			EnvVars:     []string{"HEALTHCHECK_PORT"},
 		},
+		&cli.IntFlag{
+			Name:        "metrics-port",
+			Usage:       "Port to serve Prometheus metrics at /metrics. When positive, a literal port number. When zero, a random port is allocated. When negative, metrics are not served.",
+			Value:       -1,
+			Destination: &flags.metricsPort,
+			EnvVars:     []string{"METRICS_PORT"},
+		},
+		&cli.IntFlag{
+			Name:        "expected-gpus",
+			Usage:       "Number of GPUs the node is expected to have, checked by the readiness service of the healthcheck. When zero, the " + expectedGPUsLabel + " label of the node is used if set.",
+			Destination: &flags.expectedGPUs,
+			EnvVars:     []string{"EXPECTED_GPUS"},
+		},
+		&cli.DurationFlag{
+			Name:        "device-resync-interval",
+			Usage:       "Interval at which devices are rediscovered in addition to when the kernel reports a GPU uevent. When zero or negative, devices are only rediscovered on uevents.",
+			Value:       5 * time.Minute,
+			Destination: &flags.deviceResyncInterval,
+			EnvVars:     []string{"DEVICE_RESYNC_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:        "ras-poll-interval",
+			Usage:       "Interval at which the RAS error counters of the GPUs are polled. When zero or negative, RAS health checks are disabled.",
+			Value:       30 * time.Second,
+			Destination: &flags.rasPollInterval,
+			EnvVars:     []string{"RAS_POLL_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "ras-thresholds",
+			Usage:       "Comma separated <condition>=<count> thresholds at which a GPU and its partitions are tainted. Conditions are 'ue' and 'ce' for uncorrectable and correctable errors of any RAS block, '<block>_ue' and '<block>_ce' (e.g. 'umc_ce') for a single block, and 'bad_pages' for retired VRAM pages. A count of 0 disables the condition.",
+			Value:       DefaultRASThresholds,
+			Destination: &flags.rasThresholds,
+			EnvVars:     []string{"RAS_THRESHOLDS"},
+		},
+		&cli.StringFlag{
+			Name:        "ras-taint-effect",
+			Usage:       "Effect of the taint put on GPUs that exceed a RAS threshold: NoSchedule or NoExecute.",
+			Value:       string(resourceapi.DeviceTaintEffectNoSchedule),
+			Destination: &flags.rasTaintEffect,
+			EnvVars:     []string{"RAS_TAINT_EFFECT"},
+		},
+		&cli.DurationFlag{
+			Name:        "claim-reconcile-interval",
+			Usage:       "Interval at which prepared claims that no longer exist or are no longer reserved are unprepared, and CDI spec files of claims that are not prepared are deleted, in addition to at startup. When zero or negative, claims are only reconciled at startup.",
+			Value:       5 * time.Minute,
+			Destination: &flags.claimReconcileInterval,
+			EnvVars:     []string{"CLAIM_RECONCILE_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "partitionable-devices",
+			Usage:       "Publish every partition layout supported by a GPU as partitionable devices with shared counters instead of only its current partitions. Requires the DRAPartitionableDevices feature gate.",
+			Value:       false,
+			Destination: &flags.partitionableDevices,
+			EnvVars:     []string{"PARTITIONABLE_DEVICES"},
+		},
+		&cli.BoolFlag{
+			Name:        "hive-devices",
+			Usage:       "Additionally publish a device for every XGMI hive that allocates all of its GPUs at once, sharing counters with the devices of its GPUs. Cannot be combined with --partitionable-devices or --device-sharing. Requires the DRAPartitionableDevices feature gate.",
+			Value:       false,
+			Destination: &flags.hiveDevices,
+			EnvVars:     []string{"HIVE_DEVICES"},
+		},
+		&cli.BoolFlag{
+			Name:        "device-sharing",
+			Usage:       "Publish devices as allocatable to several claims at once, which share them with the sharing strategy of their GpuConfig. Requires the DRAConsumableCapacity feature gate.",
+			Value:       false,
+			Destination: &flags.deviceSharing,
+			EnvVars:     []string{"DEVICE_SHARING"},
+		},
+		&cli.IntFlag{
+			Name:        "sharing-replicas",
+			Usage:       "Number of claims a device can be allocated to with --device-sharing, published as its 'replicas' capacity of which every allocation consumes one.",
+			Value:       4,
+			Destination: &flags.sharingReplicas,
+			EnvVars:     []string{"SHARING_REPLICAS"},
+		},
+		&cli.DurationFlag{
+			Name:        "kfd-process-timeout",
+			Usage:       "How long unpreparing a claim waits for processes that still use its GPUs to exit before failing, or killing them with --kill-kfd-processes.",
+			Value:       10 * time.Second,
+			Destination: &flags.kfdProcessTimeout,
+			EnvVars:     []string{"KFD_PROCESS_TIMEOUT"},
+		},
+		&cli.BoolFlag{
+			Name:        "kill-kfd-processes",
+			Usage:       "Kill processes that still use the GPUs of a claim after --kfd-process-timeout when unpreparing it. Requires the host PID namespace.",
+			Value:       false,
+			Destination: &flags.killKFDProcesses,
+			EnvVars:     []string{"KILL_KFD_PROCESSES"},
+		},
 	}
 	cliFlags = append(cliFlags, flags.kubeClientConfig.Flags()...)
 	cliFlags = append(cliFlags, flags.loggingConfig.Flags()...)
@@ -0,0 +1,258 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	klog "k8s.io/klog/v2"
+)
+
+const metricsNamespace = "amd_gpu_dra"
+
+// Reasons under which prepare and unprepare errors are counted.
+const (
+	reasonNotAllocated      = "NotAllocated"
+	reasonDeviceUnavailable = "DeviceUnavailable"
+	reasonDeviceBusy        = "DeviceBusy"
+	reasonInvalidConfig     = "InvalidConfig"
+	reasonConfigFailed      = "ConfigFailed"
+	reasonRestoreFailed     = "RestoreFailed"
+	reasonCDIFailed         = "CDIFailed"
+	reasonCheckpointFailed  = "CheckpointFailed"
+	reasonUnpreparing       = "Unpreparing"
+	reasonUnknown           = "Unknown"
+)
+
+var (
+	discoveredDevices = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "discovered_devices",
+			Help:      "Number of devices discovered on the node by device type and product name.",
+		},
+		[]string{"type", "product"},
+	)
+	preparedClaims = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "prepared_claims",
+			Help:      "Number of claims in the checkpoint by checkpoint state.",
+		},
+		[]string{"state"},
+	)
+	prepareDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "prepare_duration_seconds",
+			Help:      "Time taken to prepare a claim, including waiting for other claims of its GPUs.",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+	unprepareDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "unprepare_duration_seconds",
+			Help:      "Time taken to unprepare a claim, including waiting for its processes to exit.",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 16),
+		},
+	)
+	prepareErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "prepare_errors_total",
+			Help:      "Number of claims that failed to prepare by reason.",
+		},
+		[]string{"reason"},
+	)
+	unprepareErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "unprepare_errors_total",
+			Help:      "Number of claims that failed to unprepare by reason.",
+		},
+		[]string{"reason"},
+	)
+	checkpointWriteDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "checkpoint_write_duration_seconds",
+			Help:      "Time taken to write the checkpoint.",
+			Buckets:   metrics.ExponentialBuckets(0.0001, 2, 15),
+		},
+	)
+	discoveryDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "discovery_duration_seconds",
+			Help:      "Time taken to discover the devices of the node.",
+			Buckets:   metrics.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+	resourceSlicePublishes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resourceslice_publish_total",
+			Help:      "Number of publications of the ResourceSlices of the node by result, success or error.",
+		},
+		[]string{"result"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the metrics of the plugin. Metrics are only
+// recorded once registered.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(
+			discoveredDevices,
+			preparedClaims,
+			prepareDuration,
+			unprepareDuration,
+			prepareErrors,
+			unprepareErrors,
+			checkpointWriteDuration,
+			discoveryDuration,
+			resourceSlicePublishes,
+		)
+	})
+}
+
+// recordDiscoveredDevices sets the discovered devices metric to the given
+// devices.
+func recordDiscoveredDevices(devices AllocatableDevices) {
+	discoveredDevices.Reset()
+	for _, device := range devices {
+		discoveredDevices.WithLabelValues(device.Type(), device.ProductName()).Inc()
+	}
+}
+
+// recordPreparedClaims sets the prepared claims metric to the claims of a
+// checkpoint.
+func recordPreparedClaims(checkpoint *Checkpoint) {
+	preparedClaims.Reset()
+	for _, state := range []ClaimCheckpointState{
+		ClaimCheckpointStatePrepareStarted,
+		ClaimCheckpointStatePrepareCompleted,
+		ClaimCheckpointStateUnprepareStarted,
+	} {
+		preparedClaims.WithLabelValues(string(state)).Set(0)
+	}
+	for _, claim := range checkpoint.V2.PreparedClaims {
+		preparedClaims.WithLabelValues(string(claim.CheckpointState)).Inc()
+	}
+}
+
+// publishResult returns the result label of a ResourceSlice publication.
+func publishResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// reasonError is an error with the reason it is counted under.
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e *reasonError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reasonError) Unwrap() error {
+	return e.err
+}
+
+// withReason returns err with the reason it is counted under. The innermost
+// reason of an error wins.
+func withReason(reason string, err error) error {
+	var existing *reasonError
+	if errors.As(err, &existing) {
+		return err
+	}
+	return &reasonError{reason: reason, err: err}
+}
+
+// errorReason returns the reason an error is counted under.
+func errorReason(err error) string {
+	var reasoned *reasonError
+	if errors.As(err, &reasoned) {
+		return reasoned.reason
+	}
+	return reasonUnknown
+}
+
+// metricsServer serves the metrics of the plugin over HTTP.
+type metricsServer struct {
+	server *http.Server
+	addr   net.Addr
+	wg     sync.WaitGroup
+}
+
+// startMetricsServer serves the metrics at /metrics on the given port, or on
+// a random port if it is zero. It returns nil if the port is negative.
+func startMetricsServer(ctx context.Context, port int) (*metricsServer, error) {
+	log := klog.FromContext(ctx)
+
+	if port < 0 {
+		return nil, nil
+	}
+
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics at %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", legacyregistry.Handler())
+	m := &metricsServer{
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		addr:   lis.Addr(),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		log.Info("starting metrics server", "addr", m.addr.String())
+		if err := m.server.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(err, "failed to serve metrics", "addr", addr)
+		}
+	}()
+
+	return m, nil
+}
+
+func (m *metricsServer) Stop(logger klog.Logger) {
+	logger.Info("stopping metrics server")
+	if err := m.server.Shutdown(context.Background()); err != nil {
+		logger.Error(err, "failed to stop metrics server")
+	}
+	m.wg.Wait()
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/component-base/metrics/legacyregistry"
+	klog "k8s.io/klog/v2"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+// metricValue returns the value of a counter or gauge of the registered
+// metrics, or the sample count of a histogram, summed over the series with
+// the given labels.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var value float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if v, exists := labels[label.GetName()]; exists && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched < len(labels) {
+				continue
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				value += metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				value += metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				value += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return value
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "without reason",
+			err:  errors.New("failed"),
+			want: reasonUnknown,
+		},
+		{
+			name: "with reason",
+			err:  withReason(reasonDeviceBusy, errors.New("failed")),
+			want: reasonDeviceBusy,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("prepare failed: %w", withReason(reasonInvalidConfig, errors.New("failed"))),
+			want: reasonInvalidConfig,
+		},
+		{
+			name: "innermost reason",
+			err:  withReason(reasonConfigFailed, withReason(reasonCheckpointFailed, errors.New("failed"))),
+			want: reasonCheckpointFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, errorReason(tt.err))
+		})
+	}
+}
+
+func TestDeviceStateMetrics(t *testing.T) {
+	registerMetrics()
+	state := newTestPrepareState(t, amdgputest.MI300XCPXNPS1)
+	assert.Equal(t, float64(len(state.allocatable)), metricValue(t, "amd_gpu_dra_discovered_devices", nil))
+	assert.Equal(t, float64(len(state.allocatable)), metricValue(t, "amd_gpu_dra_discovered_devices", map[string]string{"type": AmdPartitionDeviceType}))
+
+	unallocated := newTestClaim("unallocated")
+	unallocated.Status.Allocation = nil
+	prepares := metricValue(t, "amd_gpu_dra_prepare_duration_seconds", nil)
+	unavailable := metricValue(t, "amd_gpu_dra_prepare_errors_total", map[string]string{"reason": reasonDeviceUnavailable})
+	notAllocated := metricValue(t, "amd_gpu_dra_prepare_errors_total", map[string]string{"reason": reasonNotAllocated})
+	writes := metricValue(t, "amd_gpu_dra_checkpoint_write_duration_seconds", nil)
+	results, _ := state.Prepare([]*resourceapi.ResourceClaim{
+		newTestClaim("claim", "gpu-43d0a94e5d4cf437-xcp0"),
+		newTestClaim("unknown", "gpu-0000000000000000"),
+		unallocated,
+	})
+	require.NoError(t, results["claim"].Err)
+	assert.Equal(t, prepares+3, metricValue(t, "amd_gpu_dra_prepare_duration_seconds", nil))
+	assert.Equal(t, unavailable+1, metricValue(t, "amd_gpu_dra_prepare_errors_total", map[string]string{"reason": reasonDeviceUnavailable}))
+	assert.Equal(t, notAllocated+1, metricValue(t, "amd_gpu_dra_prepare_errors_total", map[string]string{"reason": reasonNotAllocated}))
+	// The batch is started and committed, the failed claims rolled back.
+	assert.Equal(t, writes+4, metricValue(t, "amd_gpu_dra_checkpoint_write_duration_seconds", nil))
+	assert.Equal(t, float64(1), metricValue(t, "amd_gpu_dra_prepared_claims", map[string]string{"state": string(ClaimCheckpointStatePrepareCompleted)}))
+
+	unprepares := metricValue(t, "amd_gpu_dra_unprepare_duration_seconds", nil)
+	require.NoError(t, state.Unprepare("claim"))
+	assert.Equal(t, unprepares+1, metricValue(t, "amd_gpu_dra_unprepare_duration_seconds", nil))
+	assert.Zero(t, metricValue(t, "amd_gpu_dra_prepared_claims", nil))
+}
+
+func TestMetricsServer(t *testing.T) {
+	registerMetrics()
+	resourceSlicePublishes.WithLabelValues(publishResult(nil)).Inc()
+
+	server, err := startMetricsServer(t.Context(), 0)
+	require.NoError(t, err)
+	defer server.Stop(klog.Background())
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", server.addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `amd_gpu_dra_resourceslice_publish_total{result="success"}`)
+
+	disabled, err := startMetricsServer(t.Context(), -1)
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+}
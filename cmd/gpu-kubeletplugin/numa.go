@@ -0,0 +1,150 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+	"k8s.io/utils/cpuset"
+)
+
+const (
+	// topologyFileContainerPath is where the topology file of a claim is
+	// mounted in its containers.
+	topologyFileContainerPath = "/var/run/amd-gpu/topology.json"
+)
+
+// numaAffinity returns the NUMA nodes of the devices backing an allocated
+// device, in ascending order, and the CPUs local to them. Devices whose NUMA
+// node or local CPUs are unknown are left out.
+func numaAffinity(backing []*AllocatableDevice) ([]int, string) {
+	var nodes []int
+	cpus := cpuset.New()
+	for _, device := range backing {
+		if node := device.NumaNode(); node >= 0 && !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+		local, err := cpuset.Parse(device.LocalCPUs())
+		if err != nil {
+			klog.Warningf("Device %s has invalid local CPUs %q: %v", device.CanonicalName(), device.LocalCPUs(), err)
+			continue
+		}
+		cpus = cpus.Union(local)
+	}
+	slices.Sort(nodes)
+	return nodes, cpus.String()
+}
+
+// mergeNumaAffinity returns the NUMA nodes and local CPUs of all devices of a
+// claim.
+func mergeNumaAffinity(devices PreparedDevices) ([]int, string) {
+	var nodes []int
+	cpus := cpuset.New()
+	for _, device := range devices {
+		for _, node := range device.NumaNodes {
+			if !slices.Contains(nodes, node) {
+				nodes = append(nodes, node)
+			}
+		}
+		// The CPUs were formatted by numaAffinity.
+		local, _ := cpuset.Parse(device.LocalCPUs)
+		cpus = cpus.Union(local)
+	}
+	slices.Sort(nodes)
+	return nodes, cpus.String()
+}
+
+// numaEnv returns the environment variables that tell the containers of a
+// claim which NUMA nodes its devices are on and which CPUs are local to them,
+// e.g. for launchers to pin their ranks. Variables whose value is unknown are
+// left out.
+func numaEnv(devices PreparedDevices) []string {
+	nodes, cpus := mergeNumaAffinity(devices)
+	var env []string
+	if len(nodes) > 0 {
+		env = append(env, "AMD_GPU_NUMA_NODES="+formatNumaNodes(nodes))
+	}
+	if cpus != "" {
+		env = append(env, "AMD_GPU_LOCAL_CPUS="+cpus)
+	}
+	return env
+}
+
+func formatNumaNodes(nodes []int) string {
+	s := make([]string, len(nodes))
+	for i, node := range nodes {
+		s[i] = strconv.Itoa(node)
+	}
+	return strings.Join(s, ",")
+}
+
+// TopologyFile is the content of the topology file of a claim.
+type TopologyFile struct {
+	// NumaNodes and LocalCPUs are those of all devices of the claim, as in
+	// AMD_GPU_NUMA_NODES and AMD_GPU_LOCAL_CPUS.
+	NumaNodes []int               `json:"numaNodes"`
+	LocalCPUs string              `json:"localCPUs"`
+	Devices   []TopologyFileEntry `json:"devices"`
+}
+
+// TopologyFileEntry describes an allocated device in the topology file.
+type TopologyFileEntry struct {
+	Name     string   `json:"name"`
+	Requests []string `json:"requests"`
+	// VisibleDevices are the GPUs and partitions backing the device as
+	// listed in ROCR_VISIBLE_DEVICES.
+	VisibleDevices []string `json:"visibleDevices"`
+	NumaNodes      []int    `json:"numaNodes"`
+	LocalCPUs      string   `json:"localCPUs"`
+}
+
+// topologyFileRequested returns whether the config of any device of a claim
+// asks for a topology file.
+func topologyFileRequested(devices PreparedDevices) bool {
+	return slices.ContainsFunc(devices, func(device *PreparedDevice) bool {
+		return device.Config != nil && device.Config.TopologyFile
+	})
+}
+
+// topologyFile returns the topology file of a claim.
+func topologyFile(devices PreparedDevices) ([]byte, error) {
+	file := TopologyFile{Devices: []TopologyFileEntry{}}
+	nodes, cpus := mergeNumaAffinity(devices)
+	file.NumaNodes, file.LocalCPUs = append([]int{}, nodes...), cpus
+	indices := make(map[int]int)
+	for i, v := range claimVisibleDevices(devices) {
+		indices[v.Ordinal] = i
+	}
+	for _, device := range devices {
+		entry := TopologyFileEntry{
+			Name:           device.DeviceName,
+			Requests:       device.RequestNames,
+			VisibleDevices: []string{},
+			NumaNodes:      append([]int{}, device.NumaNodes...),
+			LocalCPUs:      device.LocalCPUs,
+		}
+		for _, v := range device.VisibleDevices {
+			entry.VisibleDevices = append(entry.VisibleDevices, v.entry(indices[v.Ordinal]))
+		}
+		file.Devices = append(file.Devices, entry)
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
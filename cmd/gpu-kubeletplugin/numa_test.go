@@ -0,0 +1,146 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestNumaEnv(t *testing.T) {
+	tests := map[string]struct {
+		devices  PreparedDevices
+		expected []string
+	}{
+		"no devices": {
+			devices:  nil,
+			expected: nil,
+		},
+		"unknown NUMA nodes": {
+			devices:  PreparedDevices{{}},
+			expected: nil,
+		},
+		"merged": {
+			devices: PreparedDevices{
+				{NumaNodes: []int{1}, LocalCPUs: "48-95,144-191"},
+				{NumaNodes: []int{0}, LocalCPUs: "0-47,96-143"},
+				{NumaNodes: []int{0}, LocalCPUs: "0-47,96-143"},
+			},
+			expected: []string{
+				"AMD_GPU_NUMA_NODES=0,1",
+				"AMD_GPU_LOCAL_CPUS=0-191",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, numaEnv(test.devices))
+		})
+	}
+}
+
+func TestDeviceStateApplyConfigNumaAffinity(t *testing.T) {
+	state := newTestPrepareState(t, amdgputest.MI300XCPXNPS4)
+	results := []*resourceapi.DeviceRequestAllocationResult{
+		{Request: "gpu", Pool: "node", Device: "gpu-43d0a94e5d4cf437-xcp1"},
+		{Request: "gpu", Pool: "node", Device: "gpu-43d0a94e5d4cf437-xcp5"},
+	}
+
+	prepared, err := state.applyConfig("claim-uid", configapi.DefaultGpuConfig(), results)
+	require.NoError(t, err)
+	// The partitions are on the NUMA nodes of their memory partitions.
+	assert.Equal(t, []int{0}, prepared["gpu-43d0a94e5d4cf437-xcp1"].NumaNodes)
+	assert.Equal(t, "0-47,96-143", prepared["gpu-43d0a94e5d4cf437-xcp1"].LocalCPUs)
+	assert.Equal(t, []int{1}, prepared["gpu-43d0a94e5d4cf437-xcp5"].NumaNodes)
+	assert.Equal(t, "48-95,144-191", prepared["gpu-43d0a94e5d4cf437-xcp5"].LocalCPUs)
+}
+
+func TestCDIHandlerTopologyFile(t *testing.T) {
+	cdi, cdiRoot := newTestCDIHandler(t)
+	config := configapi.DefaultGpuConfig()
+	config.TopologyFile = true
+	devices := PreparedDevices{
+		{
+			Device:         drapbv1.Device{RequestNames: []string{"gpu"}, DeviceName: "gpu-43d0a94e5d4cf437-xcp5"},
+			ContainerEdits: &cdiapi.ContainerEdits{ContainerEdits: &cdispec.ContainerEdits{Env: []string{"FOO=bar"}}},
+			Config:         config,
+			VisibleDevices: []VisibleDevice{{Ordinal: 5}},
+			NumaNodes:      []int{1},
+			LocalCPUs:      "48-95,144-191",
+		},
+		{
+			Device:         drapbv1.Device{RequestNames: []string{"gpu"}, DeviceName: "gpu-9c1a3b4fe2d07a11-xcp0"},
+			ContainerEdits: &cdiapi.ContainerEdits{ContainerEdits: &cdispec.ContainerEdits{Env: []string{"FOO=bar"}}},
+			Config:         configapi.DefaultGpuConfig(),
+			VisibleDevices: []VisibleDevice{{Ordinal: 8}},
+			NumaNodes:      []int{0},
+			LocalCPUs:      "0-47,96-143",
+		},
+	}
+	require.NoError(t, cdi.CreateClaimSpecFile("claim-uid", devices))
+
+	matches, err := filepath.Glob(filepath.Join(cdiRoot, cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, "claim-uid")+".*"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	spec, err := cdiapi.ReadSpec(matches[0], 0)
+	require.NoError(t, err)
+	assert.Contains(t, spec.ContainerEdits.Env, "ROCR_VISIBLE_DEVICES=0,1")
+	assert.Contains(t, spec.ContainerEdits.Env, "AMD_GPU_NUMA_NODES=0,1")
+	assert.Contains(t, spec.ContainerEdits.Env, "AMD_GPU_LOCAL_CPUS=0-191")
+	assert.Contains(t, spec.ContainerEdits.Env, "AMD_GPU_TOPOLOGY_FILE="+topologyFileContainerPath)
+	require.Len(t, spec.ContainerEdits.Mounts, 1)
+	mount := spec.ContainerEdits.Mounts[0]
+	assert.Equal(t, topologyFileContainerPath, mount.ContainerPath)
+	assert.Contains(t, mount.Options, "ro")
+
+	// The file describes every device of the claim.
+	content, err := os.ReadFile(mount.HostPath)
+	require.NoError(t, err)
+	var file TopologyFile
+	require.NoError(t, json.Unmarshal(content, &file))
+	assert.Equal(t, TopologyFile{
+		NumaNodes: []int{0, 1},
+		LocalCPUs: "0-191",
+		Devices: []TopologyFileEntry{
+			{Name: "gpu-43d0a94e5d4cf437-xcp5", Requests: []string{"gpu"}, VisibleDevices: []string{"0"}, NumaNodes: []int{1}, LocalCPUs: "48-95,144-191"},
+			{Name: "gpu-9c1a3b4fe2d07a11-xcp0", Requests: []string{"gpu"}, VisibleDevices: []string{"1"}, NumaNodes: []int{0}, LocalCPUs: "0-47,96-143"},
+		},
+	}, file)
+
+	require.NoError(t, cdi.DeleteClaimSpecFile("claim-uid"))
+	assert.NoFileExists(t, mount.HostPath)
+
+	// Without the option no file is mounted.
+	require.NoError(t, cdi.CreateClaimSpecFile("claim-uid", devices[1:]))
+	spec, err = cdiapi.ReadSpec(matches[0], 0)
+	require.NoError(t, err)
+	assert.Empty(t, spec.ContainerEdits.Mounts)
+	assert.NotContains(t, spec.ContainerEdits.Env, "AMD_GPU_TOPOLOGY_FILE="+topologyFileContainerPath)
+}
@@ -0,0 +1,283 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	klog "k8s.io/klog/v2"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+)
+
+// Names of the counters shared by the devices of a partitionable GPU.
+const (
+	xccsCounter   = "xccs"
+	memoryCounter = "memory"
+)
+
+// partitionLayout is a combination of compute and memory partition modes that
+// a GPU supports, e.g. CPX/NPS4.
+type partitionLayout struct {
+	Modes            amdgpu.PartitionModes
+	Partitions       int // number of compute partitions
+	MemoryPartitions int // number of memory (NUMA) partitions
+}
+
+// name returns the layout as used in device and counter names, e.g. "cpx-nps4".
+func (l *partitionLayout) name() string {
+	return strings.ToLower(strings.ReplaceAll(l.Modes.String(), "/", "-"))
+}
+
+// profile returns the partitionProfile attribute of the devices of the
+// layout, e.g. "cpx_nps4".
+func (l *partitionLayout) profile() string {
+	return strings.ToLower(strings.ReplaceAll(l.Modes.String(), "/", "_"))
+}
+
+// matches reports whether a partitioning config, if any, asks for the modes
+// of the layout.
+func (l *partitionLayout) matches(config *configapi.PartitioningConfig) bool {
+	if config == nil {
+		return true
+	}
+	return (config.ComputeMode == "" || string(config.ComputeMode) == l.Modes.Compute) &&
+		(config.MemoryMode == "" || string(config.MemoryMode) == l.Modes.Memory)
+}
+
+// computePartitionCount returns the number of partitions a compute mode splits
+// a GPU with the given number of XCCs into, or 0 if it cannot.
+func computePartitionCount(mode string, xccs int) int {
+	var partitions int
+	switch strings.ToUpper(mode) {
+	case "SPX":
+		partitions = 1
+	case "DPX":
+		partitions = 2
+	case "TPX":
+		partitions = 3
+	case "QPX":
+		partitions = 4
+	case "CPX":
+		partitions = xccs
+	}
+	if partitions == 0 || xccs%partitions != 0 {
+		return 0
+	}
+	return partitions
+}
+
+// memoryPartitionCount returns the number of NUMA partitions a memory mode
+// (NPS<n>) splits VRAM into, or 0 if the mode is unknown. GPUs that do not
+// report a memory mode have a single memory partition.
+func memoryPartitionCount(mode string) int {
+	if mode == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(mode), "NPS"))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// gpuLayouts returns the partition layouts a GPU supports, ordered by their
+// number of compute and then memory partitions. A layout is only supported
+// if each compute partition fits in a single memory partition.
+func gpuLayouts(gpu *amdgpu.GPU) []*partitionLayout {
+	if gpu.XCCCount == 0 || len(gpu.AvailableComputePartitions) == 0 {
+		return nil
+	}
+	memoryModes := gpu.AvailableMemoryPartitions
+	if len(memoryModes) == 0 {
+		memoryModes = []string{gpu.MemoryPartition}
+	}
+
+	var layouts []*partitionLayout
+	for _, compute := range gpu.AvailableComputePartitions {
+		partitions := computePartitionCount(compute, gpu.XCCCount)
+		if partitions == 0 {
+			continue
+		}
+		for _, memory := range memoryModes {
+			memoryPartitions := memoryPartitionCount(memory)
+			if memoryPartitions == 0 || partitions%memoryPartitions != 0 {
+				continue
+			}
+			layouts = append(layouts, &partitionLayout{
+				Modes: amdgpu.PartitionModes{
+					Compute: strings.ToUpper(compute),
+					Memory:  strings.ToUpper(memory),
+				},
+				Partitions:       partitions,
+				MemoryPartitions: memoryPartitions,
+			})
+		}
+	}
+	slices.SortStableFunc(layouts, func(a, b *partitionLayout) int {
+		return cmp.Or(cmp.Compare(a.Partitions, b.Partitions), cmp.Compare(a.MemoryPartitions, b.MemoryPartitions))
+	})
+	return layouts
+}
+
+// addPartitionableDevices adds a device for every partition of every layout
+// the GPU supports to devices. It reports false, adding nothing, if the GPU
+// does not report its supported layouts or they exceed the limits of a
+// ResourceSlice.
+//
+// All devices of the GPU consume from a counter set named after the GPU:
+//   - "xccs" and "memory" hold the XCCs and VRAM of the GPU, of which each
+//     device consumes its share.
+//   - Partitions of different layouts must not be allocated together since a
+//     GPU is in a single layout at a time. Each partition of a layout with
+//     the most partitions, and each full GPU, is excluded by its XCC count.
+//     Every other partition has an exclusive counter of that maximum, which
+//     it consumes completely while partitions of all other layouts consume 1.
+func addPartitionableDevices(devices AllocatableDevices, gpu *amdgpu.GPU, info *AmdGpuInfo) bool {
+	layouts := gpuLayouts(gpu)
+	if len(layouts) == 0 {
+		return false
+	}
+	maxPartitions := layouts[len(layouts)-1].Partitions
+	base := slices.IndexFunc(layouts, func(l *partitionLayout) bool { return l.Partitions == maxPartitions })
+
+	exclusive := func(l *partitionLayout, index int) string {
+		return fmt.Sprintf("%s-xcp%d", l.name(), index)
+	}
+	hasExclusive := func(i int) bool {
+		return i != base && layouts[i].Partitions > 1
+	}
+
+	counterSet := &resourceapi.CounterSet{
+		Name: info.CanonicalName(),
+		Counters: map[string]resourceapi.Counter{
+			xccsCounter:   {Value: *resource.NewQuantity(int64(gpu.XCCCount), resource.DecimalSI)},
+			memoryCounter: {Value: *resource.NewQuantity(int64(info.MemoryBytes), resource.BinarySI)},
+		},
+	}
+	for i, l := range layouts {
+		if !hasExclusive(i) {
+			continue
+		}
+		for index := range l.Partitions {
+			counterSet.Counters[exclusive(l, index)] = resourceapi.Counter{
+				Value: *resource.NewQuantity(int64(maxPartitions), resource.DecimalSI),
+			}
+		}
+	}
+	info.CounterSet = counterSet
+
+	current := strings.ToUpper(gpu.ComputePartition) + "/" + strings.ToUpper(gpu.MemoryPartition)
+	layoutDevices := make(AllocatableDevices)
+	totalCounters := 0
+	for i, l := range layouts {
+		for index := range l.Partitions {
+			counters := map[string]resourceapi.Counter{
+				xccsCounter:   {Value: *resource.NewQuantity(int64(gpu.XCCCount/l.Partitions), resource.DecimalSI)},
+				memoryCounter: {Value: *resource.NewQuantity(int64(info.MemoryBytes)/int64(l.Partitions), resource.BinarySI)},
+			}
+			for j, other := range layouts {
+				switch {
+				case !hasExclusive(j) || l.Partitions == 1:
+				case j == i:
+					counters[exclusive(l, index)] = resourceapi.Counter{
+						Value: *resource.NewQuantity(int64(maxPartitions), resource.DecimalSI),
+					}
+				default:
+					for otherIndex := range other.Partitions {
+						counters[exclusive(other, otherIndex)] = resourceapi.Counter{
+							Value: *resource.NewQuantity(1, resource.DecimalSI),
+						}
+					}
+				}
+			}
+			if len(counters) > resourceapi.ResourceSliceMaxCountersPerDevice {
+				klog.Warningf("GPU %s has too many partition layouts to publish them as partitionable devices", gpu.PCIAddress)
+				return false
+			}
+			totalCounters += len(counters)
+			consumes := []resourceapi.DeviceCounterConsumption{{
+				CounterSet: counterSet.Name,
+				Counters:   counters,
+			}}
+
+			var device *AllocatableDevice
+			if l.Partitions == 1 {
+				full := *info
+				if l.Modes.String() != current {
+					full.Ordinal = -1
+				}
+				full.PartitionProfile = l.profile()
+				full.Layout = l
+				full.ConsumesCounters = consumes
+				device = &AllocatableDevice{AmdGpu: &full}
+			} else {
+				partition := &AmdPartitionInfo{
+					Parent:           info,
+					UUID:             fmt.Sprintf("%s-XCP%d", info.UUID, index),
+					Index:            index,
+					CardIndex:        -1,
+					RenderIndex:      -1,
+					Ordinal:          -1,
+					PartitionProfile: l.profile(),
+					MemoryBytes:      info.MemoryBytes / uint64(l.MemoryPartitions),
+					ComputeUnits:     info.ComputeUnits / l.Partitions,
+					SimdUnits:        info.SimdUnits / l.Partitions,
+					NumaNode:         info.NumaNode,
+					LocalCPUs:        info.LocalCPUs,
+					Layout:           l,
+					ConsumesCounters: consumes,
+				}
+				// Only the partitions of the current layout exist.
+				if l.Modes.String() == current {
+					for _, p := range gpu.Partitions {
+						if p.Index == index {
+							partition.CardIndex = p.CardIndex
+							partition.RenderIndex = p.RenderIndex
+							partition.KFDGPUID = p.KFDGPUID
+							partition.Ordinal = p.Ordinal
+							partition.NumaNode = p.NumaNode
+							partition.LocalCPUs = p.LocalCPUs
+						}
+					}
+				}
+				device = &AllocatableDevice{AmdPartition: partition}
+			}
+			layoutDevices[device.CanonicalName()] = device
+		}
+	}
+
+	if len(counterSet.Counters) > resourceapi.ResourceSliceMaxSharedCounters ||
+		len(layoutDevices) > resourceapi.ResourceSliceMaxDevices ||
+		totalCounters > resourceapi.ResourceSliceMaxDeviceCountersPerSlice {
+		klog.Warningf("GPU %s has too many partition layouts to publish them as partitionable devices", gpu.PCIAddress)
+		info.CounterSet = nil
+		return false
+	}
+
+	for name, device := range layoutDevices {
+		devices[name] = device
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+// newPartitionableTestDeviceState returns a DeviceState like
+// newTestDeviceState that publishes partitionable devices.
+func newPartitionableTestDeviceState(t *testing.T, hostRoot string) *DeviceState {
+	state := newTestDeviceState(t, hostRoot)
+	allocatable, err := enumerateAllPossibleDevices(hostRoot, true, false)
+	require.NoError(t, err)
+	state.allocatable = allocatable
+	state.partitionable = true
+	return state
+}
+
+func quantityValue(q resource.Quantity) int64 {
+	return q.Value()
+}
+
+func TestEnumeratePartitionableDevices(t *testing.T) {
+	tests := map[string]struct {
+		fixture  string
+		expected map[string]int // device name -> card index
+		count    int
+	}{
+		"MI300X SPX NPS1": {
+			fixture: amdgputest.MI300XSPXNPS1,
+			expected: map[string]int{
+				"gpu-43d0a94e5d4cf437":               1,
+				"gpu-43d0a94e5d4cf437-dpx-nps1-xcp1": -1,
+				"gpu-43d0a94e5d4cf437-qpx-nps4-xcp3": -1,
+				"gpu-43d0a94e5d4cf437-cpx-nps1-xcp0": -1,
+				"gpu-43d0a94e5d4cf437-cpx-nps4-xcp7": -1,
+			},
+			// SPX/NPS1, DPX/NPS1, QPX/NPS1, QPX/NPS4, CPX/NPS1 and CPX/NPS4
+			// on each of the two GPUs.
+			count: 2 * (1 + 2 + 4 + 4 + 8 + 8),
+		},
+		"MI300X CPX NPS4": {
+			fixture: amdgputest.MI300XCPXNPS4,
+			expected: map[string]int{
+				"gpu-43d0a94e5d4cf437-cpx-nps1-xcp0": -1,
+				"gpu-43d0a94e5d4cf437-cpx-nps4-xcp0": 1,
+				"gpu-43d0a94e5d4cf437-cpx-nps4-xcp7": 8,
+			},
+			count: 2 * (1 + 2 + 4 + 4 + 8 + 8),
+		},
+		"Radeon without partition support": {
+			fixture: amdgputest.Radeon,
+			expected: map[string]int{
+				"gpu-0000-2d-00-0": 0,
+			},
+			count: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, test.fixture), true, false)
+			require.NoError(t, err)
+			assert.Len(t, devices, test.count)
+
+			for name, cardIndex := range test.expected {
+				require.Contains(t, devices, name)
+				card, _ := devices[name].DRMNodes()
+				assert.Equal(t, cardIndex, card, name)
+			}
+		})
+	}
+}
+
+func TestPartitionableDeviceCapacity(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1), true, false)
+	require.NoError(t, err)
+
+	device := devices["gpu-43d0a94e5d4cf437-cpx-nps4-xcp2"].GetDevice()
+	assert.Equal(t, "cpx_nps4", *device.Attributes["partitionProfile"].StringValue)
+	assert.Equal(t, int64(48<<30), quantityValue(device.Capacity["memory"].Value))
+	assert.Equal(t, int64(38), quantityValue(device.Capacity["computeUnits"].Value))
+	require.Len(t, device.ConsumesCounters, 1)
+	assert.Equal(t, "gpu-43d0a94e5d4cf437", device.ConsumesCounters[0].CounterSet)
+	assert.Equal(t, int64(1), quantityValue(device.ConsumesCounters[0].Counters[xccsCounter].Value))
+	assert.Equal(t, int64(24<<30), quantityValue(device.ConsumesCounters[0].Counters[memoryCounter].Value))
+}
+
+// TestPartitionableDeviceCounters checks that two devices of a GPU can be
+// allocated together exactly when they are distinct partitions of the same
+// layout, and that all devices of a layout can be allocated together.
+func TestPartitionableDeviceCounters(t *testing.T) {
+	devices, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1), true, false)
+	require.NoError(t, err)
+
+	var gpu []*AllocatableDevice
+	for _, name := range slices.Sorted(maps.Keys(devices)) {
+		if devices[name].PCIAddress() == "0000:03:00.0" {
+			gpu = append(gpu, devices[name])
+		}
+	}
+	counterSet := gpu[0].CounterSet()
+	require.NotNil(t, counterSet)
+	assert.LessOrEqual(t, len(counterSet.Counters), resourceapi.ResourceSliceMaxSharedCounters)
+
+	fits := func(devices ...*AllocatableDevice) bool {
+		consumed := make(map[string]int64)
+		for _, device := range devices {
+			for _, consumption := range device.GetDevice().ConsumesCounters {
+				for name, counter := range consumption.Counters {
+					consumed[name] += counter.Value.Value()
+				}
+			}
+		}
+		for name, value := range consumed {
+			if value > quantityValue(counterSet.Counters[name].Value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	layouts := make(map[*partitionLayout][]*AllocatableDevice)
+	for _, device := range gpu {
+		assert.LessOrEqual(t, len(device.GetDevice().ConsumesCounters[0].Counters), resourceapi.ResourceSliceMaxCountersPerDevice)
+		layouts[device.PartitionLayout()] = append(layouts[device.PartitionLayout()], device)
+	}
+	for layout, devices := range layouts {
+		assert.True(t, fits(devices...), layout.name())
+	}
+
+	for _, a := range gpu {
+		for _, b := range gpu {
+			if a == b {
+				continue
+			}
+			sameLayout := a.PartitionLayout() == b.PartitionLayout()
+			assert.Equal(t, sameLayout, fits(a, b), "%s and %s", a.CanonicalName(), b.CanonicalName())
+		}
+	}
+}
+
+func TestDeviceStatePublishedSlices(t *testing.T) {
+	state := newPartitionableTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	published := state.PublishedSlices()
+	require.Len(t, published, 2)
+	for i, name := range []string{"gpu-43d0a94e5d4cf437", "gpu-9c1a3b4fe2d07a11"} {
+		require.Len(t, published[i].SharedCounters, 1)
+		assert.Equal(t, name, published[i].SharedCounters[0].Name)
+		assert.Len(t, published[i].Devices, 27)
+		for _, device := range published[i].Devices {
+			assert.Equal(t, name, device.ConsumesCounters[0].CounterSet)
+		}
+	}
+
+	// GPUs without partitioning support are published without counters.
+	state = newPartitionableTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.Radeon))
+	published = state.PublishedSlices()
+	require.Len(t, published, 1)
+	assert.Empty(t, published[0].SharedCounters)
+	assert.Len(t, published[0].Devices, 1)
+
+	// Without partitionable devices all devices share a single slice.
+	state = newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	published = state.PublishedSlices()
+	require.Len(t, published, 1)
+	assert.Len(t, published[0].Devices, 2)
+}
+
+func TestDeviceStatePrepareInactiveLayout(t *testing.T) {
+	state := newPartitionableTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	device := "gpu-43d0a94e5d4cf437-cpx-nps1-xcp3"
+	results := []*resourceapi.DeviceRequestAllocationResult{{Request: "gpu", Device: device}}
+
+	_, err := state.gpuPartitionModes(&configapi.PartitioningConfig{ComputeMode: "SPX"}, results)
+	assert.EqualError(t, err, "device gpu-43d0a94e5d4cf437-cpx-nps1-xcp3 of partition layout CPX/NPS1 conflicts with the requested partitioning")
+
+	gpuModes, err := state.gpuPartitionModes(nil, results)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]amdgpu.PartitionModes{"0000:03:00.0": {Compute: "CPX", Memory: "NPS1"}}, gpuModes)
+
+	previous, err := state.applyPartitioning("claim-uid", gpuModes, []string{device})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]amdgpu.PartitionModes{"0000:03:00.0": {Compute: "SPX", Memory: "NPS1"}}, previous)
+	modes, err := amdgpu.GetPartitionModes("0000:03:00.0", state.hostRoot)
+	require.NoError(t, err)
+	assert.Equal(t, amdgpu.PartitionModes{Compute: "CPX", Memory: "NPS1"}, modes)
+
+	// The device keeps its name across repartitioning and stays published.
+	assert.Contains(t, state.allocatable, device)
+	assert.False(t, state.withheld(device))
+}
@@ -0,0 +1,124 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	resourceapi "k8s.io/api/resource/v1"
+	klog "k8s.io/klog/v2"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+)
+
+// gpuPartitionModes returns the partition modes each GPU of a set of
+// allocation results must be in: those of the layout of a partitionable
+// device, or else those requested by the partitioning config, if any.
+func (s *DeviceState) gpuPartitionModes(config *configapi.PartitioningConfig, results []*resourceapi.DeviceRequestAllocationResult) (map[string]amdgpu.PartitionModes, error) {
+	gpuModes := make(map[string]amdgpu.PartitionModes)
+	for _, result := range results {
+		device := s.allocatable[result.Device]
+		pciAddr := device.PCIAddress()
+
+		var modes amdgpu.PartitionModes
+		switch layout := device.PartitionLayout(); {
+		case layout != nil:
+			if !layout.matches(config) {
+				return nil, fmt.Errorf("device %s of partition layout %s conflicts with the requested partitioning", result.Device, layout.Modes)
+			}
+			modes = layout.Modes
+		case config != nil:
+			modes = amdgpu.PartitionModes{
+				Compute: string(config.ComputeMode),
+				Memory:  string(config.MemoryMode),
+			}
+		default:
+			continue
+		}
+
+		if other, exists := gpuModes[pciAddr]; exists && other != modes {
+			return nil, fmt.Errorf("devices of GPU %s are allocated in partition layouts %s and %s", pciAddr, other, modes)
+		}
+		gpuModes[pciAddr] = modes
+	}
+	return gpuModes, nil
+}
+
+// applyPartitioning switches GPUs, keyed by PCI address, to the given
+// partition modes and rediscovers the devices. It returns the previous modes
+// of the GPUs it repartitioned. A GPU is only repartitioned if no other
+// prepared claim uses it or any of its partitions, since repartitioning
+// replaces all of them. The preparing devices of the claim that are replaced
+// are retained, and the rest of their GPU withheld, until the claim is
+// unprepared. Must be called with the state locked.
+func (s *DeviceState) applyPartitioning(claimUID string, gpuModes map[string]amdgpu.PartitionModes, preparing []string) (map[string]amdgpu.PartitionModes, error) {
+	previous := make(map[string]amdgpu.PartitionModes)
+	for _, pciAddr := range slices.Sorted(maps.Keys(gpuModes)) {
+		modes := gpuModes[pciAddr]
+		current, err := amdgpu.GetPartitionModes(pciAddr, s.hostRoot)
+		if err != nil {
+			return nil, fmt.Errorf("unable to partition GPU %s: %w", pciAddr, err)
+		}
+		if (modes.Compute == "" || modes.Compute == current.Compute) &&
+			(modes.Memory == "" || modes.Memory == current.Memory) {
+			continue
+		}
+
+		if other := s.claimUsingGPU(s.checkpoint, claimUID, pciAddr); other != "" {
+			return nil, fmt.Errorf("unable to partition GPU %s from %s to %s: it is in use by claim %s",
+				pciAddr, current, modes, other)
+		}
+
+		if err := s.recordChange(claimUID, DeviceSettings{PCIAddress: pciAddr, PartitionModes: &current}); err != nil {
+			return nil, err
+		}
+		klog.Infof("Repartitioning GPU %s from %s to %s for claim %s", pciAddr, current, modes, claimUID)
+		if err := amdgpu.SetPartitionModes(pciAddr, modes, s.hostRoot); err != nil {
+			return nil, fmt.Errorf("unable to partition GPU %s: %w", pciAddr, err)
+		}
+		previous[pciAddr] = current
+	}
+	if len(previous) == 0 {
+		return previous, nil
+	}
+
+	allocatable, err := enumerateAllPossibleDevices(s.hostRoot, s.partitionable, s.hiveDevices)
+	if err != nil {
+		return nil, fmt.Errorf("error enumerating all possible devices: %v", err)
+	}
+	s.updateAllocatable(allocatable, preparing...)
+	return previous, nil
+}
+
+// claimUsingGPU returns the UID of a prepared claim other than claimUID that
+// uses the GPU at pciAddr or one of its partitions, or "" if there is none.
+func (s *DeviceState) claimUsingGPU(checkpoint *Checkpoint, claimUID, pciAddr string) string {
+	for _, uid := range slices.Sorted(maps.Keys(checkpoint.V2.PreparedClaims)) {
+		if uid == claimUID {
+			continue
+		}
+		for _, device := range checkpoint.V2.PreparedClaims[uid].PreparedDevices {
+			if d, exists := s.allocatable[device.DeviceName]; exists && slices.Contains(d.GPUs(), pciAddr) {
+				return uid
+			}
+		}
+	}
+	return ""
+}
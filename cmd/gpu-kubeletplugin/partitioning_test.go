@@ -0,0 +1,149 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	drahealthv1alpha1 "k8s.io/kubelet/pkg/apis/dra-health/v1alpha1"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestDeviceStateApplyPartitioning(t *testing.T) {
+	tests := map[string]struct {
+		fixture     string
+		device      string
+		pciAddr     string
+		preparedBy  map[string]string
+		config      configapi.PartitioningConfig
+		expected    amdgpu.PartitionModes
+		expectedErr string
+	}{
+		"free GPU": {
+			fixture:  amdgputest.MI300XSPXNPS1,
+			device:   "gpu-43d0a94e5d4cf437",
+			pciAddr:  "0000:03:00.0",
+			config:   configapi.PartitioningConfig{ComputeMode: "CPX", MemoryMode: "NPS4"},
+			expected: amdgpu.PartitionModes{Compute: "CPX", Memory: "NPS4"},
+		},
+		"other GPU in use": {
+			fixture:    amdgputest.MI300XSPXNPS1,
+			device:     "gpu-43d0a94e5d4cf437",
+			pciAddr:    "0000:03:00.0",
+			preparedBy: map[string]string{"other-claim": "gpu-9c1a3b4fe2d07a11"},
+			config:     configapi.PartitioningConfig{ComputeMode: "DPX"},
+			expected:   amdgpu.PartitionModes{Compute: "DPX", Memory: "NPS1"},
+		},
+		"GPU in use": {
+			fixture:     amdgputest.MI300XSPXNPS1,
+			device:      "gpu-43d0a94e5d4cf437",
+			pciAddr:     "0000:03:00.0",
+			preparedBy:  map[string]string{"other-claim": "gpu-43d0a94e5d4cf437"},
+			config:      configapi.PartitioningConfig{ComputeMode: "CPX"},
+			expected:    amdgpu.PartitionModes{Compute: "SPX", Memory: "NPS1"},
+			expectedErr: "unable to partition GPU 0000:03:00.0 from SPX/NPS1 to CPX: it is in use by claim other-claim",
+		},
+		"partition of the GPU in use": {
+			fixture:     amdgputest.MI300XCPXNPS1,
+			device:      "gpu-43d0a94e5d4cf437-xcp0",
+			pciAddr:     "0000:03:00.0",
+			preparedBy:  map[string]string{"other-claim": "gpu-43d0a94e5d4cf437-xcp5"},
+			config:      configapi.PartitioningConfig{ComputeMode: "SPX"},
+			expected:    amdgpu.PartitionModes{Compute: "CPX", Memory: "NPS1"},
+			expectedErr: "unable to partition GPU 0000:03:00.0 from CPX/NPS1 to SPX: it is in use by claim other-claim",
+		},
+		"already in the requested modes": {
+			fixture:    amdgputest.MI300XCPXNPS1,
+			device:     "gpu-43d0a94e5d4cf437-xcp0",
+			pciAddr:    "0000:03:00.0",
+			preparedBy: map[string]string{"other-claim": "gpu-43d0a94e5d4cf437-xcp5"},
+			config:     configapi.PartitioningConfig{ComputeMode: "CPX", MemoryMode: "NPS1"},
+			expected:   amdgpu.PartitionModes{Compute: "CPX", Memory: "NPS1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			state := newTestDeviceState(t, amdgputest.HostRoot(t, test.fixture))
+
+			checkpoint := newCheckpoint()
+			for uid, device := range test.preparedBy {
+				checkpoint.V2.PreparedClaims[uid] = preparedClaim(PreparedDevices{
+					{Device: drapbv1.Device{DeviceName: device}},
+				})
+			}
+			state.checkpoint = checkpoint
+
+			gpuModes, err := state.gpuPartitionModes(&test.config, []*resourceapi.DeviceRequestAllocationResult{
+				{Request: "gpu", Device: test.device},
+			})
+			require.NoError(t, err)
+
+			_, err = state.applyPartitioning("claim-uid", gpuModes, []string{test.device})
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			modes, err := amdgpu.GetPartitionModes(test.pciAddr, state.hostRoot)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, modes)
+		})
+	}
+}
+
+func TestDeviceStateApplyPartitioningUnsupported(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.Radeon))
+	_, err := state.applyPartitioning("claim-uid", map[string]amdgpu.PartitionModes{
+		"0000:2d:00.0": {Compute: "CPX"},
+	}, []string{"gpu-0000-2d-00-0"})
+	assert.ErrorContains(t, err, "unable to partition GPU 0000:2d:00.0")
+}
+
+func TestDeviceStateRepartitionedGPUWithheld(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+
+	// A claim being prepared repartitions the first GPU from SPX to CPX.
+	allocatable, err := enumerateAllPossibleDevices(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1), false, false)
+	require.NoError(t, err)
+	assert.True(t, state.updateAllocatable(allocatable, "gpu-43d0a94e5d4cf437"))
+
+	// The claim still owns the whole GPU, so its new partitions are withheld
+	// and back the device of the claim.
+	published := publishedDeviceNames(state)
+	assert.Len(t, published, 8)
+	assert.NotContains(t, published, "gpu-43d0a94e5d4cf437-xcp0")
+	assert.True(t, state.withheld("gpu-43d0a94e5d4cf437-xcp0"))
+
+	backing := state.backingDevices("gpu-43d0a94e5d4cf437", "0000:03:00.0")
+	require.Len(t, backing, 8)
+	assert.Equal(t, "gpu-43d0a94e5d4cf437-xcp0", backing[0].CanonicalName())
+	assert.Equal(t, drahealthv1alpha1.HealthStatus_HEALTHY, state.DeviceHealth()["gpu-43d0a94e5d4cf437"])
+
+	// Unpreparing the claim releases the partitions.
+	state.pruneRetained(newCheckpoint())
+	assert.Len(t, publishedDeviceNames(state), 16)
+	assert.NotContains(t, state.allocatable, "gpu-43d0a94e5d4cf437")
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	klog "k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+)
+
+// powerSettings returns the power settings of a GPU requested by a
+// performance config.
+func powerSettings(config *configapi.PerformanceConfig) amdgpu.PowerSettings {
+	settings := amdgpu.PowerSettings{
+		PerformanceLevel: string(config.PerformanceLevel),
+		PowerProfile:     config.PowerProfile,
+	}
+	if config.PowerCap != nil {
+		settings.PowerCap = ptr.To(int64(*config.PowerCap) * 1000000)
+	}
+	return settings
+}
+
+// powerSettingsApplied returns whether the current settings of a GPU already
+// are the requested ones, and the current values of the requested settings,
+// which are restored when the claim is unprepared.
+func powerSettingsApplied(current, requested amdgpu.PowerSettings) (bool, amdgpu.PowerSettings) {
+	applied := true
+	var previous amdgpu.PowerSettings
+	if requested.PowerCap != nil {
+		previous.PowerCap = current.PowerCap
+		applied = applied && current.PowerCap != nil && *current.PowerCap == *requested.PowerCap
+	}
+	if requested.PerformanceLevel != "" {
+		previous.PerformanceLevel = current.PerformanceLevel
+		applied = applied && current.PerformanceLevel == requested.PerformanceLevel
+	}
+	if requested.PowerProfile != "" {
+		previous.PowerProfile = current.PowerProfile
+		applied = applied && current.PowerProfile == requested.PowerProfile
+	}
+	return applied, previous
+}
+
+// applyPerformance applies the performance config of a claim to its GPUs,
+// given by PCI address. It returns the settings to restore on each GPU when
+// the claim is unprepared. All GPUs are checked before any of them is
+// changed, and a GPU is only changed if no other prepared claim uses it,
+// since the settings apply to the whole GPU. A GPU that already has the
+// requested settings takes over the settings to restore from the claims that
+// changed them, so that the last claim using it restores them. Must be called
+// with the state locked.
+func (s *DeviceState) applyPerformance(claimUID string, config *configapi.PerformanceConfig, pciAddrs []string, checkpoint *Checkpoint) (map[string]amdgpu.PowerSettings, error) {
+	if config == nil {
+		return nil, nil
+	}
+	requested := powerSettings(config)
+
+	restore := make(map[string]amdgpu.PowerSettings)
+	var changing []string
+	for _, pciAddr := range pciAddrs {
+		if err := amdgpu.CheckPowerSettings(pciAddr, requested, s.hostRoot); err != nil {
+			return nil, fmt.Errorf("unable to apply performance settings to GPU %s: %w", pciAddr, err)
+		}
+		current, err := amdgpu.GetPowerSettings(pciAddr, s.hostRoot)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply performance settings to GPU %s: %w", pciAddr, err)
+		}
+
+		applied, previous := powerSettingsApplied(current, requested)
+		if applied {
+			if settings := s.powerSettingsToRestore(checkpoint, claimUID, pciAddr); settings != nil {
+				restore[pciAddr] = *settings
+			}
+			continue
+		}
+		if other := s.claimUsingGPU(checkpoint, claimUID, pciAddr); other != "" {
+			return nil, fmt.Errorf("unable to change GPU %s to %s: it is in use by claim %s", pciAddr, requested, other)
+		}
+		restore[pciAddr] = previous
+		changing = append(changing, pciAddr)
+	}
+
+	for _, pciAddr := range changing {
+		previous := restore[pciAddr]
+		if err := s.recordChange(claimUID, DeviceSettings{PCIAddress: pciAddr, Power: &previous}); err != nil {
+			return nil, err
+		}
+		klog.Infof("Changing GPU %s from %s to %s for claim %s", pciAddr, restore[pciAddr], requested, claimUID)
+		if err := amdgpu.SetPowerSettings(pciAddr, requested, s.hostRoot); err != nil {
+			return nil, fmt.Errorf("unable to apply performance settings to GPU %s: %w", pciAddr, err)
+		}
+	}
+	return restore, nil
+}
+
+// powerSettingsToRestore returns the power settings a prepared claim other
+// than claimUID restores on the GPU at pciAddr, or nil if there is none.
+func (s *DeviceState) powerSettingsToRestore(checkpoint *Checkpoint, claimUID, pciAddr string) *amdgpu.PowerSettings {
+	for _, uid := range slices.Sorted(maps.Keys(checkpoint.V2.PreparedClaims)) {
+		if uid == claimUID {
+			continue
+		}
+		for _, device := range checkpoint.V2.PreparedClaims[uid].PreparedDevices {
+			if settings := device.Restore; settings != nil && settings.Power != nil && settings.PCIAddress == pciAddr {
+				return settings.Power
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestDeviceStateApplyPerformance(t *testing.T) {
+	original := amdgpu.PowerSettings{
+		PowerCap:         ptr.To[int64](750000000),
+		PerformanceLevel: "auto",
+		PowerProfile:     "BOOTUP_DEFAULT",
+	}
+	changed := amdgpu.PowerSettings{
+		PowerCap:         ptr.To[int64](500000000),
+		PerformanceLevel: "high",
+		PowerProfile:     "BOOTUP_DEFAULT",
+	}
+
+	tests := map[string]struct {
+		preparedBy      map[string]*PreparedDevice
+		current         *amdgpu.PowerSettings
+		config          configapi.PerformanceConfig
+		expected        amdgpu.PowerSettings
+		expectedRestore map[string]amdgpu.PowerSettings
+		expectedErr     string
+	}{
+		"free GPU": {
+			config:   configapi.PerformanceConfig{PowerCap: ptr.To(500), PerformanceLevel: "high"},
+			expected: changed,
+			expectedRestore: map[string]amdgpu.PowerSettings{
+				"0000:03:00.0": {PowerCap: ptr.To[int64](750000000), PerformanceLevel: "auto"},
+			},
+		},
+		"other GPU in use": {
+			preparedBy: map[string]*PreparedDevice{
+				"other-claim": {Device: drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"}},
+			},
+			config:   configapi.PerformanceConfig{PowerCap: ptr.To(500), PerformanceLevel: "high"},
+			expected: changed,
+			expectedRestore: map[string]amdgpu.PowerSettings{
+				"0000:03:00.0": {PowerCap: ptr.To[int64](750000000), PerformanceLevel: "auto"},
+			},
+		},
+		"GPU in use": {
+			preparedBy: map[string]*PreparedDevice{
+				"other-claim": {Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}},
+			},
+			config:      configapi.PerformanceConfig{PowerCap: ptr.To(500), PerformanceLevel: "high"},
+			expected:    original,
+			expectedErr: "unable to change GPU 0000:03:00.0 to power cap 500W, performance level high: it is in use by claim other-claim",
+		},
+		"GPU in use with the requested settings": {
+			preparedBy: map[string]*PreparedDevice{
+				"other-claim": {
+					Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"},
+					Restore: &DeviceSettings{
+						PCIAddress: "0000:03:00.0",
+						Power:      &amdgpu.PowerSettings{PowerCap: ptr.To[int64](750000000), PerformanceLevel: "auto"},
+					},
+				},
+			},
+			current:  &amdgpu.PowerSettings{PowerCap: ptr.To[int64](500000000), PerformanceLevel: "high"},
+			config:   configapi.PerformanceConfig{PowerCap: ptr.To(500), PerformanceLevel: "high"},
+			expected: changed,
+			expectedRestore: map[string]amdgpu.PowerSettings{
+				"0000:03:00.0": {PowerCap: ptr.To[int64](750000000), PerformanceLevel: "auto"},
+			},
+		},
+		"power cap out of range": {
+			config:      configapi.PerformanceConfig{PowerCap: ptr.To(1000), PerformanceLevel: "high"},
+			expected:    original,
+			expectedErr: "unable to apply performance settings to GPU 0000:03:00.0: power cap 1000W is not supported by 0000:03:00.0, valid range: 200W-750W",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+			if test.current != nil {
+				require.NoError(t, amdgpu.SetPowerSettings("0000:03:00.0", *test.current, state.hostRoot))
+			}
+
+			checkpoint := newCheckpoint()
+			for uid, device := range test.preparedBy {
+				checkpoint.V2.PreparedClaims[uid] = preparedClaim(PreparedDevices{device})
+			}
+
+			restore, err := state.applyPerformance("claim-uid", &test.config, []string{"0000:03:00.0"}, checkpoint)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expectedRestore, restore)
+			}
+
+			settings, err := amdgpu.GetPowerSettings("0000:03:00.0", state.hostRoot)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+func TestDeviceStateRestorePerformance(t *testing.T) {
+	restore := &DeviceSettings{
+		PCIAddress: "0000:03:00.0",
+		Power:      &amdgpu.PowerSettings{PowerCap: ptr.To[int64](750000000), PerformanceLevel: "auto"},
+	}
+	changed := amdgpu.PowerSettings{
+		PowerCap:         ptr.To[int64](500000000),
+		PerformanceLevel: "high",
+		PowerProfile:     "BOOTUP_DEFAULT",
+	}
+
+	tests := map[string]struct {
+		preparedBy map[string]string
+		expected   amdgpu.PowerSettings
+	}{
+		"GPU free": {
+			expected: amdgpu.PowerSettings{
+				PowerCap:         ptr.To[int64](750000000),
+				PerformanceLevel: "auto",
+				PowerProfile:     "BOOTUP_DEFAULT",
+			},
+		},
+		"GPU in use": {
+			preparedBy: map[string]string{"other-claim": "gpu-43d0a94e5d4cf437"},
+			expected:   changed,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+			require.NoError(t, amdgpu.SetPowerSettings("0000:03:00.0", amdgpu.PowerSettings{
+				PowerCap:         ptr.To[int64](500000000),
+				PerformanceLevel: "high",
+			}, state.hostRoot))
+
+			checkpoint := newCheckpoint()
+			for uid, device := range test.preparedBy {
+				checkpoint.V2.PreparedClaims[uid] = preparedClaim(PreparedDevices{
+					{Device: drapbv1.Device{DeviceName: device}},
+				})
+			}
+
+			devices := PreparedDevices{
+				{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}, Restore: restore},
+			}
+			require.NoError(t, state.restoreSettings("claim-uid", devices, checkpoint))
+
+			settings, err := amdgpu.GetPowerSettings("0000:03:00.0", state.hostRoot)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
+)
+
+// claimReconciler periodically reconciles the prepared claims with the
+// ResourceClaims of the API server.
+type claimReconciler struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startClaimReconciler calls reconcile every interval until stopped. Unlike
+// the RAS monitor, it does not call it right away, since the driver already
+// reconciles the claims at startup.
+func startClaimReconciler(ctx context.Context, interval time.Duration, reconcile func(ctx context.Context)) *claimReconciler {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &claimReconciler{cancel: cancel}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reconcile(ctx)
+			}
+		}
+	}()
+	return r
+}
+
+func (r *claimReconciler) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// reconcileClaims unprepares the claims that were deleted, deallocated or
+// released while kubelet could not unprepare them, e.g. while the plugin was
+// down, and deletes the CDI spec files of claims that are not prepared. Claims
+// are left alone if the ResourceClaims cannot be listed.
+func (d *driver) reconcileClaims(ctx context.Context) {
+	listed := time.Now()
+	claims, err := d.client.ResourceV1().ResourceClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Unable to list ResourceClaims, skipping claim reconciliation: %v", err)
+		return
+	}
+
+	changed, err := d.state.Reconcile(liveClaims(claims.Items, d.nodeName), listed)
+	if err != nil {
+		klog.Errorf("Failed to reconcile claims: %v", err)
+	}
+	if changed {
+		// Devices withheld for the claims may be available again.
+		d.republish(ctx)
+	}
+}
+
+// liveClaims returns the UIDs of the claims that are allocated devices of the
+// driver on the node and are still reserved for a consumer.
+func liveClaims(claims []resourceapi.ResourceClaim, nodeName string) sets.Set[string] {
+	live := sets.New[string]()
+	for _, claim := range claims {
+		if claim.Status.Allocation == nil || len(claim.Status.ReservedFor) == 0 {
+			continue
+		}
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			if result.Driver == consts.DriverName && result.Pool == nodeName {
+				live.Insert(string(claim.UID))
+				break
+			}
+		}
+	}
+	return live
+}
+
+// Reconcile unprepares the claims in the checkpoint that are not live, given
+// the live claims listed at the given time, and deletes the CDI spec files of
+// claims that are not in the checkpoint. Claims that started to prepare after
+// the listing are kept, since the listing may predate them; claims migrated
+// from a V1 checkpoint have no PrepareStarted and are always checked. It
+// returns whether any claim was unprepared.
+func (s *DeviceState) Reconcile(live sets.Set[string], listed time.Time) (bool, error) {
+	s.Lock()
+	var stale []string
+	for _, uid := range slices.Sorted(maps.Keys(s.checkpoint.V2.PreparedClaims)) {
+		claim := s.checkpoint.V2.PreparedClaims[uid]
+		if live.Has(uid) || claim.PrepareStarted.After(listed) {
+			continue
+		}
+		klog.Infof("Unpreparing claim %s/%s (%s), which no longer exists or is no longer reserved", claim.Namespace, claim.Name, uid)
+		stale = append(stale, uid)
+	}
+	s.Unlock()
+
+	var changed bool
+	var errs []error
+	for _, uid := range stale {
+		if err := s.Unprepare(uid); err != nil {
+			errs = append(errs, fmt.Errorf("unable to unprepare claim %s: %w", uid, err))
+			continue
+		}
+		changed = true
+	}
+
+	// Claims are recorded in the checkpoint before their CDI spec is written.
+	s.Lock()
+	defer s.Unlock()
+	specs, err := s.cdi.ListClaimSpecFiles()
+	if err != nil {
+		return changed, errors.Join(append(errs, err)...)
+	}
+	for _, uid := range specs {
+		if _, exists := s.checkpoint.V2.PreparedClaims[uid]; exists {
+			continue
+		}
+		klog.Infof("Deleting CDI spec file of claim %s, which is not prepared", uid)
+		if err := s.cdi.DeleteClaimSpecFile(uid); err != nil {
+			errs = append(errs, fmt.Errorf("unable to delete CDI spec file for claim %s: %w", uid, err))
+		}
+	}
+
+	return changed, errors.Join(errs...)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
+)
+
+func TestLiveClaims(t *testing.T) {
+	claim := func(uid, driver, pool string, reserved bool) resourceapi.ResourceClaim {
+		c := resourceapi.ResourceClaim{}
+		c.UID = types.UID(uid)
+		if driver != "" {
+			c.Status.Allocation = &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{{Driver: driver, Pool: pool}},
+				},
+			}
+		}
+		if reserved {
+			c.Status.ReservedFor = []resourceapi.ResourceClaimConsumerReference{{Resource: "pods", Name: "pod"}}
+		}
+		return c
+	}
+
+	claims := []resourceapi.ResourceClaim{
+		claim("live", consts.DriverName, "node", true),
+		claim("unreserved", consts.DriverName, "node", false),
+		claim("unallocated", "", "", true),
+		claim("other-node", consts.DriverName, "other", true),
+		claim("other-driver", "gpu.example.com", "node", true),
+	}
+	assert.Equal(t, sets.New("live"), liveClaims(claims, "node"))
+}
+
+func TestDeviceStateReconcile(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	cdi, cdiRoot := newTestCDIHandler(t)
+	state.cdi = cdi
+	require.NoError(t, cdi.CreateCommonSpecFile())
+
+	listed := time.Now()
+	checkpoint := newCheckpoint()
+	for _, uid := range []string{"live", "stale"} {
+		checkpoint.V2.PreparedClaims[uid] = preparedClaim(PreparedDevices{
+			{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}},
+		})
+	}
+	// Started to prepare after the claims were listed.
+	checkpoint.V2.PreparedClaims["new"] = &PreparedClaim{
+		CheckpointState: ClaimCheckpointStatePrepareStarted,
+		PrepareStarted:  listed.Add(time.Second),
+	}
+	state.checkpoint = checkpoint
+	require.NoError(t, state.saveCheckpoint())
+	for _, uid := range []string{"live", "stale", "new", "orphan"} {
+		require.NoError(t, cdi.CreateClaimSpecFile(uid, PreparedDevices{{
+			Device:         drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"},
+			ContainerEdits: &cdiapi.ContainerEdits{ContainerEdits: &cdispec.ContainerEdits{Env: []string{"FOO=bar"}}},
+		}}))
+	}
+
+	changed, err := state.Reconcile(sets.New("live"), listed)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	checkpoint = &Checkpoint{}
+	require.NoError(t, state.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint))
+	assert.Equal(t, []string{"live", "new"}, slices.Sorted(maps.Keys(checkpoint.V2.PreparedClaims)))
+	specs, err := cdi.ListClaimSpecFiles()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"live", "new"}, specs)
+	common, err := filepath.Glob(filepath.Join(cdiRoot, cdiapi.GenerateTransientSpecName(cdiVendor, cdiClass, cdiCommonDeviceName)+".*"))
+	require.NoError(t, err)
+	assert.Len(t, common, 1)
+
+	changed, err = state.Reconcile(sets.New("live"), listed)
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestCDIHandlerListClaimSpecFiles(t *testing.T) {
+	cdi, cdiRoot := newTestCDIHandler(t)
+	require.NoError(t, cdi.CreateCommonSpecFile())
+	require.NoError(t, os.WriteFile(filepath.Join(cdiRoot, "other.vendor-gpu_claim-uid.json"), nil, 0600))
+
+	specs, err := cdi.ListClaimSpecFiles()
+	require.NoError(t, err)
+	assert.Empty(t, specs)
+}
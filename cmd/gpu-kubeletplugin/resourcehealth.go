@@ -0,0 +1,160 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+	drahealthv1alpha1 "k8s.io/kubelet/pkg/apis/dra-health/v1alpha1"
+)
+
+// healthResendInterval is how often the complete device health is streamed
+// to kubelet even if nothing changed, so that kubelet does not time out
+// devices and mark them as unknown.
+const healthResendInterval = 15 * time.Second
+
+// DeviceHealth returns the health of every device in the inventory. Devices
+// whose GPU disappeared while they are retained for their prepared claims and
+// devices of GPUs that exceeded a RAS threshold are unhealthy. Devices of GPUs
+// whose RAS counters could not be read are unknown. Retained devices of GPUs
+// that were repartitioned are healthy. A hive is as healthy as its least
+// healthy GPU.
+func (s *DeviceState) DeviceHealth() map[string]drahealthv1alpha1.HealthStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	discovered := sets.New[string]()
+	for name, device := range s.allocatable {
+		if !s.retained.Has(name) && device.Type() != AmdHiveDeviceType {
+			discovered.Insert(device.PCIAddress())
+		}
+	}
+
+	health := make(map[string]drahealthv1alpha1.HealthStatus, len(s.allocatable))
+	for name, device := range s.allocatable {
+		health[name] = drahealthv1alpha1.HealthStatus_HEALTHY
+		for _, pciAddr := range device.GPUs() {
+			switch {
+			case s.retained.Has(name) && !discovered.Has(pciAddr):
+				health[name] = drahealthv1alpha1.HealthStatus_UNHEALTHY
+			case s.rasTaints[pciAddr] != nil:
+				health[name] = drahealthv1alpha1.HealthStatus_UNHEALTHY
+			case s.rasUnknown.Has(pciAddr) && health[name] != drahealthv1alpha1.HealthStatus_UNHEALTHY:
+				health[name] = drahealthv1alpha1.HealthStatus_UNKNOWN
+			}
+		}
+	}
+	return health
+}
+
+// healthWatchers fans out device health changes to the NodeWatchResources
+// streams opened by kubelet.
+type healthWatchers struct {
+	sync.Mutex
+	watchers map[chan struct{}]struct{}
+}
+
+// watch registers a new watcher. The returned function unregisters it.
+func (h *healthWatchers) watch() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.Lock()
+	defer h.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[chan struct{}]struct{})
+	}
+	h.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		h.Lock()
+		defer h.Unlock()
+		delete(h.watchers, ch)
+	}
+}
+
+// notify tells all watchers that the device health may have changed.
+func (h *healthWatchers) notify() {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NodeWatchResources implements [drahealthv1alpha1.DRAResourceHealthServer].
+// It sends the health of all devices when called, whenever it may have
+// changed, and periodically until kubelet closes the stream.
+func (d *driver) NodeWatchResources(_ *drahealthv1alpha1.NodeWatchResourcesRequest, stream grpc.ServerStreamingServer[drahealthv1alpha1.NodeWatchResourcesResponse]) error {
+	ctx := stream.Context()
+	klog.Info("NodeWatchResources is called, streaming device health")
+
+	changed, stop := d.healthWatchers.watch()
+	defer stop()
+
+	ticker := time.NewTicker(healthResendInterval)
+	defer ticker.Stop()
+
+	var previous map[string]drahealthv1alpha1.HealthStatus
+	for {
+		health := d.state.DeviceHealth()
+		for name, status := range health {
+			if previous != nil && previous[name] != status {
+				klog.Infof("Device %s health changed from %s to %s", name, previous[name], status)
+			}
+		}
+		previous = health
+
+		if err := stream.Send(d.healthResponse(health)); err != nil {
+			klog.Errorf("Failed to send device health: %v", err)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			klog.Info("NodeWatchResources stream closed")
+			return nil
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthResponse builds the complete list of device health sent to kubelet.
+func (d *driver) healthResponse(health map[string]drahealthv1alpha1.HealthStatus) *drahealthv1alpha1.NodeWatchResourcesResponse {
+	now := time.Now().Unix()
+	response := &drahealthv1alpha1.NodeWatchResourcesResponse{}
+	for _, name := range slices.Sorted(maps.Keys(health)) {
+		response.Devices = append(response.Devices, &drahealthv1alpha1.DeviceHealth{
+			Device: &drahealthv1alpha1.DeviceIdentifier{
+				PoolName:   d.nodeName,
+				DeviceName: name,
+			},
+			Health:          health[name],
+			LastUpdatedTime: now,
+		})
+	}
+	return response
+}
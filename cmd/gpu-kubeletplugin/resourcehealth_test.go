@@ -0,0 +1,134 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	drahealthv1alpha1 "k8s.io/kubelet/pkg/apis/dra-health/v1alpha1"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+// fakeHealthStream records the responses sent on a NodeWatchResources stream.
+type fakeHealthStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *drahealthv1alpha1.NodeWatchResourcesResponse
+}
+
+func (f *fakeHealthStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeHealthStream) Send(response *drahealthv1alpha1.NodeWatchResourcesResponse) error {
+	f.responses <- response
+	return nil
+}
+
+func healthByDevice(t *testing.T, response *drahealthv1alpha1.NodeWatchResourcesResponse) map[string]drahealthv1alpha1.HealthStatus {
+	health := make(map[string]drahealthv1alpha1.HealthStatus)
+	for _, device := range response.Devices {
+		assert.Equal(t, "node", device.Device.PoolName)
+		assert.NotZero(t, device.LastUpdatedTime)
+		health[device.Device.DeviceName] = device.Health
+	}
+	return health
+}
+
+func TestDeviceStateDeviceHealth(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XRAS))
+	state.UpdateHealth()
+
+	assert.Equal(t, map[string]drahealthv1alpha1.HealthStatus{
+		"gpu-43d0a94e5d4cf437": drahealthv1alpha1.HealthStatus_UNHEALTHY,
+		"gpu-9c1a3b4fe2d07a11": drahealthv1alpha1.HealthStatus_HEALTHY,
+	}, state.DeviceHealth())
+
+	// A GPU that fell off the bus while in use is unhealthy, one whose RAS
+	// counters cannot be read is unknown.
+	checkpoint := newCheckpoint()
+	checkpoint.V2.PreparedClaims["claim-uid"] = preparedClaim(PreparedDevices{
+		{Device: drapbv1.Device{DeviceName: "gpu-9c1a3b4fe2d07a11"}},
+	})
+	state.checkpoint = checkpoint
+	state.hostRoot = t.TempDir()
+	_, err := state.Rediscover()
+	require.NoError(t, err)
+	state.rasUnknown.Insert("0000:23:00.0")
+	assert.Equal(t, map[string]drahealthv1alpha1.HealthStatus{
+		"gpu-9c1a3b4fe2d07a11": drahealthv1alpha1.HealthStatus_UNHEALTHY,
+	}, state.DeviceHealth())
+
+	state.retained.Delete("gpu-9c1a3b4fe2d07a11")
+	assert.Equal(t, drahealthv1alpha1.HealthStatus_UNKNOWN, state.DeviceHealth()["gpu-9c1a3b4fe2d07a11"])
+}
+
+func TestNodeWatchResources(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+	d := &driver{
+		state:    newTestDeviceState(t, root),
+		nodeName: "node",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeHealthStream{
+		ctx:       ctx,
+		responses: make(chan *drahealthv1alpha1.NodeWatchResourcesResponse, 10),
+	}
+	done := make(chan error)
+	go func() {
+		done <- d.NodeWatchResources(&drahealthv1alpha1.NodeWatchResourcesRequest{}, stream)
+	}()
+
+	// The complete device health is sent right away.
+	health := healthByDevice(t, <-stream.responses)
+	require.Len(t, health, 16)
+	for name, status := range health {
+		assert.Equal(t, drahealthv1alpha1.HealthStatus_HEALTHY, status, name)
+	}
+
+	// An uncorrectable error marks all partitions of the GPU unhealthy.
+	umc := filepath.Join(root, "sys/bus/pci/devices/0000:03:00.0/ras/umc_err_count")
+	require.NoError(t, os.WriteFile(umc, []byte("ue: 1\nce: 0\n"), 0644))
+	require.True(t, d.state.UpdateHealth())
+	d.healthWatchers.notify()
+
+	select {
+	case response := <-stream.responses:
+		health = healthByDevice(t, response)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no health update after a RAS error")
+	}
+	require.Len(t, health, 16)
+	for i := range 8 {
+		assert.Equal(t, drahealthv1alpha1.HealthStatus_UNHEALTHY, health[fmt.Sprintf("gpu-43d0a94e5d4cf437-xcp%d", i)])
+		assert.Equal(t, drahealthv1alpha1.HealthStatus_HEALTHY, health[fmt.Sprintf("gpu-9c1a3b4fe2d07a11-xcp%d", i)])
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
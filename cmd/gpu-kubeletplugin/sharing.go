@@ -0,0 +1,144 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/sets"
+	klog "k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+)
+
+// replicasCapacity is the capacity of a shared device that limits the number
+// of allocations of the device.
+const replicasCapacity resourceapi.QualifiedName = "replicas"
+
+// shareDevice makes a published device allocatable to several claims. Every
+// allocation consumes one of its replicas and, unless it requests otherwise,
+// none of its other capacities, which would be consumed in full by default.
+// Claims can request a share of its memory and compute units, which the
+// scheduler keeps from exceeding the capacity of the device.
+func shareDevice(device *resourceapi.Device, replicas int) {
+	device.AllowMultipleAllocations = ptr.To(true)
+	for name, capacity := range device.Capacity {
+		capacity.RequestPolicy = capacityRequestPolicy(device, name)
+		device.Capacity[name] = capacity
+	}
+	device.Capacity[replicasCapacity] = resourceapi.DeviceCapacity{
+		Value: *resource.NewQuantity(int64(replicas), resource.DecimalSI),
+		RequestPolicy: &resourceapi.CapacityRequestPolicy{
+			Default: resource.NewQuantity(1, resource.DecimalSI),
+			ValidRange: &resourceapi.CapacityRequestPolicyRange{
+				Min: resource.NewQuantity(1, resource.DecimalSI),
+				Max: resource.NewQuantity(int64(replicas), resource.DecimalSI),
+			},
+		},
+	}
+}
+
+// sharers returns the devices prepared for claims other than claimUID with
+// the given name, keyed by claim UID.
+func sharers(checkpoint *Checkpoint, claimUID, name string) map[string]*PreparedDevice {
+	devices := make(map[string]*PreparedDevice)
+	for uid, claim := range checkpoint.V2.PreparedClaims {
+		if uid == claimUID {
+			continue
+		}
+		for _, device := range claim.PreparedDevices {
+			if device.DeviceName == name {
+				devices[uid] = device
+			}
+		}
+	}
+	return devices
+}
+
+// checkSharing returns an error if a device is already prepared for another
+// claim that does not share it with the same strategy. Devices prepared
+// before sharing was recorded are not shared.
+func checkSharing(checkpoint *Checkpoint, claimUID string, sharing *configapi.GpuSharing, name string) error {
+	others := sharers(checkpoint, claimUID, name)
+	for _, uid := range slices.Sorted(maps.Keys(others)) {
+		switch other := others[uid].Sharing; {
+		case other == "" || sharing == nil:
+			return fmt.Errorf("device %s is in use by claim %s", name, uid)
+		case other != sharing.Strategy:
+			return fmt.Errorf("device %s is in use by claim %s which shares it with strategy %s, not %s", name, uid, other, sharing.Strategy)
+		}
+	}
+	return nil
+}
+
+// allocateComputeUnits picks the compute units of a device for a claim that
+// space partitions it: an equal share of the CUs of the device that no other
+// claim has. The lowest free CUs are picked.
+func allocateComputeUnits(checkpoint *Checkpoint, claimUID string, config *configapi.SpacePartitioningConfig, name string, device *AllocatableDevice) ([]int, error) {
+	cus, simds := device.ComputeUnits()
+	if cus == 0 {
+		return nil, fmt.Errorf("device %s reports no compute units to partition", name)
+	}
+	size := cus / config.PartitionCount
+	if size == 0 {
+		return nil, fmt.Errorf("device %s has %d compute units, too few for %d partitions", name, cus, config.PartitionCount)
+	}
+
+	used := sets.New[int]()
+	for _, other := range sharers(checkpoint, claimUID, name) {
+		used.Insert(other.ComputeUnits...)
+	}
+	var allocated []int
+	for cu := 0; cu < cus && len(allocated) < size; cu++ {
+		if !used.Has(cu) {
+			allocated = append(allocated, cu)
+		}
+	}
+	if len(allocated) < size {
+		return nil, fmt.Errorf("device %s has %d free compute units, %d requested", name, cus-used.Len(), size)
+	}
+
+	klog.Infof("Allocated compute units %s (%d SIMDs) of device %s to claim %s",
+		formatComputeUnits(allocated), size*simds/cus, name, claimUID)
+	return allocated, nil
+}
+
+// formatComputeUnits formats a sorted list of compute units as comma
+// separated ranges, e.g. "0-18,38-56", as accepted by HSA_CU_MASK.
+func formatComputeUnits(cus []int) string {
+	var ranges []string
+	for i := 0; i < len(cus); {
+		j := i
+		for j+1 < len(cus) && cus[j+1] == cus[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(cus[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", cus[i], cus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
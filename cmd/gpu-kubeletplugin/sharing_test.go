@@ -0,0 +1,185 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestCheckSharing(t *testing.T) {
+	spacePartitioning := &configapi.GpuSharing{
+		Strategy:                configapi.SpacePartitioningStrategy,
+		SpacePartitioningConfig: &configapi.SpacePartitioningConfig{PartitionCount: 2},
+	}
+
+	tests := map[string]struct {
+		other       *PreparedDevice
+		sharing     *configapi.GpuSharing
+		expectedErr string
+	}{
+		"device not prepared for another claim": {
+			sharing: nil,
+		},
+		"device prepared before sharing was recorded": {
+			other:       &PreparedDevice{},
+			sharing:     spacePartitioning,
+			expectedErr: "device gpu-9c1a3b4fe2d07a11 is in use by claim other-uid",
+		},
+		"device shared with another strategy": {
+			other:       &PreparedDevice{Sharing: configapi.TimeSlicingStrategy},
+			sharing:     spacePartitioning,
+			expectedErr: "device gpu-9c1a3b4fe2d07a11 is in use by claim other-uid which shares it with strategy TimeSlicing, not SpacePartitioning",
+		},
+		"device time-sliced by both claims": {
+			other:   &PreparedDevice{Sharing: configapi.TimeSlicingStrategy},
+			sharing: &configapi.GpuSharing{Strategy: configapi.TimeSlicingStrategy},
+		},
+		"device shared by another claim": {
+			other:       &PreparedDevice{Sharing: configapi.SpacePartitioningStrategy},
+			sharing:     nil,
+			expectedErr: "device gpu-9c1a3b4fe2d07a11 is in use by claim other-uid",
+		},
+		"device space partitioned by both claims": {
+			other:   &PreparedDevice{Sharing: configapi.SpacePartitioningStrategy},
+			sharing: spacePartitioning,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			checkpoint := newCheckpoint()
+			if test.other != nil {
+				test.other.DeviceName = "gpu-9c1a3b4fe2d07a11"
+				checkpoint.V2.PreparedClaims["other-uid"] = preparedClaim(PreparedDevices{test.other})
+			}
+			err := checkSharing(checkpoint, "claim-uid", test.sharing, "gpu-9c1a3b4fe2d07a11")
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAllocateComputeUnits(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	name := "gpu-9c1a3b4fe2d07a11-xcp2"
+	device := state.allocatable[name]
+	cus, _ := device.ComputeUnits()
+	require.Equal(t, 38, cus)
+
+	checkpoint := newCheckpoint()
+	allocate := func(claimUID string, partitionCount int) ([]int, error) {
+		config := &configapi.SpacePartitioningConfig{PartitionCount: partitionCount}
+		allocated, err := allocateComputeUnits(checkpoint, claimUID, config, name, device)
+		if err == nil {
+			checkpoint.V2.PreparedClaims[claimUID] = preparedClaim(PreparedDevices{{
+				Device:       drapbv1.Device{DeviceName: name},
+				Sharing:      configapi.SpacePartitioningStrategy,
+				ComputeUnits: allocated,
+			}})
+		}
+		return allocated, err
+	}
+
+	first, err := allocate("claim-1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "0-18", formatComputeUnits(first))
+
+	second, err := allocate("claim-2", 4)
+	require.NoError(t, err)
+	assert.Equal(t, "19-27", formatComputeUnits(second))
+
+	_, err = allocate("claim-3", 2)
+	assert.EqualError(t, err, "device gpu-9c1a3b4fe2d07a11-xcp2 has 10 free compute units, 19 requested")
+
+	_, err = allocate("claim-3", 64)
+	assert.EqualError(t, err, "device gpu-9c1a3b4fe2d07a11-xcp2 has 38 compute units, too few for 64 partitions")
+
+	// The CUs of an unprepared claim are free again.
+	delete(checkpoint.V2.PreparedClaims, "claim-1")
+	third, err := allocate("claim-3", 4)
+	require.NoError(t, err)
+	assert.Equal(t, "0-8", formatComputeUnits(third))
+}
+
+func TestFormatComputeUnits(t *testing.T) {
+	tests := map[string]struct {
+		cus      []int
+		expected string
+	}{
+		"no compute units": {
+			cus:      nil,
+			expected: "",
+		},
+		"single compute unit": {
+			cus:      []int{7},
+			expected: "7",
+		},
+		"ranges and single compute units": {
+			cus:      []int{0, 1, 2, 5, 9, 10},
+			expected: "0-2,5,9-10",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, formatComputeUnits(test.cus))
+		})
+	}
+}
+
+func TestDeviceStatePublishedDevicesSharing(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	for _, device := range state.PublishedDevices() {
+		assert.Nil(t, device.AllowMultipleAllocations, device.Name)
+	}
+
+	state.deviceSharing = true
+	state.sharingReplicas = 4
+	for _, device := range state.PublishedDevices() {
+		assert.Equal(t, ptr.To(true), device.AllowMultipleAllocations, device.Name)
+
+		// Allocations consume a replica and nothing else by default.
+		replicas := device.Capacity[replicasCapacity]
+		assert.Equal(t, int64(4), replicas.Value.Value())
+		assert.Equal(t, int64(1), replicas.RequestPolicy.Default.Value())
+		assert.Equal(t, int64(4), replicas.RequestPolicy.ValidRange.Max.Value())
+		memory := device.Capacity["memory"]
+		assert.Equal(t, int64(192<<30), memory.Value.Value())
+		assert.True(t, memory.RequestPolicy.Default.IsZero())
+
+		// Or a share of its memory and compute units, up to all of them.
+		assert.Equal(t, int64(1<<30), memory.RequestPolicy.ValidRange.Step.Value())
+		assert.Equal(t, int64(192<<30), memory.RequestPolicy.ValidRange.Max.Value())
+		computeUnits := device.Capacity["computeUnits"]
+		assert.Equal(t, int64(1), computeUnits.RequestPolicy.ValidRange.Step.Value())
+		assert.Equal(t, int64(304), computeUnits.RequestPolicy.ValidRange.Max.Value())
+		simdUnits := device.Capacity["simdUnits"]
+		assert.Equal(t, int64(4), simdUnits.RequestPolicy.ValidRange.Step.Value())
+		assert.Equal(t, int64(1216), simdUnits.RequestPolicy.ValidRange.Max.Value())
+	}
+}
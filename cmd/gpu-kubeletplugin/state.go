@@ -34,16 +34,25 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu"
 	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 	"golang.org/x/sys/unix"
 	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
 	klog "k8s.io/klog/v2"
 	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
 	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager"
@@ -53,8 +62,8 @@ import (
 )
 
 type PreparedDevices []*PreparedDevice
-type PreparedClaims map[string]PreparedDevices
-type PerDeviceCDIContainerEdits map[string]*cdiapi.ContainerEdits
+type PreparedClaims map[string]*PreparedClaim
+type PerDevicePreparedDevices map[string]*PreparedDevice
 
 type OpaqueDeviceConfig struct {
 	Requests []string
@@ -64,6 +73,40 @@ type OpaqueDeviceConfig struct {
 type PreparedDevice struct {
 	drapbv1.Device
 	ContainerEdits *cdiapi.ContainerEdits
+	Restore        *DeviceSettings `json:",omitempty"`
+	// Config is the normalized config applied to the device.
+	Config *configapi.GpuConfig `json:",omitempty"`
+	// VisibleDevices are the GPUs and partitions backing the device, as
+	// listed in the ROCR_VISIBLE_DEVICES of the claim.
+	VisibleDevices []VisibleDevice `json:",omitempty"`
+	// Sharing is the strategy with which the claim shares the device with
+	// other claims, and ShareID identifies its allocation of the device if
+	// the device is allocated to several claims.
+	Sharing configapi.GpuSharingStrategy `json:",omitempty"`
+	ShareID string                       `json:",omitempty"`
+	// ComputeUnits are the compute units of the device the claim is limited
+	// to with HSA_CU_MASK when it space partitions the device.
+	ComputeUnits []int `json:",omitempty"`
+	// ConsumedCapacity is the capacity of the device the allocation of the
+	// claim consumed when the device is shared.
+	ConsumedCapacity map[resourceapi.QualifiedName]resource.Quantity `json:",omitempty"`
+	// NumaNodes are the NUMA nodes of the devices backing the device and
+	// LocalCPUs the CPUs local to them, as listed in AMD_GPU_NUMA_NODES and
+	// AMD_GPU_LOCAL_CPUS of the claim.
+	NumaNodes []int  `json:",omitempty"`
+	LocalCPUs string `json:",omitempty"`
+}
+
+// DeviceSettings are settings of the GPU of a device that were changed while
+// preparing it and are restored when it is unprepared.
+type DeviceSettings struct {
+	PCIAddress string
+	// PartitionModes the GPU was in before the claim repartitioned it. Only
+	// set if the claim got the whole GPU.
+	PartitionModes *amdgpu.PartitionModes `json:",omitempty"`
+	// Power settings the GPU had before the performance config of the claim
+	// was applied.
+	Power *amdgpu.PowerSettings `json:",omitempty"`
 }
 
 func (pds PreparedDevices) GetDevices() []*drapbv1.Device {
@@ -74,15 +117,71 @@ func (pds PreparedDevices) GetDevices() []*drapbv1.Device {
 	return devices
 }
 
+// DeviceState holds the devices of the node and the claims prepared on them.
+// Its mutex guards the in-memory state, the device inventory and the
+// checkpoint, and is only held briefly. Preparing and unpreparing claims is
+// serialized per GPU by gpuLocks instead, which are taken before the mutex.
 type DeviceState struct {
 	sync.Mutex
+	hostRoot          string
+	partitionable     bool
+	hiveDevices       bool
+	deviceSharing     bool
+	sharingReplicas   int
 	cdi               *CDIHandler
 	allocatable       AllocatableDevices
 	checkpointManager checkpointmanager.CheckpointManager
+	gpuLocks          gpuLocks
+
+	// gpus is the number of GPUs last discovered. It is read by the
+	// healthcheck without locking the state.
+	gpus atomic.Int32
+
+	// checkpoint is the checkpoint of the plugin. Changes to it are written
+	// before the GPU settings they record are changed, and otherwise once
+	// per batch of claims prepared.
+	checkpoint *Checkpoint
+
+	// Unprepare waits up to kfdProcessTimeout for processes still using the
+	// GPUs of a claim to exit, then kills them if killKFDProcesses is set.
+	kfdProcessTimeout time.Duration
+	killKFDProcesses  bool
+
+	// retained holds the names of devices that are no longer discovered but
+	// are kept in allocatable because they still have prepared claims. They
+	// are not published.
+	retained sets.Set[string]
+
+	// rasTaints maps the PCI address of a GPU whose RAS counters exceeded a
+	// threshold to the taint published on it and all of its partitions.
+	rasThresholds  rasThresholds
+	rasTaintEffect resourceapi.DeviceTaintEffect
+	rasTaints      map[string]*resourceapi.DeviceTaint
+	// rasUnknown holds the PCI addresses of GPUs whose RAS counters could
+	// not be read.
+	rasUnknown sets.Set[string]
 }
 
 func NewDeviceState(config *Config) (*DeviceState, error) {
-	allocatable, err := enumerateAllPossibleDevices()
+	rasThresholds, err := parseRASThresholds(config.flags.rasThresholds)
+	if err != nil {
+		return nil, err
+	}
+	rasTaintEffect, err := parseTaintEffect(config.flags.rasTaintEffect)
+	if err != nil {
+		return nil, err
+	}
+	if config.flags.deviceSharing && config.flags.sharingReplicas < 1 {
+		return nil, fmt.Errorf("invalid number of sharing replicas: %d", config.flags.sharingReplicas)
+	}
+	// Hive devices would exceed the counters of a ResourceSlice with
+	// partitionable devices, and every allocation of a shared device would
+	// consume its counters.
+	if config.flags.hiveDevices && (config.flags.partitionableDevices || config.flags.deviceSharing) {
+		return nil, fmt.Errorf("hive devices cannot be combined with partitionable devices or device sharing")
+	}
+
+	allocatable, err := enumerateAllPossibleDevices(config.flags.hostRoot, config.flags.partitionableDevices, config.flags.hiveDevices)
 	if err != nil {
 		return nil, fmt.Errorf("error enumerating all possible devices: %v", err)
 	}
@@ -103,10 +202,23 @@ func NewDeviceState(config *Config) (*DeviceState, error) {
 	}
 
 	state := &DeviceState{
+		hostRoot:          config.flags.hostRoot,
+		partitionable:     config.flags.partitionableDevices,
+		hiveDevices:       config.flags.hiveDevices,
+		deviceSharing:     config.flags.deviceSharing,
+		sharingReplicas:   config.flags.sharingReplicas,
 		cdi:               cdi,
 		allocatable:       allocatable,
 		checkpointManager: checkpointManager,
+		kfdProcessTimeout: config.flags.kfdProcessTimeout,
+		killKFDProcesses:  config.flags.killKFDProcesses,
+		retained:          sets.New[string](),
+		rasThresholds:     rasThresholds,
+		rasTaintEffect:    rasTaintEffect,
+		rasTaints:         make(map[string]*resourceapi.DeviceTaint),
+		rasUnknown:        sets.New[string](),
 	}
+	state.gpus.Store(int32(countGPUs(allocatable, state.retained)))
 
 	checkpoints, err := state.checkpointManager.ListCheckpoints()
 	if err != nil {
@@ -115,85 +227,528 @@ func NewDeviceState(config *Config) (*DeviceState, error) {
 
 	for _, c := range checkpoints {
 		if c == DriverPluginCheckpointFile {
+			if err := state.recoverCheckpoint(); err != nil {
+				return nil, err
+			}
 			return state, nil
 		}
 	}
 
-	checkpoint := newCheckpoint()
-	if err := state.checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
-		return nil, fmt.Errorf("unable to sync to checkpoint: %v", err)
+	state.checkpoint = newCheckpoint()
+	if err := state.saveCheckpoint(); err != nil {
+		return nil, err
 	}
 
 	return state, nil
 }
 
-func (s *DeviceState) Prepare(claim *resourceapi.ResourceClaim) ([]*drapbv1.Device, error) {
+// recoverCheckpoint migrates the checkpoint to the latest version and
+// finishes what an earlier instance of the plugin left half done: claims
+// whose prepare did not complete are rolled back, and claims whose unprepare
+// did not complete are unprepared again. A claim that cannot be recovered is
+// left in the checkpoint for kubelet to retry.
+func (s *DeviceState) recoverCheckpoint() error {
+	s.Lock()
+	if err := s.loadCheckpoint(); err != nil {
+		s.Unlock()
+		return err
+	}
+	err := s.saveCheckpoint()
+	claims := maps.Clone(s.checkpoint.V2.PreparedClaims)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range slices.Sorted(maps.Keys(claims)) {
+		switch claims[uid].CheckpointState {
+		case ClaimCheckpointStatePrepareStarted:
+			klog.Infof("Rolling back claim %s, which did not complete preparing", uid)
+		case ClaimCheckpointStateUnprepareStarted:
+			klog.Infof("Unpreparing claim %s, which did not complete unpreparing", uid)
+		default:
+			continue
+		}
+		// Unprepare rolls back claims that did not complete preparing.
+		if err := s.Unprepare(uid); err != nil {
+			klog.Errorf("Unable to recover claim %s: %v", uid, err)
+		}
+	}
+	return nil
+}
+
+// PublishedDevices returns the devices to publish in the ResourceSlices of
+// the node, ordered by name.
+func (s *DeviceState) PublishedDevices() []resourceapi.Device {
 	s.Lock()
 	defer s.Unlock()
+	return s.publishedDevices()
+}
 
-	claimUID := string(claim.UID)
+func (s *DeviceState) publishedDevices() []resourceapi.Device {
+	devices := make([]resourceapi.Device, 0, len(s.allocatable))
+	for _, name := range slices.Sorted(maps.Keys(s.allocatable)) {
+		if s.withheld(name) {
+			continue
+		}
+		device := s.allocatable[name].GetDevice()
+		for _, pciAddr := range s.allocatable[name].GPUs() {
+			if taint, exists := s.rasTaints[pciAddr]; exists {
+				device.Taints = []resourceapi.DeviceTaint{*taint}
+				break
+			}
+		}
+		if s.deviceSharing {
+			shareDevice(&device, s.sharingReplicas)
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// PublishedSlices returns the ResourceSlices to publish for the node. All
+// devices share a single slice unless partitionable devices are enabled, in
+// which case each GPU gets a slice of its own holding its counter set, since
+// devices can only consume counters defined in their own slice. Likewise each
+// hive gets a slice with the devices of its GPUs when hive devices are
+// enabled, and all other devices share one.
+func (s *DeviceState) PublishedSlices() []resourceslice.Slice {
+	s.Lock()
+	defer s.Unlock()
+	return s.publishedSlices()
+}
 
-	checkpoint := newCheckpoint()
-	if err := s.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
-		return nil, fmt.Errorf("unable to sync from checkpoint: %v", err)
+func (s *DeviceState) publishedSlices() []resourceslice.Slice {
+	devices := s.publishedDevices()
+	if !s.partitionable && !s.hiveDevices {
+		return []resourceslice.Slice{{Devices: devices}}
 	}
-	preparedClaims := checkpoint.V1.PreparedClaims
 
-	if preparedClaims[claimUID] != nil {
-		return preparedClaims[claimUID].GetDevices(), nil
+	groups := make(map[string]*resourceslice.Slice)
+	for _, device := range devices {
+		allocatable := s.allocatable[device.Name]
+		counterSet := allocatable.CounterSet()
+		key := allocatable.PCIAddress()
+		if s.hiveDevices {
+			key = ""
+			if counterSet != nil {
+				key = counterSet.Name
+			}
+		}
+		slice, exists := groups[key]
+		if !exists {
+			slice = &resourceslice.Slice{}
+			if counterSet != nil {
+				slice.SharedCounters = []resourceapi.CounterSet{*counterSet}
+			}
+			groups[key] = slice
+		}
+		slice.Devices = append(slice.Devices, device)
+	}
+	if len(groups) == 0 {
+		return []resourceslice.Slice{{}}
 	}
 
-	preparedDevices, err := s.prepareDevices(claim)
+	published := make([]resourceslice.Slice, 0, len(groups))
+	for _, key := range slices.Sorted(maps.Keys(groups)) {
+		published = append(published, *groups[key])
+	}
+	return published
+}
+
+// withheld reports whether a device must neither be published nor prepared:
+// it is retained, or it shares a GPU with a retained device. The latter
+// happens when a claim repartitioned the GPU and still uses all of it.
+func (s *DeviceState) withheld(name string) bool {
+	if s.retained.Has(name) {
+		return true
+	}
+	gpus := s.allocatable[name].GPUs()
+	for retained := range s.retained {
+		if slices.ContainsFunc(s.allocatable[retained].GPUs(), func(pciAddr string) bool {
+			return slices.Contains(gpus, pciAddr)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rediscover enumerates the devices on the node again and replaces the
+// allocatable inventory. Devices that disappeared but still have prepared
+// claims are retained, unpublished, until their claims are unprepared so that
+// those claims can still be torn down. It reports whether the published
+// devices changed.
+func (s *DeviceState) Rediscover() (bool, error) {
+	allocatable, err := enumerateAllPossibleDevices(s.hostRoot, s.partitionable, s.hiveDevices)
 	if err != nil {
-		return nil, fmt.Errorf("prepare failed: %v", err)
+		return false, fmt.Errorf("error enumerating all possible devices: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.updateAllocatable(allocatable), nil
+}
+
+// updateAllocatable replaces the allocatable inventory with newly discovered
+// devices, retaining those that disappeared but are prepared, either in the
+// checkpoint or in the additional list of devices being prepared. It reports
+// whether the published devices changed.
+func (s *DeviceState) updateAllocatable(allocatable AllocatableDevices, preparing ...string) bool {
+	prepared := sets.New(preparing...)
+	for _, claim := range s.checkpoint.V2.PreparedClaims {
+		for _, device := range claim.PreparedDevices {
+			prepared.Insert(device.DeviceName)
+		}
 	}
 
-	if err = s.cdi.CreateClaimSpecFile(claimUID, preparedDevices); err != nil {
-		return nil, fmt.Errorf("unable to create CDI spec file for claim: %v", err)
+	retained := sets.New[string]()
+	for name, device := range s.allocatable {
+		if _, exists := allocatable[name]; exists || !prepared.Has(name) {
+			continue
+		}
+		klog.Warningf("Device %s disappeared but has prepared claims, withholding it until they are unprepared", name)
+		allocatable[name] = device
+		retained.Insert(name)
 	}
 
-	preparedClaims[claimUID] = preparedDevices
-	if err := s.checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
-		return nil, fmt.Errorf("unable to sync to checkpoint: %v", err)
+	previous := s.publishedSlices()
+	s.allocatable = allocatable
+	s.retained = retained
+	s.gpus.Store(int32(countGPUs(allocatable, retained)))
+
+	return !equality.Semantic.DeepEqual(previous, s.publishedSlices())
+}
+
+// pruneRetained drops retained devices that no prepared claim of the
+// checkpoint refers to anymore.
+func (s *DeviceState) pruneRetained(checkpoint *Checkpoint) {
+	prepared := sets.New[string]()
+	for _, claim := range checkpoint.V2.PreparedClaims {
+		for _, device := range claim.PreparedDevices {
+			prepared.Insert(device.DeviceName)
+		}
+	}
+	for name := range s.retained {
+		if !prepared.Has(name) {
+			klog.Infof("Dropping device %s which is no longer discovered nor prepared", name)
+			delete(s.allocatable, name)
+			s.retained.Delete(name)
+		}
 	}
+}
+
+// maxParallelPrepares limits the claims of a batch that are prepared at the
+// same time.
+const maxParallelPrepares = 16
 
-	return preparedClaims[claimUID].GetDevices(), nil
+// PrepareResult is the outcome of preparing a claim: its prepared devices, or
+// the error that kept it from being prepared.
+type PrepareResult struct {
+	Devices []*drapbv1.Device
+	Err     error
 }
 
-func (s *DeviceState) Unprepare(claimUID string) error {
+// Prepare prepares a batch of claims, keyed by claim UID in the result, in
+// two phases: the claims are recorded as PrepareStarted before any device is
+// touched, and as PrepareCompleted with their prepared devices once their CDI
+// specs are written. Claims are prepared in parallel, serialized only by the
+// GPUs they share, and the checkpoint is written once to start and once to
+// commit the batch, besides the GPU settings changed in between. A prepare
+// that fails, or that an earlier instance of the plugin did not complete, is
+// rolled back before the claim is prepared again. It also reports whether the
+// published devices changed, which happens when a claim repartitions a GPU.
+func (s *DeviceState) Prepare(claims []*resourceapi.ResourceClaim) (map[string]PrepareResult, bool) {
+	results := make(map[string]PrepareResult, len(claims))
+	defer func() {
+		for _, result := range results {
+			if result.Err != nil {
+				prepareErrors.WithLabelValues(errorReason(result.Err)).Inc()
+			}
+		}
+	}()
+	var preparing []*resourceapi.ResourceClaim
+	rollback := sets.New[string]()
+
+	s.Lock()
+	for _, claim := range claims {
+		claimUID := string(claim.UID)
+		if prepared := s.checkpoint.V2.PreparedClaims[claimUID]; prepared != nil {
+			switch prepared.CheckpointState {
+			case ClaimCheckpointStatePrepareCompleted:
+				results[claimUID] = PrepareResult{Devices: prepared.PreparedDevices.GetDevices()}
+				continue
+			case ClaimCheckpointStateUnprepareStarted:
+				results[claimUID] = PrepareResult{Err: withReason(reasonUnpreparing, fmt.Errorf("claim %s is being unprepared", claimUID))}
+				continue
+			}
+			rollback.Insert(claimUID)
+		} else {
+			s.checkpoint.V2.PreparedClaims[claimUID] = newPreparedClaim(claim)
+		}
+		preparing = append(preparing, claim)
+	}
+	var published []resourceslice.Slice
+	if len(preparing) > 0 {
+		published = s.publishedSlices()
+	}
+	if len(preparing) > rollback.Len() {
+		if err := s.saveCheckpoint(); err != nil {
+			for _, claim := range preparing {
+				if !rollback.Has(string(claim.UID)) {
+					delete(s.checkpoint.V2.PreparedClaims, string(claim.UID))
+				}
+				results[string(claim.UID)] = PrepareResult{Err: err}
+			}
+			preparing = nil
+		}
+	}
+	s.Unlock()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	workers := make(chan struct{}, maxParallelPrepares)
+	for _, claim := range preparing {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			defer wg.Done()
+			err := s.prepareClaim(claim, rollback.Has(string(claim.UID)))
+			mutex.Lock()
+			results[string(claim.UID)] = PrepareResult{Err: err}
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
 	s.Lock()
 	defer s.Unlock()
+	changed := len(preparing) > 0 && !equality.Semantic.DeepEqual(published, s.publishedSlices())
+	var completed []string
+	for _, claim := range preparing {
+		if prepared := s.checkpoint.V2.PreparedClaims[string(claim.UID)]; results[string(claim.UID)].Err == nil && prepared != nil {
+			completed = append(completed, string(claim.UID))
+		}
+	}
+	if len(completed) == 0 {
+		return results, changed
+	}
+	err := s.saveCheckpoint()
+	for _, claimUID := range completed {
+		prepared := s.checkpoint.V2.PreparedClaims[claimUID]
+		if err != nil {
+			// Rolled back when the claim is prepared again.
+			prepared.CheckpointState = ClaimCheckpointStatePrepareStarted
+			results[claimUID] = PrepareResult{Err: err}
+			continue
+		}
+		results[claimUID] = PrepareResult{Devices: prepared.PreparedDevices.GetDevices()}
+	}
+	return results, changed
+}
 
-	checkpoint := newCheckpoint()
-	if err := s.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
-		return fmt.Errorf("unable to sync from checkpoint: %v", err)
+// newPreparedClaim returns the checkpoint of a claim that starts to prepare.
+func newPreparedClaim(claim *resourceapi.ResourceClaim) *PreparedClaim {
+	return &PreparedClaim{
+		CheckpointState: ClaimCheckpointStatePrepareStarted,
+		Namespace:       claim.Namespace,
+		Name:            claim.Name,
+		PrepareStarted:  time.Now(),
 	}
-	preparedClaims := checkpoint.V1.PreparedClaims
+}
 
-	if preparedClaims[claimUID] == nil {
+// prepareClaim prepares the devices and the CDI spec of a claim recorded as
+// PrepareStarted, after rolling back an earlier prepare of the claim if
+// rollback is set, and marks it PrepareCompleted in memory. The claim is
+// rolled back if it fails.
+func (s *DeviceState) prepareClaim(claim *resourceapi.ResourceClaim, rollback bool) error {
+	start := time.Now()
+	defer func() { prepareDuration.Observe(time.Since(start).Seconds()) }()
+	claimUID := string(claim.UID)
+	unlock := s.gpuLocks.lock(s.claimGPUs(claim))
+	defer unlock()
+
+	if rollback {
+		s.Lock()
+		err := s.rollbackPrepare(claimUID)
+		if err == nil {
+			s.checkpoint.V2.PreparedClaims[claimUID] = newPreparedClaim(claim)
+			err = s.saveCheckpoint()
+		}
+		s.Unlock()
+		if err != nil {
+			return fmt.Errorf("unable to roll back earlier prepare: %w", err)
+		}
+	}
+
+	preparedDevices, err := s.prepareDevices(claim)
+	if err != nil {
+		err = fmt.Errorf("prepare failed: %w", err)
+	} else if err = s.cdi.CreateClaimSpecFile(claimUID, preparedDevices); err != nil {
+		err = withReason(reasonCDIFailed, fmt.Errorf("unable to create CDI spec file for claim: %v", err))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		if rollbackErr := s.rollbackPrepare(claimUID); rollbackErr != nil {
+			klog.Errorf("Unable to roll back claim %s: %v", claimUID, rollbackErr)
+		}
+		return err
+	}
+	prepared := s.checkpoint.V2.PreparedClaims[claimUID]
+	prepared.CheckpointState = ClaimCheckpointStatePrepareCompleted
+	prepared.PrepareCompleted = time.Now()
+	return nil
+}
+
+// claimGPUs returns the PCI addresses of the GPUs of the devices allocated to
+// a claim and of the GPUs an earlier prepare of the claim changed.
+func (s *DeviceState) claimGPUs(claim *resourceapi.ResourceClaim) []string {
+	s.Lock()
+	defer s.Unlock()
+	var pciAddrs []string
+	if claim.Status.Allocation != nil {
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			if device, exists := s.allocatable[result.Device]; exists {
+				pciAddrs = append(pciAddrs, device.GPUs()...)
+			}
+		}
+	}
+	if prepared := s.checkpoint.V2.PreparedClaims[string(claim.UID)]; prepared != nil {
+		pciAddrs = append(pciAddrs, s.preparedClaimGPUs(prepared)...)
+	}
+	return pciAddrs
+}
+
+// preparedClaimGPUs returns the PCI addresses of the GPUs of the prepared
+// devices of a claim and of the GPUs its prepare changed. Must be called with
+// the state locked.
+func (s *DeviceState) preparedClaimGPUs(claim *PreparedClaim) []string {
+	var pciAddrs []string
+	for _, device := range claim.PreparedDevices {
+		if d, exists := s.allocatable[device.DeviceName]; exists {
+			pciAddrs = append(pciAddrs, d.GPUs()...)
+		}
+		if device.Restore != nil {
+			pciAddrs = append(pciAddrs, device.Restore.PCIAddress)
+		}
+	}
+	for _, change := range claim.Changes {
+		pciAddrs = append(pciAddrs, change.PCIAddress)
+	}
+	return pciAddrs
+}
+
+// rollbackPrepare undoes a prepare of a claim that did not complete: the GPU
+// settings changed for the claim are restored, unless another claim uses the
+// GPU, and its CDI spec and checkpoint are deleted. Must be called with the
+// GPUs of the claim and the state locked.
+func (s *DeviceState) rollbackPrepare(claimUID string) error {
+	claim := s.checkpoint.V2.PreparedClaims[claimUID]
+	if claim == nil {
 		return nil
 	}
 
-	if err := s.unprepareDevices(claimUID, preparedClaims[claimUID]); err != nil {
-		return fmt.Errorf("unprepare failed: %v", err)
+	// The first change of a GPU holds the value it had before the claim.
+	var devices PreparedDevices
+	for _, change := range claim.Changes {
+		devices = append(devices, &PreparedDevice{Restore: &change})
+	}
+	if err := s.restoreSettings(claimUID, devices, s.checkpoint); err != nil {
+		return withReason(reasonRestoreFailed, err)
 	}
 
-	err := s.cdi.DeleteClaimSpecFile(claimUID)
+	if err := s.cdi.DeleteClaimSpecFile(claimUID); err != nil {
+		return withReason(reasonCDIFailed, fmt.Errorf("unable to delete CDI spec file for claim: %v", err))
+	}
+
+	delete(s.checkpoint.V2.PreparedClaims, claimUID)
+	if err := s.saveCheckpoint(); err != nil {
+		return err
+	}
+	s.pruneRetained(s.checkpoint)
+
+	return nil
+}
+
+// Unprepare unprepares the devices of a claim in two phases: the claim is
+// recorded as UnprepareStarted before any device is touched, and deleted
+// from the checkpoint once it is unprepared. A claim that did not complete
+// preparing is rolled back.
+func (s *DeviceState) Unprepare(claimUID string) error {
+	start := time.Now()
+	err := s.unprepare(claimUID)
+	unprepareDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("unable to delete CDI spec file for claim: %v", err)
+		unprepareErrors.WithLabelValues(errorReason(err)).Inc()
 	}
+	return err
+}
 
-	delete(preparedClaims, claimUID)
-	if err := s.checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, checkpoint); err != nil {
-		return fmt.Errorf("unable to sync to checkpoint: %v", err)
+func (s *DeviceState) unprepare(claimUID string) error {
+	s.Lock()
+	var pciAddrs []string
+	if claim := s.checkpoint.V2.PreparedClaims[claimUID]; claim != nil {
+		pciAddrs = s.preparedClaimGPUs(claim)
 	}
+	s.Unlock()
+
+	unlock := s.gpuLocks.lock(pciAddrs)
+	defer unlock()
+
+	s.Lock()
+	claim := s.checkpoint.V2.PreparedClaims[claimUID]
+	if claim == nil {
+		s.Unlock()
+		return nil
+	}
+	if claim.CheckpointState == ClaimCheckpointStatePrepareStarted {
+		defer s.Unlock()
+		return s.rollbackPrepare(claimUID)
+	}
+	if claim.CheckpointState != ClaimCheckpointStateUnprepareStarted {
+		claim.CheckpointState = ClaimCheckpointStateUnprepareStarted
+		claim.UnprepareStarted = time.Now()
+		if err := s.saveCheckpoint(); err != nil {
+			s.Unlock()
+			return err
+		}
+	}
+	shared := sharedDevices(s.checkpoint, claimUID, claim.PreparedDevices)
+	s.Unlock()
+
+	// Waiting for the processes of the claim does not block other GPUs.
+	if err := s.releaseKFDProcesses(claimUID, claim.PreparedDevices, shared); err != nil {
+		return withReason(reasonDeviceBusy, fmt.Errorf("unprepare failed: %v", err))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.restoreSettings(claimUID, claim.PreparedDevices, s.checkpoint); err != nil {
+		return withReason(reasonRestoreFailed, fmt.Errorf("unprepare failed: %v", err))
+	}
+
+	if err := s.cdi.DeleteClaimSpecFile(claimUID); err != nil {
+		return withReason(reasonCDIFailed, fmt.Errorf("unable to delete CDI spec file for claim: %v", err))
+	}
+
+	delete(s.checkpoint.V2.PreparedClaims, claimUID)
+	if err := s.saveCheckpoint(); err != nil {
+		return err
+	}
+	s.pruneRetained(s.checkpoint)
 
 	return nil
 }
 
+// prepareDevices applies the configs of a claim to its allocated devices and
+// records the prepared devices in its checkpoint. Must be called with the
+// GPUs of the claim locked.
 func (s *DeviceState) prepareDevices(claim *resourceapi.ResourceClaim) (PreparedDevices, error) {
 	if claim.Status.Allocation == nil {
-		return nil, fmt.Errorf("claim not yet allocated")
+		return nil, withReason(reasonNotAllocated, fmt.Errorf("claim not yet allocated"))
 	}
 
 	// Retrieve the full set of device configs for the driver.
@@ -203,7 +758,7 @@ func (s *DeviceState) prepareDevices(claim *resourceapi.ResourceClaim) (Prepared
 		claim.Status.Allocation.Devices.Config,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("error getting opaque device configs: %v", err)
+		return nil, withReason(reasonInvalidConfig, fmt.Errorf("error getting opaque device configs: %v", err))
 	}
 
 	// Add the default GPU Config to the front of the config list with the
@@ -214,12 +769,21 @@ func (s *DeviceState) prepareDevices(claim *resourceapi.ResourceClaim) (Prepared
 		Config:   configapi.DefaultGpuConfig(),
 	})
 
+	// Scanning the processes is slow, the devices cannot change meanwhile
+	// with their GPUs locked.
+	if err := s.checkKFDProcesses(string(claim.UID), claim.Status.Allocation.Devices.Results); err != nil {
+		return nil, withReason(reasonDeviceBusy, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
 	// Look through the configs and figure out which one will be applied to
 	// each device allocation result based on their order of precedence.
 	configResultsMap := make(map[runtime.Object][]*resourceapi.DeviceRequestAllocationResult)
 	for _, result := range claim.Status.Allocation.Devices.Results {
-		if _, exists := s.allocatable[result.Device]; !exists {
-			return nil, fmt.Errorf("requested GPU is not allocatable: %v", result.Device)
+		if _, exists := s.allocatable[result.Device]; !exists || s.withheld(result.Device) {
+			return nil, withReason(reasonDeviceUnavailable, fmt.Errorf("requested GPU is not allocatable: %v", result.Device))
 		}
 		for _, c := range slices.Backward(configs) {
 			if len(c.Requests) == 0 || slices.Contains(c.Requests, result.Request) {
@@ -230,9 +794,9 @@ func (s *DeviceState) prepareDevices(claim *resourceapi.ResourceClaim) (Prepared
 	}
 
 	// Normalize, validate, and apply all configs associated with devices that
-	// need to be prepared. Track container edits generated from applying the
-	// config to the set of device allocation results.
-	perDeviceCDIContainerEdits := make(PerDeviceCDIContainerEdits)
+	// need to be prepared. Track the prepared devices generated from applying
+	// the config to the set of device allocation results.
+	perDevicePrepared := make(PerDevicePreparedDevices)
 	for c, results := range configResultsMap {
 		// Cast the opaque config to a GpuConfig
 		var config *configapi.GpuConfig
@@ -240,59 +804,113 @@ func (s *DeviceState) prepareDevices(claim *resourceapi.ResourceClaim) (Prepared
 		case *configapi.GpuConfig:
 			config = castConfig
 		default:
-			return nil, fmt.Errorf("runtime object is not a regognized configuration")
+			return nil, withReason(reasonInvalidConfig, fmt.Errorf("runtime object is not a regognized configuration"))
 		}
 
 		// Normalize the config to set any implied defaults.
 		if err := config.Normalize(); err != nil {
-			return nil, fmt.Errorf("error normalizing GPU config: %w", err)
+			return nil, withReason(reasonInvalidConfig, fmt.Errorf("error normalizing GPU config: %w", err))
 		}
 
 		// Validate the config to ensure its integrity.
 		if err := config.Validate(); err != nil {
-			return nil, fmt.Errorf("error validating GPU config: %w", err)
+			return nil, withReason(reasonInvalidConfig, fmt.Errorf("error validating GPU config: %w", err))
 		}
 
 		// Apply the config to the list of results associated with it.
-		containerEdits, err := s.applyConfig(config, results)
+		prepared, err := s.applyConfig(string(claim.UID), config, results)
 		if err != nil {
-			return nil, fmt.Errorf("error applying GPU config: %w", err)
+			return nil, withReason(reasonConfigFailed, fmt.Errorf("error applying GPU config: %w", err))
 		}
 
-		// Merge any new container edits with the overall per device map.
-		for k, v := range containerEdits {
-			perDeviceCDIContainerEdits[k] = v
+		// Merge the new prepared devices with the overall per device map.
+		for k, v := range prepared {
+			perDevicePrepared[k] = v
 		}
 	}
 
 	// Walk through each config and its associated device allocation results
-	// and construct the list of prepared devices to return.
+	// and construct the list of prepared devices to return. Every result gets
+	// a copy since a shared device may be allocated to several requests.
 	var preparedDevices PreparedDevices
 	for _, results := range configResultsMap {
 		for _, result := range results {
-			device := &PreparedDevice{
-				Device: drapbv1.Device{
-					RequestNames: []string{result.Request},
-					PoolName:     result.Pool,
-					DeviceName:   result.Device,
-					CDIDeviceIDs: s.cdi.GetClaimDevices(string(claim.UID), []string{result.Device}),
-				},
-				ContainerEdits: perDeviceCDIContainerEdits[result.Device],
+			device := *perDevicePrepared[result.Device]
+			device.Device = drapbv1.Device{
+				RequestNames: []string{result.Request},
+				PoolName:     result.Pool,
+				DeviceName:   result.Device,
+				CDIDeviceIDs: s.cdi.GetClaimDevices(string(claim.UID), []string{result.Device}),
 			}
-			preparedDevices = append(preparedDevices, device)
+			if result.ShareID != nil {
+				device.ShareID = string(*result.ShareID)
+			}
+			device.ConsumedCapacity = result.ConsumedCapacity
+			preparedDevices = append(preparedDevices, &device)
 		}
 	}
 
+	// Devices that disappear while the claim is being prepared are retained.
+	if prepared := s.checkpoint.V2.PreparedClaims[string(claim.UID)]; prepared != nil {
+		prepared.PreparedDevices = preparedDevices
+	}
+
 	return preparedDevices, nil
 }
 
-func (s *DeviceState) unprepareDevices(claimUID string, devices PreparedDevices) error {
+// restoreSettings restores the settings recorded for the prepared devices of
+// a claim. The settings of a GPU are only restored if no other prepared claim
+// uses it, and the devices are rediscovered after repartitioning a GPU.
+func (s *DeviceState) restoreSettings(claimUID string, devices PreparedDevices, checkpoint *Checkpoint) error {
+	powerRestored := sets.New[string]()
+	for _, device := range devices {
+		settings := device.Restore
+		if settings == nil || settings.Power == nil || powerRestored.Has(settings.PCIAddress) {
+			continue
+		}
+		powerRestored.Insert(settings.PCIAddress)
+		if other := s.claimUsingGPU(checkpoint, claimUID, settings.PCIAddress); other != "" {
+			klog.Infof("Not restoring %s of GPU %s, it is in use by claim %s", settings.Power, settings.PCIAddress, other)
+			continue
+		}
+		klog.Infof("Restoring %s of GPU %s for claim %s", settings.Power, settings.PCIAddress, claimUID)
+		if err := amdgpu.SetPowerSettings(settings.PCIAddress, *settings.Power, s.hostRoot); err != nil {
+			return fmt.Errorf("unable to restore performance settings of GPU %s: %w", settings.PCIAddress, err)
+		}
+	}
+
+	restored := sets.New[string]()
+	for _, device := range devices {
+		settings := device.Restore
+		if settings == nil || settings.PartitionModes == nil || restored.Has(settings.PCIAddress) {
+			continue
+		}
+		if other := s.claimUsingGPU(checkpoint, claimUID, settings.PCIAddress); other != "" {
+			klog.Infof("Not restoring partition modes of GPU %s, it is in use by claim %s", settings.PCIAddress, other)
+			continue
+		}
+		klog.Infof("Restoring partition modes of GPU %s to %s for claim %s", settings.PCIAddress, settings.PartitionModes, claimUID)
+		if err := amdgpu.SetPartitionModes(settings.PCIAddress, *settings.PartitionModes, s.hostRoot); err != nil {
+			return fmt.Errorf("unable to restore partition modes of GPU %s: %w", settings.PCIAddress, err)
+		}
+		restored.Insert(settings.PCIAddress)
+	}
+	if restored.Len() == 0 {
+		return nil
+	}
+
+	allocatable, err := enumerateAllPossibleDevices(s.hostRoot, s.partitionable, s.hiveDevices)
+	if err != nil {
+		return fmt.Errorf("error enumerating all possible devices: %v", err)
+	}
+	s.updateAllocatable(allocatable)
 	return nil
 }
 
 // getDeviceAttrs gets the major, minor, type, and permissions for a given device path.
+// The path is resolved below the configured host root.
 func (s *DeviceState) getDeviceAttrs(path string) (major, minor int64, devType, permissions string, err error) {
-	fileInfo, err := os.Stat(path)
+	fileInfo, err := os.Stat(filepath.Join(s.hostRoot, path))
 	if err != nil {
 		return 0, 0, "", "", fmt.Errorf("failed to stat device %s: %w", path, err)
 	}
@@ -322,73 +940,180 @@ func (s *DeviceState) getDeviceAttrs(path string) (major, minor int64, devType,
 }
 
 // applyConfig applies a configuration to a set of device allocation results.
-func (s *DeviceState) applyConfig(config *configapi.GpuConfig, results []*resourceapi.DeviceRequestAllocationResult) (PerDeviceCDIContainerEdits, error) {
-	perDeviceEdits := make(PerDeviceCDIContainerEdits)
+// It returns the prepared device of each result with its container edits,
+// visible devices and the settings to restore when it is unprepared.
+func (s *DeviceState) applyConfig(claimUID string, config *configapi.GpuConfig, results []*resourceapi.DeviceRequestAllocationResult) (PerDevicePreparedDevices, error) {
+	perDevicePrepared := make(PerDevicePreparedDevices)
+	for _, result := range results {
+		perDevicePrepared[result.Device] = &PreparedDevice{}
+	}
 
+	// Remember the GPU of each device, repartitioning may replace it. The
+	// settings of a hive cannot be restored per GPU, so hives are neither
+	// repartitioned nor have their performance configured.
+	pciAddrs := make(map[string]string)
+	var preparing []string
 	for _, result := range results {
-		klog.Infof("received allocation result: %+v", result)
-		card, renderD, err := parseDeviceName(result.Device)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing device name %s: %w", result.Device, err)
+		device, exists := s.allocatable[result.Device]
+		if !exists {
+			return nil, fmt.Errorf("requested GPU is not allocatable: %v", result.Device)
+		}
+		if device.Type() == AmdHiveDeviceType {
+			if config.Partitioning != nil || config.Performance != nil {
+				return nil, fmt.Errorf("hive device %s cannot be partitioned or have its performance configured", result.Device)
+			}
+			continue
 		}
-		// TODO implement GPU sharing config when it is available
-		//switch {
-		//case config.Sharing.IsTimeSlicing():
-		//	// TODO implement time slicing config when it is available
-		//case config.Sharing.IsSpacePartitioning():
-		//	// TODO implement space partitioning config when it is available
-		//}
+		pciAddrs[result.Device] = device.PCIAddress()
+		preparing = append(preparing, result.Device)
+	}
 
-		cardPath := fmt.Sprintf("/dev/dri/card%d", card)
-		renderDPath := fmt.Sprintf("/dev/dri/renderD%d", renderD)
-		kfdPath := "/dev/kfd"
+	checkpoint := s.checkpoint
+	for _, result := range results {
+		if err := checkSharing(checkpoint, claimUID, config.Sharing, result.Device); err != nil {
+			return nil, withReason(reasonDeviceBusy, err)
+		}
+	}
 
-		cardMajor, cardMinor, cardDevType, cardPermission, err := s.getDeviceAttrs(cardPath)
+	gpuModes, err := s.gpuPartitionModes(config.Partitioning, results)
+	if err != nil {
+		return nil, err
+	}
+	if len(gpuModes) > 0 {
+		previous, err := s.applyPartitioning(claimUID, gpuModes, preparing)
 		if err != nil {
-			return nil, fmt.Errorf("error getting device attrs for %s: %w", cardPath, err)
+			return nil, err
 		}
-		renderDMajor, renderDMinor, renderDDevType, renderDPermission, err := s.getDeviceAttrs(renderDPath)
-		if err != nil {
-			return nil, fmt.Errorf("error getting device attrs for %s: %w", renderDPath, err)
+		// A claim whose device was replaced got the whole GPU, which is
+		// switched back when the claim is unprepared.
+		for _, result := range results {
+			pciAddr := pciAddrs[result.Device]
+			if modes, exists := previous[pciAddr]; exists && s.retained.Has(result.Device) {
+				perDevicePrepared[result.Device].Restore = &DeviceSettings{
+					PCIAddress:     pciAddr,
+					PartitionModes: &modes,
+				}
+			}
 		}
-		kfdMajor, kfdMinor, kfdDevType, kfdPermission, err := s.getDeviceAttrs(kfdPath)
-		if err != nil {
-			return nil, fmt.Errorf("error getting device attrs for %s: %w", kfdPath, err)
+	}
+
+	gpuPower, err := s.applyPerformance(claimUID, config.Performance, slices.Compact(slices.Sorted(maps.Values(pciAddrs))), checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		pciAddr := pciAddrs[result.Device]
+		if settings, exists := gpuPower[pciAddr]; exists {
+			prepared := perDevicePrepared[result.Device]
+			if prepared.Restore == nil {
+				prepared.Restore = &DeviceSettings{PCIAddress: pciAddr}
+			}
+			prepared.Restore.Power = &settings
 		}
+	}
 
+	for _, result := range results {
+		klog.Infof("received allocation result: %+v", result)
+
+		kfdNode, err := s.deviceNode("/dev/kfd")
+		if err != nil {
+			return nil, err
+		}
 		edits := &cdispec.ContainerEdits{
-			DeviceNodes: []*cdispec.DeviceNode{
-				{
-					Path:        "/dev/kfd",
-					HostPath:    "/dev/kfd",
-					Type:        kfdDevType,
-					Major:       kfdMajor,
-					Minor:       kfdMinor,
-					Permissions: kfdPermission,
-				},
-				{
-					Path:        fmt.Sprintf("/dev/dri/card%d", card),
-					HostPath:    fmt.Sprintf("/dev/dri/card%d", card),
-					Type:        cardDevType,
-					Major:       cardMajor,
-					Minor:       cardMinor,
-					Permissions: cardPermission,
-				},
-				{
-					Path:        fmt.Sprintf("/dev/dri/renderD%d", renderD),
-					HostPath:    fmt.Sprintf("/dev/dri/renderD%d", renderD),
-					Type:        renderDDevType,
-					Major:       renderDMajor,
-					Minor:       renderDMinor,
-					Permissions: renderDPermission,
-				},
-			},
-		}
-
-		perDeviceEdits[result.Device] = &cdiapi.ContainerEdits{ContainerEdits: edits}
-	}
-
-	return perDeviceEdits, nil
+			DeviceNodes: []*cdispec.DeviceNode{kfdNode},
+		}
+
+		backing := s.backingDevices(result.Device, pciAddrs[result.Device])
+		for _, device := range backing {
+			card, renderD := device.DRMNodes()
+			if card < 0 {
+				return nil, fmt.Errorf("device %s has no DRM nodes in the current partition layout", device.CanonicalName())
+			}
+			for _, path := range []string{
+				fmt.Sprintf("/dev/dri/card%d", card),
+				fmt.Sprintf("/dev/dri/renderD%d", renderD),
+			} {
+				node, err := s.deviceNode(path)
+				if err != nil {
+					return nil, err
+				}
+				edits.DeviceNodes = append(edits.DeviceNodes, node)
+			}
+		}
+
+		prepared := perDevicePrepared[result.Device]
+		prepared.ContainerEdits = &cdiapi.ContainerEdits{ContainerEdits: edits}
+		prepared.VisibleDevices = visibleDevices(config.VisibleDevices, backing)
+		prepared.NumaNodes, prepared.LocalCPUs = numaAffinity(backing)
+		prepared.Config = config
+
+		prepared.Sharing = config.Sharing.Strategy
+
+		switch {
+		case config.Sharing.IsTimeSlicing():
+			// The GPU scheduler time-slices between the processes of all
+			// claims, there is nothing to configure.
+		case config.Sharing.IsSpacePartitioning():
+			spaceConfig, err := config.Sharing.GetSpacePartitioningConfig()
+			if err != nil {
+				return nil, err
+			}
+			if len(prepared.VisibleDevices) != 1 {
+				return nil, fmt.Errorf("device %s cannot be space partitioned: it is not a single device known to ROCm", result.Device)
+			}
+			cus, err := allocateComputeUnits(checkpoint, claimUID, spaceConfig, result.Device, backing[0])
+			if err != nil {
+				return nil, err
+			}
+			prepared.ComputeUnits = cus
+		}
+	}
+
+	return perDevicePrepared, nil
+}
+
+// backingDevices returns the devices whose DRM nodes back an allocated
+// device. This is the device itself unless the claim repartitioned its GPU,
+// in which case it is every device the GPU has now. A hive is backed by every
+// device its GPUs have.
+func (s *DeviceState) backingDevices(name, pciAddr string) []*AllocatableDevice {
+	device, exists := s.allocatable[name]
+	switch {
+	case exists && device.Type() == AmdHiveDeviceType:
+		return s.devicesOnGPUs(device.GPUs()...)
+	case exists && !s.retained.Has(name):
+		return []*AllocatableDevice{device}
+	}
+	return s.devicesOnGPUs(pciAddr)
+}
+
+// devicesOnGPUs returns the GPUs and partitions the given GPUs have now,
+// ordered by name.
+func (s *DeviceState) devicesOnGPUs(pciAddrs ...string) []*AllocatableDevice {
+	var devices []*AllocatableDevice
+	for _, name := range slices.Sorted(maps.Keys(s.allocatable)) {
+		device := s.allocatable[name]
+		if !s.retained.Has(name) && device.Type() != AmdHiveDeviceType && slices.Contains(pciAddrs, device.PCIAddress()) {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// deviceNode returns the CDI device node of a device path.
+func (s *DeviceState) deviceNode(path string) (*cdispec.DeviceNode, error) {
+	major, minor, devType, permissions, err := s.getDeviceAttrs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error getting device attrs for %s: %w", path, err)
+	}
+	return &cdispec.DeviceNode{
+		Path:        path,
+		HostPath:    path,
+		Type:        devType,
+		Major:       major,
+		Minor:       minor,
+		Permissions: permissions,
+	}, nil
 }
 
 // GetOpaqueDeviceConfigs returns an ordered list of the configs contained in possibleConfigs for this driver.
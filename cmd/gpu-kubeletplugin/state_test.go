@@ -33,11 +33,22 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"maps"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-
+	"github.com/stretchr/testify/require"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	drapbv1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/consts"
 )
 
 func TestPreparedDevicesGetDevices(t *testing.T) {
@@ -70,3 +81,236 @@ func TestPreparedDevicesGetDevices(t *testing.T) {
 		})
 	}
 }
+
+// newTestDeviceState returns a DeviceState for the devices below hostRoot
+// with an empty checkpoint and no CDI handler.
+func newTestDeviceState(t testing.TB, hostRoot string) *DeviceState {
+	allocatable, err := enumerateAllPossibleDevices(hostRoot, false, false)
+	require.NoError(t, err)
+
+	checkpointManager, err := checkpointmanager.NewCheckpointManager(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, checkpointManager.CreateCheckpoint(DriverPluginCheckpointFile, newCheckpoint()))
+
+	state := &DeviceState{
+		hostRoot:          hostRoot,
+		allocatable:       allocatable,
+		checkpointManager: checkpointManager,
+		checkpoint:        newCheckpoint(),
+		retained:          sets.New[string](),
+		rasThresholds:     rasThresholds{"ue": 1},
+		rasTaintEffect:    resourceapi.DeviceTaintEffectNoSchedule,
+		rasTaints:         make(map[string]*resourceapi.DeviceTaint),
+		rasUnknown:        sets.New[string](),
+	}
+	state.gpus.Store(int32(countGPUs(allocatable, state.retained)))
+	return state
+}
+
+// preparedClaim returns the checkpoint of a claim prepared with the given
+// devices.
+func preparedClaim(devices PreparedDevices) *PreparedClaim {
+	return &PreparedClaim{
+		CheckpointState: ClaimCheckpointStatePrepareCompleted,
+		PreparedDevices: devices,
+	}
+}
+
+func publishedDeviceNames(s *DeviceState) []string {
+	var names []string
+	for _, device := range s.PublishedDevices() {
+		names = append(names, device.Name)
+	}
+	return names
+}
+
+func TestDeviceStateRediscover(t *testing.T) {
+	spx := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+	state := newTestDeviceState(t, spx)
+	assert.Equal(t, []string{"gpu-43d0a94e5d4cf437", "gpu-9c1a3b4fe2d07a11"}, publishedDeviceNames(state))
+
+	changed, err := state.Rediscover()
+	require.NoError(t, err)
+	assert.False(t, changed, "rediscovering an unchanged node")
+
+	// Repartitioning replaces the full GPUs with their partitions.
+	state.hostRoot = amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+	changed, err = state.Rediscover()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, state.PublishedDevices(), 16)
+
+	changed, err = state.Rediscover()
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestDeviceStateRediscoverPreparedDevice(t *testing.T) {
+	state := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+
+	checkpoint := newCheckpoint()
+	checkpoint.V2.PreparedClaims["claim-uid"] = preparedClaim(PreparedDevices{
+		{Device: drapbv1.Device{DeviceName: "gpu-43d0a94e5d4cf437"}},
+	})
+	state.checkpoint = checkpoint
+
+	// Both GPUs fall off the bus.
+	state.hostRoot = t.TempDir()
+	changed, err := state.Rediscover()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, state.PublishedDevices())
+
+	// The prepared GPU is retained so its claim can still be unprepared,
+	// while the other one is dropped.
+	assert.Contains(t, state.allocatable, "gpu-43d0a94e5d4cf437")
+	assert.NotContains(t, state.allocatable, "gpu-9c1a3b4fe2d07a11")
+	assert.True(t, state.retained.Has("gpu-43d0a94e5d4cf437"))
+
+	// Once the claim is gone the retained GPU is dropped as well.
+	state.checkpoint = newCheckpoint()
+	changed, err = state.Rediscover()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, state.allocatable)
+}
+
+// countingCheckpointManager counts the checkpoints written.
+type countingCheckpointManager struct {
+	checkpointmanager.CheckpointManager
+	writes int
+}
+
+func (m *countingCheckpointManager) CreateCheckpoint(key string, checkpoint checkpointmanager.Checkpoint) error {
+	m.writes++
+	return m.CheckpointManager.CreateCheckpoint(key, checkpoint)
+}
+
+// newTestClaim returns a claim allocated the given devices of the node.
+func newTestClaim(uid string, devices ...string) *resourceapi.ResourceClaim {
+	claim := &resourceapi.ResourceClaim{}
+	claim.UID = types.UID(uid)
+	claim.Namespace = "default"
+	claim.Name = uid
+	claim.Status.Allocation = &resourceapi.AllocationResult{}
+	for _, device := range devices {
+		claim.Status.Allocation.Devices.Results = append(claim.Status.Allocation.Devices.Results, resourceapi.DeviceRequestAllocationResult{
+			Request: "gpu",
+			Driver:  consts.DriverName,
+			Pool:    "node",
+			Device:  device,
+		})
+	}
+	return claim
+}
+
+// newTestPrepareState returns a DeviceState for the devices of a fixture that
+// can prepare claims.
+func newTestPrepareState(t testing.TB, fixture string) *DeviceState {
+	hostRoot := amdgputest.HostRoot(t, fixture)
+	amdgputest.LinkDeviceNodes(t, hostRoot)
+	state := newTestDeviceState(t, hostRoot)
+	state.cdi, _ = newTestCDIHandler(t)
+	return state
+}
+
+func TestDeviceStatePrepare(t *testing.T) {
+	state := newTestPrepareState(t, amdgputest.MI300XCPXNPS1)
+	checkpointManager := &countingCheckpointManager{CheckpointManager: state.checkpointManager}
+	state.checkpointManager = checkpointManager
+
+	// Claims share devices with the default time-slicing config.
+	claims := []*resourceapi.ResourceClaim{
+		newTestClaim("claim-0", "gpu-43d0a94e5d4cf437-xcp0"),
+		newTestClaim("claim-1", "gpu-43d0a94e5d4cf437-xcp0", "gpu-9c1a3b4fe2d07a11-xcp3"),
+		newTestClaim("claim-2", "gpu-9c1a3b4fe2d07a11-xcp3"),
+		newTestClaim("unknown", "gpu-0000000000000000"),
+	}
+	results, changed := state.Prepare(claims)
+	assert.False(t, changed)
+
+	require.Len(t, results, 4)
+	for _, uid := range []string{"claim-0", "claim-1", "claim-2"} {
+		require.NoError(t, results[uid].Err, uid)
+	}
+	assert.Len(t, results["claim-1"].Devices, 2)
+	assert.ErrorContains(t, results["unknown"].Err, "requested GPU is not allocatable: gpu-0000000000000000")
+	// The batch is started and committed with a write each, the failed claim
+	// is rolled back with another.
+	assert.Equal(t, 3, checkpointManager.writes)
+
+	checkpoint := &Checkpoint{}
+	require.NoError(t, state.checkpointManager.GetCheckpoint(DriverPluginCheckpointFile, checkpoint))
+	assert.Equal(t, []string{"claim-0", "claim-1", "claim-2"}, slices.Sorted(maps.Keys(checkpoint.V2.PreparedClaims)))
+	for uid, claim := range checkpoint.V2.PreparedClaims {
+		assert.Equal(t, ClaimCheckpointStatePrepareCompleted, claim.CheckpointState, uid)
+	}
+	specs, err := state.cdi.ListClaimSpecFiles()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"claim-0", "claim-1", "claim-2"}, specs)
+
+	// Prepared claims are not prepared again.
+	checkpointManager.writes = 0
+	again, changed := state.Prepare(claims[:3])
+	assert.False(t, changed)
+	for _, uid := range []string{"claim-0", "claim-1", "claim-2"} {
+		assert.Equal(t, results[uid], again[uid], uid)
+	}
+	assert.Zero(t, checkpointManager.writes)
+
+	require.NoError(t, state.Unprepare("claim-1"))
+	specs, err = state.cdi.ListClaimSpecFiles()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"claim-0", "claim-2"}, specs)
+}
+
+func TestDeviceStatePreparePublishedDevicesChanged(t *testing.T) {
+	state := newTestPrepareState(t, amdgputest.MI300XSPXNPS1)
+
+	// The healthcheck prepares empty batches.
+	results, changed := state.Prepare(nil)
+	assert.Empty(t, results)
+	assert.False(t, changed)
+
+	// Repartitioning a GPU replaces its published devices.
+	claim := newTestClaim("claim-uid", "gpu-43d0a94e5d4cf437")
+	claim.Status.Allocation.Devices.Config = []resourceapi.DeviceAllocationConfiguration{{
+		Source: resourceapi.AllocationConfigSourceClaim,
+		DeviceConfiguration: resourceapi.DeviceConfiguration{
+			Opaque: &resourceapi.OpaqueDeviceConfiguration{
+				Driver: consts.DriverName,
+				Parameters: runtime.RawExtension{
+					Raw: []byte(`{"apiVersion":"gpu.resource.amd.com/v1alpha1","kind":"GpuConfig","partitioning":{"computeMode":"CPX"}}`),
+				},
+			},
+		},
+	}}
+	results, changed = state.Prepare([]*resourceapi.ResourceClaim{claim})
+	require.NoError(t, results["claim-uid"].Err)
+	assert.True(t, changed)
+}
+
+func BenchmarkDeviceStatePrepare(b *testing.B) {
+	for _, count := range []int{8, 64, 256} {
+		b.Run(fmt.Sprintf("claims=%d", count), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				state := newTestPrepareState(b, amdgputest.MI300XCPXNPS1)
+				devices := slices.Sorted(maps.Keys(state.allocatable))
+				var claims []*resourceapi.ResourceClaim
+				for i := range count {
+					claims = append(claims, newTestClaim(fmt.Sprintf("claim-%d", i), devices[i%len(devices)]))
+				}
+				b.StartTimer()
+
+				results, _ := state.Prepare(claims)
+				for uid, result := range results {
+					if result.Err != nil {
+						b.Fatalf("preparing claim %s: %v", uid, result.Err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*count), "µs/claim")
+		})
+	}
+}
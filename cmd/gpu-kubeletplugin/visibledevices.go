@@ -0,0 +1,128 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	klog "k8s.io/klog/v2"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+)
+
+// VisibleDevice is a GPU or partition as listed in ROCR_VISIBLE_DEVICES.
+type VisibleDevice struct {
+	// UUID is the UUID of a GPU listed by UUID. Devices without one are
+	// listed by their index among the devices of the claim.
+	UUID string `json:",omitempty"`
+	// Ordinal is the ROCm device index of the device on the node. The
+	// devices of a claim are listed in this order.
+	Ordinal int
+}
+
+// visibleDevices returns the entries of the devices backing an allocated
+// device in ROCR_VISIBLE_DEVICES. Partitions share the UUID of their GPU and
+// GPUs without a unique_id have no UUID ROCm accepts, so both are always
+// listed by index. Devices ROCm does not enumerate are left out.
+func visibleDevices(style configapi.VisibleDevicesStyle, backing []*AllocatableDevice) []VisibleDevice {
+	var visible []VisibleDevice
+	for _, device := range backing {
+		ordinal := device.Ordinal()
+		if ordinal < 0 {
+			klog.Warningf("Device %s has no ROCm device index, leaving it out of ROCR_VISIBLE_DEVICES", device.CanonicalName())
+			continue
+		}
+		var uuid string
+		if style != configapi.IndexVisibleDevices && device.Type() == AmdGpuDeviceType && device.AmdGpu.DeviceID != "" {
+			uuid = device.AmdGpu.UUID
+		}
+		visible = append(visible, VisibleDevice{UUID: uuid, Ordinal: ordinal})
+	}
+	return visible
+}
+
+// claimVisibleDevices returns the devices backing the devices of a claim that
+// ROCm enumerates, each listed once and ordered by their ROCm device index.
+// ROCm only enumerates the devices a container has render nodes for, so
+// inside the containers of the claim it numbers them from zero in this order.
+func claimVisibleDevices(devices PreparedDevices) []VisibleDevice {
+	var visible []VisibleDevice
+	for _, device := range devices {
+		for _, v := range device.VisibleDevices {
+			if !slices.ContainsFunc(visible, func(w VisibleDevice) bool { return w.Ordinal == v.Ordinal }) {
+				visible = append(visible, v)
+			}
+		}
+	}
+	slices.SortFunc(visible, func(a, b VisibleDevice) int { return cmp.Compare(a.Ordinal, b.Ordinal) })
+	return visible
+}
+
+// entry returns the entry of a device in ROCR_VISIBLE_DEVICES given its
+// index among the visible devices of its claim.
+func (v VisibleDevice) entry(index int) string {
+	if v.UUID != "" {
+		return v.UUID
+	}
+	return strconv.Itoa(index)
+}
+
+// visibleDevicesEnv returns the environment variables that make exactly the
+// GPUs and partitions of a claim visible to ROCm and HIP, ordered by their
+// ROCm device index. ROCm and HIP number the devices of the claim from zero,
+// and so do HSA_CU_MASK, which limits the devices the claim space partitions
+// to their compute units, and the capacity limits of the claim. It returns
+// nil if none of the devices is known to ROCm, since an empty
+// ROCR_VISIBLE_DEVICES would hide all of them.
+func visibleDevicesEnv(devices PreparedDevices) []string {
+	visible := claimVisibleDevices(devices)
+	computeUnits := make(map[int][]int)
+	for _, device := range devices {
+		// Space partitioned devices are backed by a single device.
+		if len(device.ComputeUnits) > 0 && len(device.VisibleDevices) == 1 {
+			computeUnits[device.VisibleDevices[0].Ordinal] = device.ComputeUnits
+		}
+	}
+	if len(visible) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(visible))
+	indices := make([]string, len(visible))
+	hipIndices := make(map[int]int, len(visible))
+	var masks []string
+	for i, v := range visible {
+		ids[i] = v.entry(i)
+		indices[i] = strconv.Itoa(i)
+		hipIndices[v.Ordinal] = i
+		if cus, exists := computeUnits[v.Ordinal]; exists {
+			masks = append(masks, fmt.Sprintf("%d:%s", i, formatComputeUnits(cus)))
+		}
+	}
+	env := []string{
+		"ROCR_VISIBLE_DEVICES=" + strings.Join(ids, ","),
+		"HIP_VISIBLE_DEVICES=" + strings.Join(indices, ","),
+	}
+	if len(masks) > 0 {
+		env = append(env, "HSA_CU_MASK="+strings.Join(masks, ";"))
+	}
+	return append(env, capacityLimitsEnv(devices, hipIndices)...)
+}
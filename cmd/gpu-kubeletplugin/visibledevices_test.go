@@ -0,0 +1,188 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	configapi "github.com/ROCm/k8s-gpu-dra-driver/api/amd.com/resource/gpu/v1alpha1"
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestVisibleDevices(t *testing.T) {
+	spx := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	cpx := newTestDeviceState(t, amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	gpu := spx.allocatable["gpu-9c1a3b4fe2d07a11"]
+	partition := cpx.allocatable["gpu-9c1a3b4fe2d07a11-xcp2"]
+	unknown := *gpu
+	unknownInfo := *gpu.AmdGpu
+	unknownInfo.Ordinal = -1
+	unknown.AmdGpu = &unknownInfo
+
+	tests := map[string]struct {
+		style    configapi.VisibleDevicesStyle
+		backing  []*AllocatableDevice
+		expected []VisibleDevice
+	}{
+		"GPU by UUID": {
+			backing:  []*AllocatableDevice{gpu},
+			expected: []VisibleDevice{{UUID: "GPU-9c1a3b4fe2d07a11", Ordinal: 1}},
+		},
+		"GPU by index": {
+			style:    configapi.IndexVisibleDevices,
+			backing:  []*AllocatableDevice{gpu},
+			expected: []VisibleDevice{{Ordinal: 1}},
+		},
+		"partition by index": {
+			style:    configapi.UUIDVisibleDevices,
+			backing:  []*AllocatableDevice{partition},
+			expected: []VisibleDevice{{Ordinal: 10}},
+		},
+		"device unknown to ROCm": {
+			backing:  []*AllocatableDevice{&unknown},
+			expected: nil,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, visibleDevices(test.style, test.backing))
+		})
+	}
+}
+
+func TestVisibleDevicesEnv(t *testing.T) {
+	tests := map[string]struct {
+		devices  PreparedDevices
+		expected []string
+	}{
+		"no devices": {
+			devices:  nil,
+			expected: nil,
+		},
+		"no devices known to ROCm": {
+			devices:  PreparedDevices{{}},
+			expected: nil,
+		},
+		"sorted by index": {
+			devices: PreparedDevices{
+				{VisibleDevices: []VisibleDevice{{UUID: "GPU-9c1a3b4fe2d07a11", Ordinal: 1}}},
+				{VisibleDevices: []VisibleDevice{{UUID: "GPU-43d0a94e5d4cf437", Ordinal: 0}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=GPU-43d0a94e5d4cf437,GPU-9c1a3b4fe2d07a11",
+				"HIP_VISIBLE_DEVICES=0,1",
+			},
+		},
+		// ROCm only enumerates the devices of the claim, so indices are
+		// relative to the claim rather than to the node.
+		"partition by index": {
+			devices: PreparedDevices{
+				{VisibleDevices: []VisibleDevice{{Ordinal: 5}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=0",
+				"HIP_VISIBLE_DEVICES=0",
+			},
+		},
+		"GPU by UUID and partition by index": {
+			devices: PreparedDevices{
+				{VisibleDevices: []VisibleDevice{{Ordinal: 5}}},
+				{VisibleDevices: []VisibleDevice{{UUID: "GPU-43d0a94e5d4cf437", Ordinal: 0}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=GPU-43d0a94e5d4cf437,1",
+				"HIP_VISIBLE_DEVICES=0,1",
+			},
+		},
+		"backing device listed by UUID and by index": {
+			devices: PreparedDevices{
+				{VisibleDevices: []VisibleDevice{{UUID: "GPU-43d0a94e5d4cf437", Ordinal: 0}}},
+				{VisibleDevices: []VisibleDevice{{Ordinal: 0}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=GPU-43d0a94e5d4cf437",
+				"HIP_VISIBLE_DEVICES=0",
+			},
+		},
+		"shared backing devices listed once": {
+			devices: PreparedDevices{
+				{VisibleDevices: []VisibleDevice{{Ordinal: 8}, {Ordinal: 9}}},
+				{VisibleDevices: []VisibleDevice{{Ordinal: 9}, {Ordinal: 3}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=0,1,2",
+				"HIP_VISIBLE_DEVICES=0,1,2",
+			},
+		},
+		"space partitioned devices": {
+			devices: PreparedDevices{
+				{
+					VisibleDevices: []VisibleDevice{{Ordinal: 9}},
+					ComputeUnits:   []int{0, 1, 2, 3, 4, 5, 6, 7, 8},
+				},
+				{VisibleDevices: []VisibleDevice{{Ordinal: 1}}},
+				{
+					VisibleDevices: []VisibleDevice{{Ordinal: 10}},
+					ComputeUnits:   []int{19, 20, 21, 22, 23, 24, 25, 26, 27},
+				},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=0,1,2",
+				"HIP_VISIBLE_DEVICES=0,1,2",
+				"HSA_CU_MASK=1:0-8;2:19-27",
+			},
+		},
+		"consumed capacity": {
+			devices: PreparedDevices{
+				{
+					VisibleDevices: []VisibleDevice{{UUID: "GPU-9c1a3b4fe2d07a11", Ordinal: 1}},
+					ConsumedCapacity: map[resourceapi.QualifiedName]resource.Quantity{
+						"memory":         resource.MustParse("16Gi"),
+						"computeUnits":   resource.MustParse("76"),
+						"simdUnits":      resource.MustParse("0"),
+						replicasCapacity: resource.MustParse("1"),
+					},
+				},
+				{
+					VisibleDevices: []VisibleDevice{{UUID: "GPU-9c1a3b4fe2d07a11", Ordinal: 1}},
+					ConsumedCapacity: map[resourceapi.QualifiedName]resource.Quantity{
+						"memory":         resource.MustParse("8Gi"),
+						replicasCapacity: resource.MustParse("1"),
+					},
+				},
+				{VisibleDevices: []VisibleDevice{{UUID: "GPU-43d0a94e5d4cf437", Ordinal: 0}}},
+			},
+			expected: []string{
+				"ROCR_VISIBLE_DEVICES=GPU-43d0a94e5d4cf437,GPU-9c1a3b4fe2d07a11",
+				"HIP_VISIBLE_DEVICES=0,1",
+				"AMD_GPU_COMPUTE_UNITS_LIMIT_1=76",
+				"AMD_GPU_MEMORY_LIMIT_1=25769803776",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, visibleDevicesEnv(test.devices))
+		})
+	}
+}
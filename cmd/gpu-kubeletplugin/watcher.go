@@ -0,0 +1,247 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// ueventDebounce is how long the watcher waits for a burst of uevents
+	// (e.g. one per partition when a GPU is repartitioned) to settle before
+	// rediscovering devices.
+	ueventDebounce = 2 * time.Second
+
+	// ueventBufferSize is large enough for any single kernel uevent message.
+	ueventBufferSize = 64 * 1024
+
+	// ueventRetryInterval is how long the watcher waits before reading the
+	// uevent socket again after an unexpected error.
+	ueventRetryInterval = time.Second
+)
+
+// uevent is a kernel object event received on a NETLINK_KOBJECT_UEVENT socket.
+type uevent struct {
+	Action  string
+	DevPath string
+	Env     map[string]string
+}
+
+// parseUevent parses a kernel uevent message of the form
+// "<action>@<devpath>\0KEY=VALUE\0...".
+func parseUevent(msg []byte) (*uevent, error) {
+	fields := bytes.Split(msg, []byte{0})
+	action, devPath, found := strings.Cut(string(fields[0]), "@")
+	if !found {
+		return nil, fmt.Errorf("malformed uevent header %q", fields[0])
+	}
+
+	event := &uevent{
+		Action:  action,
+		DevPath: devPath,
+		Env:     make(map[string]string),
+	}
+	for _, field := range fields[1:] {
+		if key, value, found := strings.Cut(string(field), "="); found {
+			event.Env[key] = value
+		}
+	}
+	return event, nil
+}
+
+// affectsGPUs reports whether the event may change the set of AMD GPUs or
+// partitions on the node.
+func (e *uevent) affectsGPUs() bool {
+	switch e.Env["SUBSYSTEM"] {
+	case "drm", "kfd":
+		return true
+	case "pci":
+		return e.Env["DRIVER"] == "amdgpu" || strings.HasPrefix(e.Env["PCI_ID"], "1002:")
+	case "platform":
+		return strings.Contains(e.DevPath, "amdgpu_xcp")
+	}
+	return false
+}
+
+// openUeventSocket opens a netlink socket subscribed to kernel uevents. Reads
+// time out periodically so the reader can notice cancellation.
+func openUeventSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create uevent socket: %w", err)
+	}
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1, // kernel uevents, as opposed to those re-broadcast by udev
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to bind uevent socket: %w", err)
+	}
+
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to set uevent socket timeout: %w", err)
+	}
+	return fd, nil
+}
+
+// deviceWatcher triggers device rediscovery when the kernel reports a GPU
+// related uevent and, as a fallback for missed events, periodically.
+type deviceWatcher struct {
+	resyncInterval time.Duration
+	debounce       time.Duration
+	rediscover     func(ctx context.Context) error
+
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// startDeviceWatcher starts watching for device changes. A non-positive
+// resyncInterval disables periodic rediscovery.
+func startDeviceWatcher(ctx context.Context, resyncInterval time.Duration, rediscover func(ctx context.Context) error) *deviceWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &deviceWatcher{
+		resyncInterval: resyncInterval,
+		debounce:       ueventDebounce,
+		rediscover:     rediscover,
+		trigger:        make(chan struct{}, 1),
+		cancel:         cancel,
+	}
+
+	fd, err := openUeventSocket()
+	if err != nil {
+		// Uevents are only delivered in the host network namespace.
+		klog.Warningf("Not watching uevents, relying on periodic resync every %v: %v", resyncInterval, err)
+	} else {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer unix.Close(fd)
+			w.readUevents(ctx, func(buf []byte) (int, error) {
+				n, _, err := unix.Recvfrom(fd, buf, 0)
+				return n, err
+			})
+		}()
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run(ctx)
+	}()
+
+	return w
+}
+
+// Stop stops the watcher and waits for it to finish.
+func (w *deviceWatcher) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// Trigger requests a rediscovery after the debounce period.
+func (w *deviceWatcher) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// readUevents triggers a rediscovery for every GPU related uevent until ctx
+// is cancelled or the socket is closed. recv reads one message from the
+// socket.
+func (w *deviceWatcher) readUevents(ctx context.Context, recv func(buf []byte) (int, error)) {
+	buf := make([]byte, ueventBufferSize)
+	for ctx.Err() == nil {
+		n, err := recv(buf)
+		switch {
+		case err == nil:
+		case errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOBUFS):
+			// The socket overflowed during a burst of events, some of
+			// which are lost: rediscover everything.
+			klog.Warningf("Uevent socket overflowed, rediscovering devices")
+			w.Trigger()
+			continue
+		case errors.Is(err, unix.EBADF):
+			klog.Errorf("Uevent socket closed, relying on periodic resync: %v", err)
+			return
+		default:
+			klog.Errorf("Failed to read uevent: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(ueventRetryInterval):
+			}
+			continue
+		}
+
+		event, err := parseUevent(buf[:n])
+		if err != nil {
+			klog.V(6).Infof("Ignoring uevent: %v", err)
+			continue
+		}
+		if event.affectsGPUs() {
+			klog.V(4).Infof("Received %s uevent for %s", event.Action, event.DevPath)
+			w.Trigger()
+		}
+	}
+}
+
+func (w *deviceWatcher) run(ctx context.Context) {
+	var resync <-chan time.Time
+	if w.resyncInterval > 0 {
+		ticker := time.NewTicker(w.resyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	debounce := time.NewTimer(0)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.trigger:
+			debounce.Reset(w.debounce)
+			continue
+		case <-debounce.C:
+		case <-resync:
+		}
+
+		if err := w.rediscover(ctx); err != nil {
+			klog.Errorf("Failed to rediscover devices: %v", err)
+		}
+	}
+}
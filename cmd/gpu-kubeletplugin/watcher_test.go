@@ -0,0 +1,154 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseUevent(t *testing.T) {
+	tests := map[string]struct {
+		msg      string
+		expected *uevent
+		affects  bool
+		wantErr  bool
+	}{
+		"drm render node added": {
+			msg: "add@/devices/pci0000:00/0000:00:01.1/0000:01:00.0/0000:02:00.0/0000:03:00.0/drm/renderD128\x00" +
+				"ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:01.1/0000:01:00.0/0000:02:00.0/0000:03:00.0/drm/renderD128\x00" +
+				"SUBSYSTEM=drm\x00DEVNAME=dri/renderD128\x00SEQNUM=4711\x00",
+			expected: &uevent{
+				Action:  "add",
+				DevPath: "/devices/pci0000:00/0000:00:01.1/0000:01:00.0/0000:02:00.0/0000:03:00.0/drm/renderD128",
+				Env: map[string]string{
+					"ACTION":    "add",
+					"DEVPATH":   "/devices/pci0000:00/0000:00:01.1/0000:01:00.0/0000:02:00.0/0000:03:00.0/drm/renderD128",
+					"SUBSYSTEM": "drm",
+					"DEVNAME":   "dri/renderD128",
+					"SEQNUM":    "4711",
+				},
+			},
+			affects: true,
+		},
+		"amdgpu PCI function removed": {
+			msg:     "remove@/devices/pci0000:20/0000:20:01.1/0000:21:00.0/0000:22:00.0/0000:23:00.0\x00ACTION=remove\x00SUBSYSTEM=pci\x00PCI_ID=1002:74A1\x00",
+			affects: true,
+		},
+		"XCP platform device": {
+			msg:     "add@/devices/platform/amdgpu_xcp_3\x00ACTION=add\x00SUBSYSTEM=platform\x00",
+			affects: true,
+		},
+		"unrelated PCI device": {
+			msg:     "bind@/devices/pci0000:00/0000:00:1f.6\x00ACTION=bind\x00SUBSYSTEM=pci\x00DRIVER=e1000e\x00PCI_ID=8086:15BB\x00",
+			affects: false,
+		},
+		"unrelated subsystem": {
+			msg:     "change@/devices/virtual/net/eth0\x00ACTION=change\x00SUBSYSTEM=net\x00",
+			affects: false,
+		},
+		"malformed header": {
+			msg:     "libudev\x00",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			event, err := parseUevent([]byte(test.msg))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if test.expected != nil {
+				assert.Equal(t, test.expected, event)
+			}
+			assert.Equal(t, test.affects, event.affectsGPUs())
+			assert.True(t, strings.HasPrefix(test.msg, event.Action+"@"+event.DevPath))
+		})
+	}
+}
+
+func TestDeviceWatcherRun(t *testing.T) {
+	var calls atomic.Int32
+	w := &deviceWatcher{
+		resyncInterval: 50 * time.Millisecond,
+		debounce:       10 * time.Millisecond,
+		trigger:        make(chan struct{}, 1),
+		rediscover: func(context.Context) error {
+			calls.Add(1)
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+
+	// A burst of triggers is coalesced into a single rediscovery.
+	for range 5 {
+		w.Trigger()
+	}
+	assert.Eventually(t, func() bool { return calls.Load() >= 1 }, time.Second, 5*time.Millisecond)
+
+	// Periodic resync keeps rediscovering without any trigger.
+	assert.Eventually(t, func() bool { return calls.Load() >= 3 }, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestDeviceWatcherReadUevents(t *testing.T) {
+	w := &deviceWatcher{trigger: make(chan struct{}, 1)}
+	drm := []byte("change@/devices/pci0000:00/0000:03:00.0/drm/card1\x00SUBSYSTEM=drm\x00")
+	reads := []func(buf []byte) (int, error){
+		func([]byte) (int, error) { return 0, unix.EAGAIN },
+		// An overflow loses events and triggers a full rediscovery.
+		func([]byte) (int, error) { return 0, unix.ENOBUFS },
+		func(buf []byte) (int, error) { return copy(buf, drm), nil },
+		func([]byte) (int, error) { return 0, unix.EBADF },
+	}
+	var triggers int
+	recv := func(buf []byte) (int, error) {
+		require.NotEmpty(t, reads, "read after the socket was closed")
+		read := reads[0]
+		reads = reads[1:]
+		// Count and drain the triggers of the previous read.
+		select {
+		case <-w.trigger:
+			triggers++
+		default:
+		}
+		return read(buf)
+	}
+
+	// Reading stops once the socket is closed.
+	w.readUevents(context.Background(), recv)
+	assert.Empty(t, reads)
+	assert.Equal(t, 2, triggers)
+}
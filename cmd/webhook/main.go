@@ -293,6 +293,12 @@ func admitResourceClaimParameters(ar admissionv1.AdmissionReview) *admissionv1.A
 			errs = append(errs, fmt.Errorf("expected v1alpha1.GpuConfig at %s but got: %T", fieldPath, decodedConfig))
 			continue
 		}
+		// Validate the config the way the kubelet plugin applies it, with
+		// implied defaults such as the sharing strategy set.
+		if err := gpuConfig.Normalize(); err != nil {
+			errs = append(errs, fmt.Errorf("error normalizing config at %s: %w", fieldPath, err))
+			continue
+		}
 		err = gpuConfig.Validate()
 		if err != nil {
 			errs = append(errs, fmt.Errorf("object at %s is invalid: %w", fieldPath, err))
@@ -32,12 +32,28 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
 )
 
+// DefaultHostRoot is the directory under which the sysfs (sys/) and devfs (dev/)
+// trees are looked up when an entry point is not given an explicit host root.
+// A different root allows discovery to run inside a container that mounts the
+// host's trees elsewhere, or against a captured tree in tests.
+const DefaultHostRoot = "/"
+
+// getHostRoot returns the optional host root passed to an entry point or
+// DefaultHostRoot if none was given.
+func getHostRoot(hostRootParam []string) string {
+	if len(hostRootParam) == 1 && hostRootParam[0] != "" {
+		return hostRootParam[0]
+	}
+	return DefaultHostRoot
+}
+
 // FamilyID to String convert AMDGPU_FAMILY_* into string
 // AMDGPU_FAMILY_* as defined in https://github.com/torvalds/linux/blob/master/include/uapi/drm/amdgpu_drm.h#L986
 func FamilyIDtoString(familyId uint32) (string, error) {
@@ -66,8 +82,9 @@ func FamilyIDtoString(familyId uint32) (string, error) {
 
 }
 
-func GetCardFamilyName(cardName string) (string, error) {
-	devHandle, err := openAMDGPU(cardName)
+// GetCardFamilyName returns the family name of a DRM card (e.g. "card1")
+func GetCardFamilyName(cardName string, hostRootParam ...string) (string, error) {
+	devHandle, err := openAMDGPU(cardName, getHostRoot(hostRootParam))
 	if err != nil {
 		return "", err
 	}
@@ -84,9 +101,11 @@ func GetCardFamilyName(cardName string) (string, error) {
 }
 
 // GetDriverVersion reads the AMDGPU driver version and source version
-func GetDriverVersion() (string, string) {
+func GetDriverVersion(hostRootParam ...string) (string, string) {
+	hostRoot := getHostRoot(hostRootParam)
+
 	// Find all available cards to read driver version from
-	matches, _ := filepath.Glob("/sys/class/drm/card*/device/driver/module/version")
+	matches, _ := filepath.Glob(filepath.Join(hostRoot, "sys/class/drm/card*/device/driver/module/version"))
 	if len(matches) == 0 {
 		glog.Warningf("No AMD GPU cards found for driver version reading")
 		return "", ""
@@ -99,7 +118,7 @@ func GetDriverVersion() (string, string) {
 		}
 		driverVersion := strings.TrimSpace(string(b))
 
-		srcVersionPath := strings.Replace(versionPath, "/version", "/srcversion", 1)
+		srcVersionPath := filepath.Join(filepath.Dir(versionPath), "srcversion")
 		b, err = os.ReadFile(srcVersionPath)
 		if err != nil {
 			continue
@@ -116,206 +135,376 @@ func GetDriverVersion() (string, string) {
 	return "", ""
 }
 
-// GetAMDGPUs return a map of AMD GPU on a node identified by the part of the pci address
-func GetAMDGPUs() map[string]map[string]interface{} {
-	if _, err := os.Stat("/sys/module/amdgpu/drivers/"); err != nil {
+// GetAMDGPUs returns the AMD GPUs on a node ordered by PCI address, together
+// with their compute partitions. Fields that cannot be discovered keep their
+// default value and record an error in the Provenance of the GPU or partition.
+func GetAMDGPUs(hostRootParam ...string) []*GPU {
+	hostRoot := getHostRoot(hostRootParam)
+
+	if _, err := os.Stat(filepath.Join(hostRoot, "sys/module/amdgpu/drivers/")); err != nil {
 		glog.Warningf("amdgpu driver unavailable: %s", err)
-		return make(map[string]map[string]interface{})
+		return nil
 	}
 
 	//ex: /sys/module/amdgpu/drivers/pci:amdgpu/0000:19:00.0
-	matches, _ := filepath.Glob("/sys/module/amdgpu/drivers/pci:amdgpu/[0-9a-fA-F][0-9a-fA-F][0-9a-fA-F][0-9a-fA-F]:*")
-
-	devID := ""
-	devices := make(map[string]map[string]interface{})
-	card, renderD, nodeId := 0, 128, 0
+	matches, _ := filepath.Glob(filepath.Join(hostRoot, "sys/module/amdgpu/drivers/pci:amdgpu/[0-9a-fA-F][0-9a-fA-F][0-9a-fA-F][0-9a-fA-F]:*"))
 
 	// Get comprehensive topology information once instead of multiple calls
-	topologyInfo := GetTopologyInfo()
+	topoRoot := filepath.Join(hostRoot, "sys/class/kfd/kfd")
+	topologyInfo := GetTopologyInfo(topoRoot)
 
 	// Get driver version once for all devices
-	globalDriverVersion, globalDriverSrcVersion := GetDriverVersion()
+	globalDriverVersion, globalDriverSrcVersion := GetDriverVersion(hostRoot)
 
+	gpus := make([]*GPU, 0, len(matches))
 	for _, path := range matches {
-		computePartitionFile := filepath.Join(path, "current_compute_partition")
-		memoryPartitionFile := filepath.Join(path, "current_memory_partition")
-		numaNodeFile := filepath.Join(path, "numa_node")
-
-		computePartitionType, memoryPartitionType := "", ""
-		var numaNode int
+		glog.Info(path)
 
-		// Read the compute partition
-		if data, err := os.ReadFile(computePartitionFile); err == nil {
-			computePartitionType = strings.ToLower(strings.TrimSpace(string(data)))
-		} else {
-			glog.Warningf("Failed to read 'current_compute_partition' file at %s: %s", computePartitionFile, err)
+		// Extract PCI address from path (e.g., "0000:19:00.0" from "/sys/module/amdgpu/drivers/pci:amdgpu/0000:19:00.0")
+		gpu := newGPU(filepath.Base(path), path)
+		gpu.DriverVersion = globalDriverVersion
+		gpu.DriverSrcVersion = globalDriverSrcVersion
+		if globalDriverVersion == "" {
+			gpu.Provenance.record(FieldDriverVersion, path, errors.New("driver version unavailable"))
 		}
 
-		// Read the memory partition
-		if data, err := os.ReadFile(memoryPartitionFile); err == nil {
-			memoryPartitionType = strings.ToLower(strings.TrimSpace(string(data)))
+		readGPUProperties(gpu, hostRoot)
+
+		if info, exists := topologyInfo[gpu.RenderIndex]; exists {
+			gpu.setTopology(info, topologyNodePath(topoRoot, info.NodeID))
 		} else {
-			glog.Warningf("Failed to read 'current_memory_partition' file at %s: %s", memoryPartitionFile, err)
+			err := fmt.Errorf("no KFD topology node for renderD%d", gpu.RenderIndex)
+			glog.Warningf("GPU %s: %s", gpu.PCIAddress, err)
+			gpu.Provenance.record(FieldTopology, topoRoot, err)
 		}
 
-		if data, err := os.ReadFile(numaNodeFile); err == nil {
-			numaNodeStr := strings.TrimSpace(string(data))
-			numaNode, err = strconv.Atoi(numaNodeStr)
-			if err != nil {
-				glog.Warningf("Failed to convert 'numa_node' value to int: %s", err)
-				continue
+		// The PCI function exposes the same unique_id in hex; use it when the
+		// GPU has no KFD topology node.
+		if gpu.UniqueID == "" {
+			uniqueIDFile := filepath.Join(path, "unique_id")
+			if v, err := readSysfsString(uniqueIDFile); err != nil {
+				gpu.Provenance.record(FieldUniqueID, uniqueIDFile, err)
+			} else if id, err := strconv.ParseUint(v, 16, 64); err != nil {
+				gpu.Provenance.record(FieldUniqueID, uniqueIDFile, fmt.Errorf("failed to parse %s: %w", uniqueIDFile, err))
+			} else {
+				gpu.UniqueID = strconv.FormatUint(id, 10)
+				gpu.Provenance.record(FieldUniqueID, uniqueIDFile, nil)
 			}
-		} else {
-			glog.Warningf("Failed to read 'numa_node' file at %s: %s", numaNodeFile, err)
-			continue
 		}
 
-		glog.Info(path)
-		devPaths, _ := filepath.Glob(path + "/drm/*")
-
-		for _, devPath := range devPaths {
-			switch name := filepath.Base(devPath); {
-			case name[0:4] == "card":
-				card, _ = strconv.Atoi(name[4:])
-			case name[0:7] == "renderD":
-				renderD, _ = strconv.Atoi(name[7:])
-				if info, exists := topologyInfo[renderD]; exists {
-					devID = info.UniqueID
-					nodeId = info.NodeID
-				}
+		// Prefer the VRAM size reported by the driver over the KFD memory bank,
+		// which only covers the first partition on partitioned GPUs.
+		vramTotalFile := filepath.Join(path, "mem_info_vram_total")
+		if vram, err := readSysfsInt(vramTotalFile); err == nil && vram > 0 {
+			gpu.VramBytes = uint64(vram)
+			gpu.Provenance.record(FieldVramBytes, vramTotalFile, nil)
+		} else if gpu.VramBytes == 0 {
+			if err == nil {
+				err = fmt.Errorf("invalid VRAM size %d", vram)
 			}
-
+			gpu.Provenance.record(FieldVramBytes, vramTotalFile, err)
 		}
-		// Extract PCI address from path (e.g., "0000:19:00.0" from "/sys/module/amdgpu/drivers/pci:amdgpu/0000:19:00.0")
-		pciAddr := filepath.Base(path)
 
-		// Get card family name
-		familyName := ""
-		if cardFamily, err := GetCardFamilyName(fmt.Sprintf("card%d", card)); err != nil {
-			glog.Warningf("Failed to get card family name for card%d: %s", card, err)
-		} else {
-			familyName = cardFamily
-		}
+		gpus = append(gpus, gpu)
+	}
 
-		// Get product name
-		productName := ""
-		productNamePath := fmt.Sprintf("/sys/class/drm/card%d/device/product_name", card)
-		if b, err := os.ReadFile(productNamePath); err != nil {
-			glog.Warningf("Failed to read product name from %s: %s", productNamePath, err)
-		} else {
-			replacer := strings.NewReplacer(" ", "_", "(", "", ")", "")
-			productName = replacer.Replace(strings.TrimSpace(string(b)))
-		}
+	addPartitions(gpus, topologyInfo, topoRoot, hostRoot)
+	setOrdinals(gpus, topologyInfo)
+	setXGMIPeers(gpus, topologyInfo)
+	setPartitionNumaNodes(gpus, topologyInfo, hostRoot)
 
-		// add devID and topology info so that we can identify later which gpu should get reported under which resource type
-		deviceInfo := map[string]interface{}{
-			"card":                 card,
-			"renderD":              renderD,
-			"devID":                devID,
-			"pciAddr":              pciAddr,
-			"driverVersion":        globalDriverVersion,
-			"driverSrcVersion":     globalDriverSrcVersion,
-			"computePartitionType": computePartitionType,
-			"memoryPartitionType":  memoryPartitionType,
-			"numaNode":             numaNode,
-			"nodeId":               nodeId,
-			"family":               familyName,
-			"productName":          productName,
-		}
+	for _, gpu := range gpus {
+		glog.Infof("Found GPU %s: card%d renderD%d compute=%q memory=%q partitions=%d errors=%v",
+			gpu.PCIAddress, gpu.CardIndex, gpu.RenderIndex, gpu.ComputePartition, gpu.MemoryPartition,
+			len(gpu.Partitions), gpu.Provenance.Errors())
+	}
+	return gpus
+}
 
-		// Add SIMD and CU information from topology if available
-		if info, exists := topologyInfo[renderD]; exists {
-			deviceInfo["simdCount"] = info.SimdCount
-			deviceInfo["simdPerCU"] = info.SimdPerCU
-			deviceInfo["cuCount"] = info.CUCount
-			deviceInfo["vramBytes"] = info.VramBytes
+// readGPUProperties fills in the properties of a GPU that are read from the
+// sysfs directory of its PCI function.
+func readGPUProperties(gpu *GPU, hostRoot string) {
+	path := gpu.SysfsPath
+
+	// Read the compute and memory partition modes. These files only exist on
+	// GPUs that support partitioning.
+	computePartitionFile := filepath.Join(path, "current_compute_partition")
+	if v, err := readSysfsString(computePartitionFile); err == nil {
+		gpu.ComputePartition = strings.ToLower(v)
+		gpu.Provenance.record(FieldComputePartition, computePartitionFile, nil)
+	} else {
+		glog.Warningf("Failed to read 'current_compute_partition' file at %s: %s", computePartitionFile, err)
+		gpu.Provenance.record(FieldComputePartition, computePartitionFile, err)
+	}
+
+	// The available modes are only reported by recent drivers.
+	if gpu.ComputePartition != "" {
+		if modes, err := readAvailablePartitionModes(filepath.Join(path, "available_compute_partition")); err == nil {
+			gpu.AvailableComputePartitions = lowerAll(modes)
 		}
+		if modes, err := readAvailablePartitionModes(filepath.Join(path, "available_memory_partition")); err == nil {
+			gpu.AvailableMemoryPartitions = lowerAll(modes)
+		}
+	}
 
-		devices[filepath.Base(path)] = deviceInfo
+	memoryPartitionFile := filepath.Join(path, "current_memory_partition")
+	if v, err := readSysfsString(memoryPartitionFile); err == nil {
+		gpu.MemoryPartition = strings.ToLower(v)
+		gpu.Provenance.record(FieldMemoryPartition, memoryPartitionFile, nil)
+	} else {
+		glog.Warningf("Failed to read 'current_memory_partition' file at %s: %s", memoryPartitionFile, err)
+		gpu.Provenance.record(FieldMemoryPartition, memoryPartitionFile, err)
+	}
+
+	numaNodeFile := filepath.Join(path, "numa_node")
+	if v, err := readSysfsInt(numaNodeFile); err == nil {
+		gpu.NumaNode = int(v)
+		gpu.Provenance.record(FieldNumaNode, numaNodeFile, nil)
+	} else {
+		glog.Warningf("Failed to read 'numa_node' file at %s: %s", numaNodeFile, err)
+		gpu.Provenance.record(FieldNumaNode, numaNodeFile, err)
 	}
 
+	localCPUsFile := filepath.Join(path, "local_cpulist")
+	if v, err := readSysfsString(localCPUsFile); err == nil {
+		gpu.LocalCPUs = v
+		gpu.Provenance.record(FieldLocalCPUs, localCPUsFile, nil)
+	} else {
+		glog.Warningf("Failed to read 'local_cpulist' file at %s: %s", localCPUsFile, err)
+		gpu.Provenance.record(FieldLocalCPUs, localCPUsFile, err)
+	}
+
+	drmPath := filepath.Join(path, "drm")
+	gpu.CardIndex, gpu.RenderIndex = readDRMNodes(drmPath)
+	if gpu.CardIndex < 0 {
+		gpu.Provenance.record(FieldCardIndex, drmPath, errors.New("no DRM card node"))
+	} else {
+		gpu.Provenance.record(FieldCardIndex, drmPath, nil)
+	}
+	if gpu.RenderIndex < 0 {
+		gpu.Provenance.record(FieldRenderIndex, drmPath, errors.New("no DRM render node"))
+	} else {
+		gpu.Provenance.record(FieldRenderIndex, drmPath, nil)
+	}
+
+	// Get card family name
+	cardName := fmt.Sprintf("card%d", gpu.CardIndex)
+	if cardFamily, err := GetCardFamilyName(cardName, hostRoot); err != nil {
+		glog.Warningf("Failed to get card family name for %s: %s", cardName, err)
+		gpu.Provenance.record(FieldFamily, filepath.Join(hostRoot, "dev/dri", cardName), err)
+	} else {
+		gpu.Family = cardFamily
+		gpu.Provenance.record(FieldFamily, filepath.Join(hostRoot, "dev/dri", cardName), nil)
+	}
+
+	// Get product name
+	productNamePath := filepath.Join(path, "product_name")
+	if v, err := readSysfsString(productNamePath); err != nil {
+		glog.Warningf("Failed to read product name from %s: %s", productNamePath, err)
+		gpu.Provenance.record(FieldProductName, productNamePath, err)
+	} else {
+		replacer := strings.NewReplacer(" ", "_", "(", "", ")", "")
+		gpu.ProductName = replacer.Replace(v)
+		gpu.Provenance.record(FieldProductName, productNamePath, nil)
+	}
+}
+
+// readDRMNodes returns the card and render indices found in a drm directory,
+// or -1 for nodes that are missing.
+func readDRMNodes(drmPath string) (card, render int) {
+	card, render = -1, -1
+	devPaths, _ := filepath.Glob(filepath.Join(drmPath, "*"))
+	for _, devPath := range devPaths {
+		name := filepath.Base(devPath)
+		switch {
+		case strings.HasPrefix(name, "card"):
+			if n, err := strconv.Atoi(strings.TrimPrefix(name, "card")); err == nil {
+				card = n
+			}
+		case strings.HasPrefix(name, "renderD"):
+			if n, err := strconv.Atoi(strings.TrimPrefix(name, "renderD")); err == nil {
+				render = n
+			}
+		}
+	}
+	return card, render
+}
+
+// xcpDevice is an amdgpu_xcp platform device backing a compute partition.
+type xcpDevice struct {
+	name string
+	card int
+}
+
+// addPartitions attaches compute partitions to GPUs that are in a partitioned
+// compute mode. Each partition has its own KFD topology node located at the
+// PCI address of its parent; partition 0 reuses the DRM nodes of the PCI
+// function while the others are exposed as amdgpu_xcp platform devices.
+func addPartitions(gpus []*GPU, topologyInfo map[int]*TopologyInfo, topoRoot, hostRoot string) {
 	// certain products have additional devices (such as MI300's partitions)
 	//ex: /sys/devices/platform/amdgpu_xcp_30
-	platformMatches, _ := filepath.Glob("/sys/devices/platform/amdgpu_xcp_*")
+	platformMatches, _ := filepath.Glob(filepath.Join(hostRoot, "sys/devices/platform/amdgpu_xcp_*"))
 
+	xcpDevices := make(map[int]xcpDevice)
 	for _, path := range platformMatches {
-		glog.Info(path)
-		devPaths, _ := filepath.Glob(path + "/drm/*")
-
-		computePartitionType, memoryPartitionType := "", ""
-		numaNode := -1
-		parentPciAddr := ""
-		familyName := ""
-		productName := ""
-
-		for _, devPath := range devPaths {
-			switch name := filepath.Base(devPath); {
-			case name[0:4] == "card":
-				card, _ = strconv.Atoi(name[4:])
-			case name[0:7] == "renderD":
-				renderD, _ = strconv.Atoi(name[7:])
-				if info, exists := topologyInfo[renderD]; exists {
-					devID = info.UniqueID
-					nodeId = info.NodeID
-				}
-				// Set the computePartitionType, memoryPartitionType, numaNode, PCI address from the real GPU using the common devID
-				for _, device := range devices {
-					if device["devID"] == devID {
-						parentPciAddr = device["pciAddr"].(string)
-						numaNode = device["numaNode"].(int)
-						familyName = device["family"].(string)
-						productName = device["productName"].(string)
-						if device["computePartitionType"].(string) != "" && device["memoryPartitionType"].(string) != "" {
-							computePartitionType = device["computePartitionType"].(string)
-							memoryPartitionType = device["memoryPartitionType"].(string)
-							break
-						}
-					}
-				}
-			}
-		}
+		card, render := readDRMNodes(filepath.Join(path, "drm"))
 		// This is needed because some of the visible renderD are actually not valid
 		// Their validity depends on topology information from KFD
+		if _, exists := topologyInfo[render]; !exists {
+			continue
+		}
+		xcpDevices[render] = xcpDevice{name: filepath.Base(path), card: card}
+	}
+
+	renders := make([]int, 0, len(topologyInfo))
+	for render := range topologyInfo {
+		renders = append(renders, render)
+	}
+	sort.Ints(renders)
 
-		if _, exists := topologyInfo[renderD]; !exists {
+	for _, gpu := range gpus {
+		if gpu.ComputePartition == "" || gpu.ComputePartition == "spx" {
 			continue
 		}
-		if numaNode == -1 || parentPciAddr == "" {
+
+		for _, render := range renders {
+			info := topologyInfo[render]
+			if info.PCIAddress != gpu.PCIAddress {
+				continue
+			}
+
+			name, card := gpu.PCIAddress, gpu.CardIndex
+			if render != gpu.RenderIndex {
+				xcp, exists := xcpDevices[render]
+				if !exists {
+					glog.Warningf("No amdgpu_xcp device found for renderD%d of GPU %s", render, gpu.PCIAddress)
+					continue
+				}
+				name, card = xcp.name, xcp.card
+			}
+
+			partition := newPartition(gpu, name, card, info, topologyNodePath(topoRoot, info.NodeID))
+			partition.Index = len(gpu.Partitions)
+			gpu.Partitions = append(gpu.Partitions, partition)
+		}
+
+		if len(gpu.Partitions) == 0 {
+			glog.Warningf("GPU %s is in %s mode but no partitions were found", gpu.PCIAddress, gpu.ComputePartition)
 			continue
 		}
 
-		deviceInfo := map[string]interface{}{
-			"card":                 card,
-			"renderD":              renderD,
-			"devID":                devID,
-			"pciAddr":              parentPciAddr,
-			"driverVersion":        globalDriverVersion,
-			"driverSrcVersion":     globalDriverSrcVersion,
-			"computePartitionType": computePartitionType,
-			"memoryPartitionType":  memoryPartitionType,
-			"numaNode":             numaNode,
-			"nodeId":               nodeId,
-			"family":               familyName,
-			"productName":          productName,
+		// The KFD node of the PCI function only describes partition 0.
+		gpu.SimdCount, gpu.CUCount, gpu.XCCCount = 0, 0, 0
+		for _, partition := range gpu.Partitions {
+			gpu.SimdCount += partition.SimdCount
+			gpu.CUCount += partition.CUCount
+			gpu.XCCCount += partition.XCCCount
 		}
+	}
+}
 
-		// Add SIMD and CU information from topology if available
-		if info, exists := topologyInfo[renderD]; exists {
-			deviceInfo["simdCount"] = info.SimdCount
-			deviceInfo["simdPerCU"] = info.SimdPerCU
-			deviceInfo["cuCount"] = info.CUCount
-			deviceInfo["vramBytes"] = info.VramBytes
+// setOrdinals numbers the GPUs, or the partitions of partitioned GPUs, the
+// way ROCm does: by the order of their KFD topology nodes among all GPU nodes.
+// These are the indices accepted by ROCR_VISIBLE_DEVICES.
+func setOrdinals(gpus []*GPU, topologyInfo map[int]*TopologyInfo) {
+	nodeIDs := make([]int, 0, len(topologyInfo))
+	for _, info := range topologyInfo {
+		nodeIDs = append(nodeIDs, info.NodeID)
+	}
+	sort.Ints(nodeIDs)
+	ordinals := make(map[int]int, len(nodeIDs))
+	for ordinal, nodeID := range nodeIDs {
+		ordinals[nodeID] = ordinal
+	}
+
+	for _, gpu := range gpus {
+		if ordinal, exists := ordinals[gpu.KFDNodeID]; exists {
+			gpu.Ordinal = ordinal
 		}
+		for _, partition := range gpu.Partitions {
+			if ordinal, exists := ordinals[partition.KFDNodeID]; exists {
+				partition.Ordinal = ordinal
+			}
+		}
+	}
+}
 
-		devices[filepath.Base(path)] = deviceInfo
+// setXGMIPeers records the GPUs that every GPU has a direct XGMI link to,
+// from the io_links of its own KFD node and of the nodes of its partitions.
+func setXGMIPeers(gpus []*GPU, topologyInfo map[int]*TopologyInfo) {
+	nodes := make(map[int]*TopologyInfo, len(topologyInfo))
+	for _, info := range topologyInfo {
+		nodes[info.NodeID] = info
+	}
+
+	for _, gpu := range gpus {
+		nodeIDs := []int{gpu.KFDNodeID}
+		for _, partition := range gpu.Partitions {
+			nodeIDs = append(nodeIDs, partition.KFDNodeID)
+		}
+		peers := make(map[string]bool)
+		for _, nodeID := range nodeIDs {
+			info, exists := nodes[nodeID]
+			if !exists {
+				continue
+			}
+			for _, link := range info.IOLinks {
+				peer, exists := nodes[link.NodeTo]
+				if link.Type == IOLinkTypeXGMI && exists && peer.PCIAddress != "" && peer.PCIAddress != gpu.PCIAddress {
+					peers[peer.PCIAddress] = true
+				}
+			}
+		}
+		gpu.XGMIPeers = make([]string, 0, len(peers))
+		for peer := range peers {
+			gpu.XGMIPeers = append(gpu.XGMIPeers, peer)
+		}
+		sort.Strings(gpu.XGMIPeers)
+	}
+}
+
+// setPartitionNumaNodes moves the partitions of GPUs whose VRAM is split into
+// several memory partitions (NPS2, NPS4, ...) to the NUMA node of their own
+// memory. That is the CPU node the KFD node of the partition has a PCIe link
+// to; KFD numbers its CPU nodes in NUMA node order. Partitions without such a
+// link keep the NUMA node of their GPU.
+func setPartitionNumaNodes(gpus []*GPU, topologyInfo map[int]*TopologyInfo, hostRoot string) {
+	nodes := make(map[int]*TopologyInfo, len(topologyInfo))
+	for _, info := range topologyInfo {
+		nodes[info.NodeID] = info
+	}
+
+	for _, gpu := range gpus {
+		if gpu.MemoryPartition == "" || gpu.MemoryPartition == "nps1" {
+			continue
+		}
+		for _, partition := range gpu.Partitions {
+			info, exists := nodes[partition.KFDNodeID]
+			if !exists {
+				continue
+			}
+			for _, link := range info.IOLinks {
+				// Only GPU nodes are part of topologyInfo.
+				if _, isGPU := nodes[link.NodeTo]; link.Type != IOLinkTypePCIe || isGPU || link.NodeTo == gpu.NumaNode {
+					continue
+				}
+				partition.NumaNode = link.NodeTo
+				cpuListFile := filepath.Join(hostRoot, fmt.Sprintf("sys/devices/system/node/node%d/cpulist", link.NodeTo))
+				if v, err := readSysfsString(cpuListFile); err == nil {
+					partition.LocalCPUs = v
+				} else {
+					glog.Warningf("Failed to read CPUs of NUMA node %d of partition %d of GPU %s: %s", link.NodeTo, partition.Index, gpu.PCIAddress, err)
+					partition.LocalCPUs = ""
+				}
+				break
+			}
+		}
 	}
-	glog.Infof("Devices map: %v", devices)
-	return devices
 }
 
 // AMDGPU check if a particular card is an AMD GPU by checking the device's vendor ID
-func AMDGPU(cardName string) bool {
-	sysfsVendorPath := "/sys/class/drm/" + cardName + "/device/vendor"
+func AMDGPU(cardName string, hostRootParam ...string) bool {
+	sysfsVendorPath := filepath.Join(getHostRoot(hostRootParam), "sys/class/drm", cardName, "device/vendor")
 	b, err := os.ReadFile(sysfsVendorPath)
 	if err == nil {
 		vid := strings.TrimSpace(string(b))
@@ -330,11 +519,11 @@ func AMDGPU(cardName string) bool {
 	return false
 }
 
-func openAMDGPU(cardName string) (C.amdgpu_device_handle, error) {
-	if !AMDGPU(cardName) {
+func openAMDGPU(cardName string, hostRoot string) (C.amdgpu_device_handle, error) {
+	if !AMDGPU(cardName, hostRoot) {
 		return nil, fmt.Errorf("%s is not an AMD GPU", cardName)
 	}
-	devPath := "/dev/dri/" + cardName
+	devPath := filepath.Join(hostRoot, "dev/dri", cardName)
 
 	dev, err := os.Open(devPath)
 
@@ -418,17 +607,48 @@ type TopologyInfo struct {
 	RenderDeviceID int    // The render device ID (e.g., 134 for renderD134)
 	UniqueID       string // Unique ID from topology
 	NodeID         int    // KFD node ID
+	GPUID          int    // KFD gpu_id, used to refer to the node in /sys/class/kfd/kfd/proc
 	SimdCount      int    // Number of SIMD units
 	SimdPerCU      int    // SIMD units per compute unit
 	CUCount        int    // Computed: SimdCount / SimdPerCU
+	XCCCount       int    // Number of XCCs (accelerator complex dies), 0 if unknown
 	VramBytes      uint64 // VRAM size in bytes
+	PCIAddress     string // PCI address of the GPU, derived from domain and location_id
+	HiveID         uint64 // XGMI hive of the GPU, 0 if it is in none
+	IOLinks        []IOLink
+}
+
+// KFD io_link types, see the CRAT link types of the kernel.
+const (
+	IOLinkTypePCIe = 2
+	IOLinkTypeXGMI = 11
+)
+
+// IOLink is a link from a KFD topology node to another node, e.g. a PCIe link
+// to its CPU or an XGMI link to another GPU.
+type IOLink struct {
+	Type   int // IOLinkTypePCIe, IOLinkTypeXGMI or another CRAT link type
+	NodeTo int // KFD node at the other end of the link
+	Weight int // relative cost of the link, lower is closer
 }
 
 var topoDrmRenderMinorRe = regexp.MustCompile(`drm_render_minor\s(\d+)`)
 var topoUniqueIdRe = regexp.MustCompile(`unique_id\s(\d+)`)
 var topoSimdCountRe = regexp.MustCompile(`simd_count\s(\d+)`)
 var topoSimdPerCuRe = regexp.MustCompile(`simd_per_cu\s(\d+)`)
+var topoNumXccRe = regexp.MustCompile(`num_xcc\s(\d+)`)
 var topoSizeInBytesRe = regexp.MustCompile(`size_in_bytes\s(\d+)`)
+var topoLocationIdRe = regexp.MustCompile(`(?m)^location_id\s(\d+)`)
+var topoDomainRe = regexp.MustCompile(`(?m)^domain\s(\d+)`)
+var topoHiveIdRe = regexp.MustCompile(`hive_id\s(\d+)`)
+var topoLinkTypeRe = regexp.MustCompile(`^type\s(\d+)`)
+var topoLinkNodeToRe = regexp.MustCompile(`node_to\s(\d+)`)
+var topoLinkWeightRe = regexp.MustCompile(`weight\s(\d+)`)
+
+// topologyNodePath returns the properties file of a KFD topology node.
+func topologyNodePath(topoRoot string, nodeId int) string {
+	return fmt.Sprintf("%s/topology/nodes/%d/properties", topoRoot, nodeId)
+}
 
 // GetTopologyInfo returns comprehensive topology information for all render devices
 // This combines the functionality of GetDevIdsFromTopology and GetNodeIdsFromTopology
@@ -496,6 +716,19 @@ func GetTopologyInfo(topoRootParam ...string) map[int]*TopologyInfo {
 			cuCount = int(simdCount / simdPerCU)
 		}
 
+		// Parse the XCC count, only reported by GPUs with multiple XCCs
+		xccCount, e := ParseTopologyProperties(nodeFile, topoNumXccRe)
+		if e != nil {
+			xccCount = 0
+		}
+
+		// The gpu_id identifies the node in the per-process KFD files
+		gpuID, e := readSysfsInt(filepath.Join(filepath.Dir(nodeFile), "gpu_id"))
+		if e != nil {
+			glog.Warningf("Failed to read gpu_id of KFD node %d: %v", nodeId, e)
+			gpuID = 0
+		}
+
 		// Parse VRAM information from mem_banks
 		var vramBytes uint64 = 0
 		vramPropertiesPath := fmt.Sprintf("%s/topology/nodes/%d/mem_banks/0/properties", topoRoot, nodeId)
@@ -508,17 +741,69 @@ func GetTopologyInfo(topoRootParam ...string) map[int]*TopologyInfo {
 			glog.Infof("Found VRAM size: %d bytes for renderD%d", vramBytes, renderMinor)
 		}
 
+		// The location_id encodes the bus, device and function of the GPU
+		// that owns this node; all partitions of a GPU share it.
+		pciAddr := ""
+		locationId, e := ParseTopologyProperties(nodeFile, topoLocationIdRe)
+		if e != nil {
+			glog.Warningf("Failed to parse location_id from %s: %v", nodeFile, e)
+		} else {
+			domain, e := ParseTopologyProperties(nodeFile, topoDomainRe)
+			if e != nil {
+				domain = 0
+			}
+			pciAddr = fmt.Sprintf("%04x:%02x:%02x.%x", domain, locationId>>8, (locationId>>3)&0x1f, locationId&0x7)
+		}
+
+		// The hive_id is a 64-bit value that does not fit an int64
+		var hiveID uint64
+		if v, e := ParseTopologyPropertiesString(nodeFile, topoHiveIdRe); e == nil {
+			if hiveID, e = strconv.ParseUint(v, 10, 64); e != nil {
+				glog.Warningf("Failed to parse hive_id from %s: %v", nodeFile, e)
+			}
+		}
+
 		// Create topology info structure
 		topologyInfoMap[int(renderMinor)] = &TopologyInfo{
 			RenderDeviceID: int(renderMinor),
 			UniqueID:       uniqueID,
 			NodeID:         nodeId,
+			GPUID:          int(gpuID),
 			SimdCount:      int(simdCount),
 			SimdPerCU:      int(simdPerCU),
 			CUCount:        cuCount,
+			XCCCount:       int(xccCount),
 			VramBytes:      vramBytes,
+			PCIAddress:     pciAddr,
+			HiveID:         hiveID,
+			IOLinks:        getIOLinks(filepath.Dir(nodeFile)),
 		}
 	}
 
 	return topologyInfoMap
 }
+
+// getIOLinks returns the io_links of a KFD topology node. Links that cannot
+// be parsed are skipped.
+func getIOLinks(nodePath string) []IOLink {
+	linkFiles, _ := filepath.Glob(filepath.Join(nodePath, "io_links/*/properties"))
+	var links []IOLink
+	for _, linkFile := range linkFiles {
+		linkType, e := ParseTopologyProperties(linkFile, topoLinkTypeRe)
+		if e != nil {
+			glog.Warningf("Failed to parse type from %s: %v", linkFile, e)
+			continue
+		}
+		nodeTo, e := ParseTopologyProperties(linkFile, topoLinkNodeToRe)
+		if e != nil {
+			glog.Warningf("Failed to parse node_to from %s: %v", linkFile, e)
+			continue
+		}
+		weight, e := ParseTopologyProperties(linkFile, topoLinkWeightRe)
+		if e != nil {
+			weight = 0
+		}
+		links = append(links, IOLink{Type: int(linkType), NodeTo: int(nodeTo), Weight: int(weight)})
+	}
+	return links
+}
@@ -0,0 +1,364 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestParseTopologyProperties(t *testing.T) {
+	tests := map[string]struct {
+		file     string
+		expected int64
+		wantErr  bool
+	}{
+		"gpu render minor": {
+			file:     "gpu-node-properties",
+			expected: 128,
+		},
+		"cpu render minor": {
+			file:     "cpu-node-properties",
+			expected: 0,
+		},
+		"missing property": {
+			file:    "gpu-mem-bank-properties",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			v, err := ParseTopologyProperties(filepath.Join("testdata/topology-parsing", test.file), topoDrmRenderMinorRe)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, v)
+		})
+	}
+
+	v, err := ParseTopologyProperties("testdata/topology-parsing/gpu-mem-bank-properties", topoSizeInBytesRe)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(192<<30), v)
+
+	s, err := ParseTopologyPropertiesString("testdata/topology-parsing/gpu-node-properties", topoUniqueIdRe)
+	assert.NoError(t, err)
+	assert.Equal(t, "4886591749734855735", s)
+}
+
+func TestGetTopologyInfo(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4)
+
+	info := GetTopologyInfo(filepath.Join(root, "sys/class/kfd/kfd"))
+	// Two GPUs with eight compute partitions each; CPU nodes are skipped.
+	require.Len(t, info, 16)
+
+	first := info[128]
+	require.NotNil(t, first)
+	assert.Equal(t, 2, first.NodeID)
+	assert.Equal(t, 52222, first.GPUID)
+	assert.Equal(t, 152, first.SimdCount)
+	assert.Equal(t, 38, first.CUCount)
+	assert.Equal(t, uint64(48<<30), first.VramBytes)
+}
+
+func TestGetTopologyInfoIOLinks(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+
+	info := GetTopologyInfo(filepath.Join(root, "sys/class/kfd/kfd"))
+	require.Contains(t, info, 128)
+	assert.Equal(t, uint64(4286628731336556645), info[128].HiveID)
+	assert.Equal(t, []IOLink{
+		{Type: IOLinkTypePCIe, NodeTo: 0, Weight: 20},
+		{Type: IOLinkTypeXGMI, NodeTo: 3, Weight: 15},
+	}, info[128].IOLinks)
+}
+
+func TestGetAMDGPUsXGMI(t *testing.T) {
+	tests := map[string]struct {
+		fixture string
+		hiveID  uint64
+		peers   [][]string
+	}{
+		"MI300X SPX": {
+			fixture: amdgputest.MI300XSPXNPS1,
+			hiveID:  4286628731336556645,
+			peers:   [][]string{{"0000:23:00.0"}, {"0000:03:00.0"}},
+		},
+		"MI300X CPX links between partitions": {
+			fixture: amdgputest.MI300XCPXNPS1,
+			hiveID:  4286628731336556645,
+			peers:   [][]string{{"0000:23:00.0"}, {"0000:03:00.0"}},
+		},
+		"MI210 without hive": {
+			fixture: amdgputest.MI210,
+			peers:   [][]string{{}, {}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gpus := GetAMDGPUs(amdgputest.HostRoot(t, test.fixture))
+			require.Len(t, gpus, len(test.peers))
+			for i, gpu := range gpus {
+				assert.Equal(t, test.hiveID, gpu.HiveID, gpu.PCIAddress)
+				assert.Equal(t, test.peers[i], gpu.XGMIPeers, gpu.PCIAddress)
+			}
+		})
+	}
+}
+
+func TestGetDriverVersion(t *testing.T) {
+	version, srcVersion := GetDriverVersion(amdgputest.HostRoot(t, amdgputest.MI210))
+	assert.Equal(t, "6.10.5", version)
+	assert.Equal(t, "5B4F1C9E7D2A8B3F6E0D1C2", srcVersion)
+
+	version, srcVersion = GetDriverVersion(t.TempDir())
+	assert.Empty(t, version)
+	assert.Empty(t, srcVersion)
+}
+
+func TestAMDGPU(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.Radeon)
+	assert.True(t, AMDGPU("card0", root))
+	assert.False(t, AMDGPU("card1", root))
+}
+
+func TestGetPCIeRoot(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+
+	pcieRoot, err := GetPCIeRoot("0000:23:00.0", root)
+	assert.NoError(t, err)
+	assert.Equal(t, "pci0000:20", pcieRoot)
+
+	_, err = GetPCIeRoot("0000:ff:00.0", root)
+	assert.Error(t, err)
+}
+
+func TestGetPCIeSwitch(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+
+	pcieSwitch, err := GetPCIeSwitch("0000:03:00.0", root)
+	assert.NoError(t, err)
+	assert.Equal(t, "0000:01:00.0", pcieSwitch)
+
+	// The NIC sits directly below a root port.
+	pcieSwitch, err = GetPCIeSwitch("0000:25:00.0", root)
+	assert.NoError(t, err)
+	assert.Empty(t, pcieSwitch)
+
+	_, err = GetPCIeSwitch("0000:ff:00.0", root)
+	assert.Error(t, err)
+}
+
+func TestGetRDMADevicesBelow(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+
+	nics, err := GetRDMADevicesBelow("0000:01:00.0", root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0000:04:00.0", "0000:04:00.1"}, nics)
+
+	nics, err = GetRDMADevicesBelow("0000:21:00.0", root)
+	assert.NoError(t, err)
+	assert.Empty(t, nics)
+
+	// Nodes without RDMA devices have no infiniband class.
+	nics, err = GetRDMADevicesBelow("0000:41:00.0", amdgputest.HostRoot(t, amdgputest.MI210))
+	assert.NoError(t, err)
+	assert.Empty(t, nics)
+}
+
+func TestGetAMDGPUs(t *testing.T) {
+	tests := map[string]struct {
+		fixture    string
+		expected   []string
+		partitions int
+	}{
+		"MI300X SPX": {
+			fixture:  amdgputest.MI300XSPXNPS1,
+			expected: []string{"0000:03:00.0", "0000:23:00.0"},
+		},
+		"MI300X CPX": {
+			fixture:    amdgputest.MI300XCPXNPS1,
+			expected:   []string{"0000:03:00.0", "0000:23:00.0"},
+			partitions: 8,
+		},
+		"MI210": {
+			fixture:  amdgputest.MI210,
+			expected: []string{"0000:43:00.0", "0000:63:00.0"},
+		},
+		"Radeon": {
+			fixture:  amdgputest.Radeon,
+			expected: []string{"0000:2d:00.0"},
+		},
+		"partial MI300X": {
+			fixture:  amdgputest.MI300XPartial,
+			expected: []string{"0000:03:00.0", "0000:23:00.0", "0000:83:00.0"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gpus := GetAMDGPUs(amdgputest.HostRoot(t, test.fixture))
+			var addrs []string
+			for _, gpu := range gpus {
+				addrs = append(addrs, gpu.PCIAddress)
+				assert.Len(t, gpu.Partitions, test.partitions)
+				for i, partition := range gpu.Partitions {
+					assert.Same(t, gpu, partition.Parent)
+					assert.Equal(t, i, partition.Index)
+					assert.Equal(t, gpu.UniqueID, partition.UniqueID)
+				}
+			}
+			assert.Equal(t, test.expected, addrs)
+		})
+	}
+
+	t.Run("no amdgpu driver", func(t *testing.T) {
+		assert.Empty(t, GetAMDGPUs(t.TempDir()))
+	})
+}
+
+func TestGetAMDGPUsPartitions(t *testing.T) {
+	gpus := GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4))
+	require.Len(t, gpus, 2)
+
+	gpu := gpus[1]
+	assert.Equal(t, "0000:23:00.0", gpu.PCIAddress)
+	assert.Equal(t, "cpx", gpu.ComputePartition)
+	assert.Equal(t, "nps4", gpu.MemoryPartition)
+	assert.Equal(t, []string{"spx", "dpx", "qpx", "cpx"}, gpu.AvailableComputePartitions)
+	assert.Equal(t, []string{"nps1", "nps4"}, gpu.AvailableMemoryPartitions)
+	assert.Equal(t, 304, gpu.CUCount)
+	assert.Equal(t, 8, gpu.XCCCount)
+	assert.Equal(t, uint64(192<<30), gpu.VramBytes)
+	require.Len(t, gpu.Partitions, 8)
+
+	// Partition 0 is the PCI function itself, the others are XCP devices.
+	assert.Equal(t, "0000:23:00.0", gpu.Partitions[0].Name)
+	assert.Equal(t, 9, gpu.Partitions[0].CardIndex)
+	assert.Equal(t, 136, gpu.Partitions[0].RenderIndex)
+	assert.Equal(t, "amdgpu_xcp_7", gpu.Partitions[1].Name)
+	assert.Equal(t, 10, gpu.Partitions[1].CardIndex)
+	assert.Equal(t, 137, gpu.Partitions[1].RenderIndex)
+	// The partitions of the first GPU come first in ROCm device order.
+	assert.Equal(t, 0, gpus[0].Ordinal)
+	assert.Equal(t, 8, gpu.Ordinal)
+	for i, partition := range gpu.Partitions {
+		assert.Equal(t, 8+i, partition.Ordinal)
+		assert.Equal(t, 38, partition.CUCount)
+		assert.Equal(t, 1, partition.XCCCount)
+		assert.Equal(t, uint64(48<<30), partition.VramBytes)
+	}
+
+	// An unpartitioned GPU reports all of its XCCs on the PCI function.
+	gpus = GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	require.Len(t, gpus, 2)
+	assert.Equal(t, 8, gpus[0].XCCCount)
+	assert.Equal(t, 304, gpus[0].CUCount)
+}
+
+func TestGetAMDGPUsNumaNodes(t *testing.T) {
+	gpus := GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4))
+	require.Len(t, gpus, 2)
+
+	// The memory partitions of the first GPU are spread over both NUMA nodes.
+	gpu := gpus[0]
+	assert.Equal(t, 0, gpu.NumaNode)
+	assert.Equal(t, "0-47,96-143", gpu.LocalCPUs)
+	require.Len(t, gpu.Partitions, 8)
+	for i, partition := range gpu.Partitions {
+		if i < 4 {
+			assert.Equal(t, 0, partition.NumaNode, i)
+			assert.Equal(t, "0-47,96-143", partition.LocalCPUs, i)
+		} else {
+			assert.Equal(t, 1, partition.NumaNode, i)
+			assert.Equal(t, "48-95,144-191", partition.LocalCPUs, i)
+		}
+	}
+
+	// Partitions without a PCIe link to a CPU node stay with their GPU.
+	for _, partition := range gpus[1].Partitions {
+		assert.Equal(t, 0, partition.NumaNode)
+		assert.Equal(t, "0-47,96-143", partition.LocalCPUs)
+	}
+
+	// In NPS1 mode all partitions share the NUMA node of their GPU.
+	gpus = GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	require.Len(t, gpus, 2)
+	for _, partition := range gpus[0].Partitions {
+		assert.Equal(t, 0, partition.NumaNode)
+	}
+}
+
+func TestGetAMDGPUsProvenance(t *testing.T) {
+	gpus := GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XPartial))
+	require.Len(t, gpus, 3)
+
+	healthy, noNuma, noKFD := gpus[0], gpus[1], gpus[2]
+
+	assert.Equal(t, 0, healthy.NumaNode)
+	assert.NoError(t, healthy.Provenance.Err(FieldNumaNode))
+	assert.NoError(t, healthy.Provenance.Err(FieldTopology))
+	assert.True(t, strings.HasSuffix(healthy.Provenance[FieldVramBytes].Path, "0000:03:00.0/mem_info_vram_total"))
+
+	assert.Equal(t, -1, noNuma.NumaNode)
+	assert.Error(t, noNuma.Provenance.Err(FieldNumaNode))
+	assert.Empty(t, noNuma.LocalCPUs)
+	assert.Error(t, noNuma.Provenance.Err(FieldLocalCPUs))
+	assert.Equal(t, 304, noNuma.CUCount)
+
+	assert.Error(t, noKFD.Provenance.Err(FieldTopology))
+	// The unique_id falls back to the hex value exposed by the PCI function.
+	assert.Equal(t, "3138568158426513040", noKFD.UniqueID)
+	assert.Equal(t, "GPU-2b8e6f1c7a5d3e90", noKFD.UUID())
+	assert.Equal(t, -1, noKFD.KFDNodeID)
+	assert.Equal(t, -1, noKFD.Ordinal)
+	assert.Equal(t, 0, noKFD.CUCount)
+	assert.Equal(t, uint64(192<<30), noKFD.VramBytes)
+	assert.Contains(t, noKFD.Provenance.Errors(), FieldTopology)
+
+	// GPUs without partitioning support record why the mode is unknown.
+	gpus = GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI210))
+	require.Len(t, gpus, 2)
+	assert.Empty(t, gpus[0].ComputePartition)
+	assert.Error(t, gpus[0].Provenance.Err(FieldComputePartition))
+	assert.Equal(t, "AMD_Instinct_MI210", gpus[0].ProductName)
+}
+
+func TestUUID(t *testing.T) {
+	gpus := GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1))
+	require.Len(t, gpus, 2)
+	assert.Equal(t, "GPU-43d0a94e5d4cf437", gpus[0].UUID())
+	assert.Equal(t, "GPU-9c1a3b4fe2d07a11", gpus[1].UUID())
+	require.Len(t, gpus[1].Partitions, 8)
+	assert.Equal(t, "GPU-9c1a3b4fe2d07a11-XCP0", gpus[1].Partitions[0].UUID())
+	assert.Equal(t, "GPU-9c1a3b4fe2d07a11-XCP7", gpus[1].Partitions[7].UUID())
+
+	// Radeon cards report a unique_id of 0 and fall back to the PCI address.
+	gpus = GetAMDGPUs(amdgputest.HostRoot(t, amdgputest.Radeon))
+	require.Len(t, gpus, 1)
+	assert.Equal(t, "GPU-0000:2d:00.0", gpus[0].UUID())
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package amdgputest provides captured sysfs/devfs trees of AMD GPU nodes so
+// that discovery code can be exercised on machines without AMD GPUs.
+//
+// Each fixture in testdata/hosts is stored in a txtar-like archive: a "-- path --"
+// header line is followed by the content of that file, and a header of the
+// form "-- path -> target --" creates a symlink. Lines before the first header
+// describe the captured node. Archives are used instead of plain directories
+// because sysfs names contain characters (':') that are not allowed in Go
+// module files.
+package amdgputest
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//go:embed testdata/hosts/*.txtar
+var hosts embed.FS
+
+// Fixture names available in testdata/hosts.
+const (
+	MI300XSPXNPS1 = "mi300x-spx-nps1"
+	MI300XCPXNPS1 = "mi300x-cpx-nps1"
+	MI300XCPXNPS4 = "mi300x-cpx-nps4"
+	MI300XPartial = "mi300x-partial"
+	MI300XRAS     = "mi300x-ras"
+	MI210         = "mi210"
+	Radeon        = "radeon"
+)
+
+// Fixtures returns the names of all captured host trees.
+func Fixtures() []string {
+	entries, _ := hosts.ReadDir("testdata/hosts")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".txtar"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HostRoot materializes the named fixture into a temporary directory and
+// returns it for use as a host root. The directory is removed when the test
+// completes.
+func HostRoot(t testing.TB, name string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := Extract(name, root); err != nil {
+		t.Fatalf("extract fixture %s: %v", name, err)
+	}
+	return root
+}
+
+// AddKFDProcess makes a process with the given PID appear below
+// /sys/class/kfd/kfd/proc of a host root, holding VRAM on the GPUs with the
+// given KFD gpu_ids. It returns a function that makes the process exit.
+func AddKFDProcess(t testing.TB, root string, pid int, gpuIDs ...int) (exit func()) {
+	t.Helper()
+	dir := filepath.Join(root, "sys/class/kfd/kfd/proc", fmt.Sprint(pid))
+	if err := writeFile(filepath.Join(dir, "pasid"), []byte("32769\n")); err != nil {
+		t.Fatalf("add KFD process %d: %v", pid, err)
+	}
+	for _, gpuID := range gpuIDs {
+		if err := writeFile(filepath.Join(dir, fmt.Sprintf("vram_%d", gpuID)), []byte("2097152\n")); err != nil {
+			t.Fatalf("add KFD process %d: %v", pid, err)
+		}
+	}
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Errorf("remove KFD process %d: %v", pid, err)
+		}
+	}
+}
+
+// LinkDeviceNodes replaces the device files below /dev of a host root, which
+// fixtures capture as regular files, with symlinks to /dev/null so that they
+// resolve to character devices.
+func LinkDeviceNodes(t testing.TB, root string) {
+	t.Helper()
+	err := filepath.WalkDir(filepath.Join(root, "dev"), func(name string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		return os.Symlink("/dev/null", name)
+	})
+	if err != nil {
+		t.Fatalf("link device nodes: %v", err)
+	}
+}
+
+// Extract materializes the named fixture below dir.
+func Extract(name, dir string) error {
+	data, err := hosts.ReadFile(path.Join("testdata/hosts", name+".txtar"))
+	if err != nil {
+		return fmt.Errorf("unknown fixture %q: %w", name, err)
+	}
+
+	var entry string
+	var content bytes.Buffer
+	flush := func() error {
+		if entry == "" {
+			return nil
+		}
+		defer content.Reset()
+		if name, target, ok := strings.Cut(entry, " -> "); ok {
+			return symlink(filepath.Join(dir, name), target)
+		}
+		return writeFile(filepath.Join(dir, entry), content.Bytes())
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "-- ") && strings.HasSuffix(line, " --") {
+			if err := flush(); err != nil {
+				return err
+			}
+			entry = strings.TrimSuffix(strings.TrimPrefix(line, "-- "), " --")
+			continue
+		}
+		if entry == "" {
+			// Leading comment describing the fixture.
+			continue
+		}
+		content.WriteString(line)
+		content.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func writeFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+func symlink(name, target string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, name)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Field names used as keys in Provenance.
+const (
+	FieldCardIndex        = "CardIndex"
+	FieldRenderIndex      = "RenderIndex"
+	FieldNumaNode         = "NumaNode"
+	FieldLocalCPUs        = "LocalCPUs"
+	FieldComputePartition = "ComputePartition"
+	FieldMemoryPartition  = "MemoryPartition"
+	FieldFamily           = "Family"
+	FieldProductName      = "ProductName"
+	FieldDriverVersion    = "DriverVersion"
+	FieldTopology         = "Topology"
+	FieldUniqueID         = "UniqueID"
+	FieldVramBytes        = "VramBytes"
+)
+
+// FieldSource records where a discovered field was read from. Err is set when
+// the field could not be read, in which case the field holds its default.
+type FieldSource struct {
+	Path string
+	Err  error
+}
+
+// Provenance maps a field name (see the Field* constants) to its source.
+type Provenance map[string]FieldSource
+
+// Err returns the error recorded for a field, if any.
+func (p Provenance) Err(field string) error {
+	return p[field].Err
+}
+
+// Errors returns all fields that could not be discovered.
+func (p Provenance) Errors() map[string]error {
+	errs := make(map[string]error)
+	for field, source := range p {
+		if source.Err != nil {
+			errs[field] = source.Err
+		}
+	}
+	return errs
+}
+
+func (p Provenance) record(field, path string, err error) {
+	p[field] = FieldSource{Path: path, Err: err}
+}
+
+// GPU is a physical AMD GPU, i.e. a PCI function bound to the amdgpu driver.
+type GPU struct {
+	PCIAddress  string // e.g. "0000:03:00.0"
+	SysfsPath   string // sysfs directory of the PCI function
+	CardIndex   int    // DRM card index (cardN), -1 if unknown
+	RenderIndex int    // DRM render minor (renderDN), -1 if unknown
+
+	UniqueID  string // KFD unique_id, empty if unknown
+	KFDNodeID int    // KFD topology node of the PCI function, -1 if unknown
+	KFDGPUID  int    // KFD gpu_id of that node, 0 if unknown
+	Ordinal   int    // ROCm device index of that node, -1 if unknown
+	NumaNode  int    // NUMA node of the PCI function, -1 if unknown
+	LocalCPUs string // CPUs local to the PCI function, e.g. "0-47,96-143"
+
+	// Current compute (e.g. "spx", "cpx") and memory (e.g. "nps1") partition
+	// modes in lower case. Empty on GPUs that do not support partitioning.
+	ComputePartition string
+	MemoryPartition  string
+
+	// Partition modes the GPU can be switched to, in lower case. Empty if
+	// the driver does not report them.
+	AvailableComputePartitions []string
+	AvailableMemoryPartitions  []string
+
+	Family           string
+	ProductName      string
+	DriverVersion    string
+	DriverSrcVersion string
+
+	// Compute and memory resources of the whole GPU. When the GPU is
+	// partitioned the compute resources are summed over all partitions.
+	SimdCount int
+	SimdPerCU int
+	CUCount   int
+	XCCCount  int // 0 if unknown
+	VramBytes uint64
+
+	// HiveID is the XGMI hive of the GPU, 0 if it is in none. XGMIPeers
+	// lists the PCI addresses of the GPUs it has a direct XGMI link to.
+	HiveID    uint64
+	XGMIPeers []string
+
+	// Partitions lists the compute partitions of the GPU ordered by their
+	// XCP index. It is empty when the GPU is not partitioned (e.g. SPX mode).
+	Partitions []*Partition
+
+	Provenance Provenance
+}
+
+// Partition is a compute partition (XCP) of a GPU. Partition 0 uses the DRM
+// nodes of the PCI function itself; the others are backed by amdgpu_xcp_*
+// platform devices.
+type Partition struct {
+	Parent *GPU
+
+	Index       int    // XCP index within the parent GPU
+	Name        string // sysfs device name, e.g. "amdgpu_xcp_3" or the parent PCI address
+	CardIndex   int    // DRM card index (cardN)
+	RenderIndex int    // DRM render minor (renderDN)
+
+	UniqueID  string // KFD unique_id, shared with the parent GPU
+	KFDNodeID int
+	KFDGPUID  int
+	Ordinal   int // ROCm device index, -1 if unknown
+
+	// NumaNode and LocalCPUs are those of the parent GPU, unless its VRAM
+	// is split into several memory partitions: then they are those of the
+	// NUMA node of the partition's own memory.
+	NumaNode  int
+	LocalCPUs string
+
+	SimdCount int
+	SimdPerCU int
+	CUCount   int
+	XCCCount  int
+	VramBytes uint64
+
+	Provenance Provenance
+}
+
+// UUID returns an identifier of the GPU that is stable across reboots and
+// driver reloads, unlike the DRM minor numbers. It is "GPU-" followed by the
+// unique_id in hex, the format accepted by ROCR_VISIBLE_DEVICES, or the PCI
+// address for GPUs that do not report a unique_id (e.g. most Radeon cards).
+func (g *GPU) UUID() string {
+	if id, err := strconv.ParseUint(g.UniqueID, 10, 64); err == nil && id != 0 {
+		return fmt.Sprintf("GPU-%016x", id)
+	}
+	return "GPU-" + g.PCIAddress
+}
+
+// UUID returns the UUID of the parent GPU suffixed with the XCP index of the
+// partition, e.g. "GPU-9c1a3b4fe2d07a11-XCP3".
+func (p *Partition) UUID() string {
+	return fmt.Sprintf("%s-XCP%d", p.Parent.UUID(), p.Index)
+}
+
+func newGPU(pciAddr, sysfsPath string) *GPU {
+	return &GPU{
+		PCIAddress:  pciAddr,
+		SysfsPath:   sysfsPath,
+		CardIndex:   -1,
+		RenderIndex: -1,
+		KFDNodeID:   -1,
+		Ordinal:     -1,
+		NumaNode:    -1,
+		Provenance:  make(Provenance),
+	}
+}
+
+// setTopology copies the compute and memory resources of a KFD node.
+func (g *GPU) setTopology(info *TopologyInfo, path string) {
+	g.UniqueID = info.UniqueID
+	g.KFDNodeID = info.NodeID
+	g.KFDGPUID = info.GPUID
+	g.SimdCount = info.SimdCount
+	g.SimdPerCU = info.SimdPerCU
+	g.CUCount = info.CUCount
+	g.XCCCount = info.XCCCount
+	g.VramBytes = info.VramBytes
+	g.HiveID = info.HiveID
+	g.Provenance.record(FieldTopology, path, nil)
+	g.Provenance.record(FieldUniqueID, path, nil)
+	g.Provenance.record(FieldVramBytes, path, nil)
+}
+
+func newPartition(parent *GPU, name string, card int, info *TopologyInfo, path string) *Partition {
+	p := &Partition{
+		Parent:      parent,
+		Name:        name,
+		CardIndex:   card,
+		RenderIndex: info.RenderDeviceID,
+		UniqueID:    info.UniqueID,
+		KFDNodeID:   info.NodeID,
+		KFDGPUID:    info.GPUID,
+		Ordinal:     -1,
+		NumaNode:    parent.NumaNode,
+		LocalCPUs:   parent.LocalCPUs,
+		SimdCount:   info.SimdCount,
+		SimdPerCU:   info.SimdPerCU,
+		CUCount:     info.CUCount,
+		XCCCount:    info.XCCCount,
+		VramBytes:   info.VramBytes,
+		Provenance:  make(Provenance),
+	}
+	p.Provenance.record(FieldTopology, path, nil)
+	return p
+}
+
+// readSysfsString reads a sysfs attribute and trims the trailing newline.
+func readSysfsString(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readSysfsInt reads a sysfs attribute holding a decimal or 0x-prefixed integer.
+func readSysfsInt(path string) (int64, error) {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return v, nil
+}
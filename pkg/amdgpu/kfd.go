@@ -0,0 +1,93 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// KFDProcess is a process that has opened /dev/kfd.
+type KFDProcess struct {
+	// PID of the process in the PID namespace of the host.
+	PID int
+	// GPUIDs are the KFD gpu_ids of the GPUs and partitions the process
+	// holds resources on, in ascending order.
+	GPUIDs []int
+}
+
+// Uses reports whether the process holds resources on the GPU or partition
+// with a KFD gpu_id.
+func (p KFDProcess) Uses(gpuID int) bool {
+	_, found := slices.BinarySearch(p.GPUIDs, gpuID)
+	return found
+}
+
+// kfdProcessGPURe matches the per-GPU entries of a process below
+// /sys/class/kfd/kfd/proc/<pid>, e.g. vram_52222.
+var kfdProcessGPURe = regexp.MustCompile(`^(?:vram|sdma|stats)_(\d+)$`)
+
+// GetKFDProcesses lists the processes that use KFD, ordered by PID, from
+// /sys/class/kfd/kfd/proc. The kernel creates a directory for every process
+// that opened /dev/kfd and, within it, entries for every GPU the process
+// acquired. A node without KFD has no processes.
+func GetKFDProcesses(hostRootParam ...string) ([]KFDProcess, error) {
+	procPath := filepath.Join(getHostRoot(hostRootParam), "sys/class/kfd/kfd/proc")
+	entries, err := os.ReadDir(procPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list KFD processes: %w", err)
+	}
+
+	var processes []KFDProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		gpuEntries, err := os.ReadDir(filepath.Join(procPath, entry.Name()))
+		if os.IsNotExist(err) {
+			// The process exited meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KFD process %d: %w", pid, err)
+		}
+
+		process := KFDProcess{PID: pid}
+		for _, gpuEntry := range gpuEntries {
+			m := kfdProcessGPURe.FindStringSubmatch(gpuEntry.Name())
+			if m == nil {
+				continue
+			}
+			gpuID, _ := strconv.Atoi(m[1])
+			if !slices.Contains(process.GPUIDs, gpuID) {
+				process.GPUIDs = append(process.GPUIDs, gpuID)
+			}
+		}
+		slices.Sort(process.GPUIDs)
+		processes = append(processes, process)
+	}
+	slices.SortFunc(processes, func(a, b KFDProcess) int { return a.PID - b.PID })
+	return processes, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestGetKFDProcesses(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS1)
+
+	processes, err := GetKFDProcesses(root)
+	require.NoError(t, err)
+	assert.Empty(t, processes)
+
+	amdgputest.AddKFDProcess(t, root, 4242, 53333, 52222)
+	exit := amdgputest.AddKFDProcess(t, root, 1717, 61110)
+	amdgputest.AddKFDProcess(t, root, 99)
+
+	processes, err = GetKFDProcesses(root)
+	require.NoError(t, err)
+	assert.Equal(t, []KFDProcess{
+		{PID: 99},
+		{PID: 1717, GPUIDs: []int{61110}},
+		{PID: 4242, GPUIDs: []int{52222, 53333}},
+	}, processes)
+	assert.True(t, processes[2].Uses(53333))
+	assert.False(t, processes[2].Uses(61110))
+
+	exit()
+	processes, err = GetKFDProcesses(root)
+	require.NoError(t, err)
+	assert.Len(t, processes, 2)
+}
+
+func TestGetKFDProcessesWithoutKFD(t *testing.T) {
+	processes, err := GetKFDProcesses(t.TempDir())
+	assert.NoError(t, err)
+	assert.Empty(t, processes)
+}
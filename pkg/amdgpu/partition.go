@@ -0,0 +1,137 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// PartitionModes are the compute (e.g. "CPX") and memory (e.g. "NPS4")
+// partition modes of a GPU, in the upper case form used by sysfs.
+type PartitionModes struct {
+	Compute string
+	Memory  string
+}
+
+// String returns the modes that are set, e.g. "CPX/NPS4" or "CPX".
+func (m PartitionModes) String() string {
+	var modes []string
+	for _, mode := range []string{m.Compute, m.Memory} {
+		if mode != "" {
+			modes = append(modes, mode)
+		}
+	}
+	return strings.Join(modes, "/")
+}
+
+// GetPartitionModes reads the current partition modes of the GPU at a PCI
+// address. It returns an error wrapping os.ErrNotExist if the GPU does not
+// support partitioning.
+func GetPartitionModes(pciAddr string, hostRootParam ...string) (PartitionModes, error) {
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+
+	var modes PartitionModes
+	compute, err := readSysfsString(filepath.Join(devicePath, "current_compute_partition"))
+	if err != nil {
+		return modes, fmt.Errorf("partitioning not available for %s: %w", pciAddr, err)
+	}
+	memory, err := readSysfsString(filepath.Join(devicePath, "current_memory_partition"))
+	if err != nil {
+		return modes, fmt.Errorf("partitioning not available for %s: %w", pciAddr, err)
+	}
+	modes.Compute = strings.ToUpper(compute)
+	modes.Memory = strings.ToUpper(memory)
+	return modes, nil
+}
+
+// SetPartitionModes repartitions the GPU at a PCI address. An empty mode
+// leaves the corresponding partitioning unchanged. The memory mode is written
+// before the compute mode because the kernel only accepts compute modes that
+// are compatible with the current memory mode. Modes are checked against
+// available_compute_partition and available_memory_partition when the kernel
+// provides them.
+//
+// The kernel removes and re-adds the partition devices of the GPU, so callers
+// must rediscover them afterwards.
+func SetPartitionModes(pciAddr string, modes PartitionModes, hostRootParam ...string) error {
+	current, err := GetPartitionModes(pciAddr, hostRootParam...)
+	if err != nil {
+		return err
+	}
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+
+	for _, p := range []struct {
+		kind    string
+		current string
+		mode    string
+	}{
+		{"memory", current.Memory, modes.Memory},
+		{"compute", current.Compute, modes.Compute},
+	} {
+		mode := strings.ToUpper(p.mode)
+		if mode == "" || mode == p.current {
+			continue
+		}
+
+		available, err := readAvailablePartitionModes(filepath.Join(devicePath, "available_"+p.kind+"_partition"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if available != nil && !slices.Contains(available, mode) {
+			return fmt.Errorf("%s partition mode %s is not supported by %s, available modes: %s",
+				p.kind, mode, pciAddr, strings.Join(available, ", "))
+		}
+
+		glog.Infof("Changing %s partition mode of %s from %s to %s", p.kind, pciAddr, p.current, mode)
+		path := filepath.Join(devicePath, "current_"+p.kind+"_partition")
+		if err := os.WriteFile(path, []byte(mode), 0644); err != nil {
+			return fmt.Errorf("failed to set %s partition mode of %s to %s: %w", p.kind, pciAddr, mode, err)
+		}
+	}
+	return nil
+}
+
+// readAvailablePartitionModes parses an available_*_partition file holding a
+// comma separated list of modes, e.g. "SPX, DPX, QPX, CPX".
+func readAvailablePartitionModes(path string) ([]string, error) {
+	v, err := readSysfsString(path)
+	if err != nil {
+		return nil, err
+	}
+	var modes []string
+	for _, mode := range strings.Split(v, ",") {
+		if mode = strings.ToUpper(strings.TrimSpace(mode)); mode != "" {
+			modes = append(modes, mode)
+		}
+	}
+	return modes, nil
+}
+
+// lowerAll converts partition modes to lower case.
+func lowerAll(modes []string) []string {
+	lower := make([]string, len(modes))
+	for i, mode := range modes {
+		lower[i] = strings.ToLower(mode)
+	}
+	return lower
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestGetPartitionModes(t *testing.T) {
+	modes, err := GetPartitionModes("0000:03:00.0", amdgputest.HostRoot(t, amdgputest.MI300XCPXNPS4))
+	require.NoError(t, err)
+	assert.Equal(t, PartitionModes{Compute: "CPX", Memory: "NPS4"}, modes)
+
+	_, err = GetPartitionModes("0000:2d:00.0", amdgputest.HostRoot(t, amdgputest.Radeon))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSetPartitionModes(t *testing.T) {
+	tests := map[string]struct {
+		modes       PartitionModes
+		expected    PartitionModes
+		expectedErr string
+	}{
+		"compute and memory": {
+			modes:    PartitionModes{Compute: "CPX", Memory: "NPS4"},
+			expected: PartitionModes{Compute: "CPX", Memory: "NPS4"},
+		},
+		"compute only, lower case": {
+			modes:    PartitionModes{Compute: "dpx"},
+			expected: PartitionModes{Compute: "DPX", Memory: "NPS1"},
+		},
+		"unchanged": {
+			modes:    PartitionModes{Compute: "SPX", Memory: "NPS1"},
+			expected: PartitionModes{Compute: "SPX", Memory: "NPS1"},
+		},
+		"unavailable mode": {
+			modes:       PartitionModes{Memory: "NPS2"},
+			expected:    PartitionModes{Compute: "SPX", Memory: "NPS1"},
+			expectedErr: "memory partition mode NPS2 is not supported by 0000:03:00.0, available modes: NPS1, NPS4",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+			err := SetPartitionModes("0000:03:00.0", test.modes, root)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			modes, err := GetPartitionModes("0000:03:00.0", root)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, modes)
+		})
+	}
+}
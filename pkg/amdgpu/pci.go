@@ -0,0 +1,131 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// GetPCIDevicePath resolves the sysfs device directory of a PCI function, e.g.
+// "<root>/sys/devices/pci0000:00/0000:00:01.1/.../0000:03:00.0" for
+// "0000:03:00.0".
+func GetPCIDevicePath(pciAddr string, hostRootParam ...string) (string, error) {
+	hostRoot := getHostRoot(hostRootParam)
+
+	busPath := filepath.Join(hostRoot, "sys/bus/pci/devices", pciAddr)
+	target, err := os.Readlink(busPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %w", busPath, err)
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(busPath), target)
+	}
+
+	devicesPath := filepath.Join(hostRoot, "sys/devices")
+	if !strings.HasPrefix(target, filepath.Join(devicesPath, "pci")) || filepath.Base(target) != pciAddr {
+		return "", fmt.Errorf("unexpected sysfs path for PCI device %s: %s", pciAddr, target)
+	}
+	return target, nil
+}
+
+// pciHierarchy returns the components of the sysfs path of a PCI function
+// below /sys/devices: its PCIe root complex, the bridges above it starting at
+// its root port, and the function itself.
+func pciHierarchy(pciAddr, hostRoot string) ([]string, error) {
+	devicePath, err := GetPCIDevicePath(pciAddr, hostRoot)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(filepath.Join(hostRoot, "sys/devices"), devicePath)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(rel, string(filepath.Separator)), nil
+}
+
+// GetPCIeRoot returns the PCIe root complex (e.g. "pci0000:00") a PCI function
+// sits under. This mirrors deviceattribute.GetPCIeRootAttributeByPCIBusID but
+// honors the host root.
+func GetPCIeRoot(pciAddr string, hostRootParam ...string) (string, error) {
+	hierarchy, err := pciHierarchy(pciAddr, getHostRoot(hostRootParam))
+	if err != nil {
+		return "", err
+	}
+	return hierarchy[0], nil
+}
+
+// GetPCIeSwitch returns the PCI address of the upstream port of the nearest
+// PCIe switch above a PCI function, which identifies the switch, or "" if
+// the function sits directly below a root port. Every switch adds an upstream
+// and a downstream port to the bridges above a function, so the upstream
+// port of the nearest switch is the bridge above its parent.
+func GetPCIeSwitch(pciAddr string, hostRootParam ...string) (string, error) {
+	hierarchy, err := pciHierarchy(pciAddr, getHostRoot(hostRootParam))
+	if err != nil {
+		return "", err
+	}
+	// Root complex, root port, upstream and downstream port, function.
+	if len(hierarchy) < 5 {
+		return "", nil
+	}
+	return hierarchy[len(hierarchy)-3], nil
+}
+
+// GetRDMADevicesBelow returns the PCI addresses of the RDMA capable NICs
+// listed in /sys/class/infiniband that sit below the PCI bridge at bridgeAddr,
+// e.g. the upstream port of a PCIe switch, sorted. NICs with several RDMA
+// devices are listed once.
+func GetRDMADevicesBelow(bridgeAddr string, hostRootParam ...string) ([]string, error) {
+	hostRoot := getHostRoot(hostRootParam)
+
+	classPath := filepath.Join(hostRoot, "sys/class/infiniband")
+	entries, err := os.ReadDir(classPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	devicesPath := filepath.Join(hostRoot, "sys/devices")
+	var nics []string
+	for _, entry := range entries {
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(classPath, entry.Name(), "device"))
+		if err != nil {
+			glog.Warningf("Failed to resolve PCI device of RDMA device %s: %v", entry.Name(), err)
+			continue
+		}
+		rel, err := filepath.Rel(devicesPath, devicePath)
+		if err != nil || !strings.HasPrefix(rel, "pci") {
+			continue
+		}
+		hierarchy := strings.Split(rel, string(filepath.Separator))
+		pciAddr := hierarchy[len(hierarchy)-1]
+		if slices.Contains(hierarchy[1:len(hierarchy)-1], bridgeAddr) && !slices.Contains(nics, pciAddr) {
+			nics = append(nics, pciAddr)
+		}
+	}
+	slices.Sort(nics)
+	return nics, nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// PowerSettings are the power and performance settings of a GPU. A setting
+// that is not set is left unchanged.
+type PowerSettings struct {
+	// PowerCap is the power cap of the GPU in microwatts, as in the
+	// power1_cap file of its hwmon device.
+	PowerCap *int64 `json:",omitempty"`
+	// PerformanceLevel is the power_dpm_force_performance_level of the GPU,
+	// e.g. "auto" or "high".
+	PerformanceLevel string `json:",omitempty"`
+	// PowerProfile is the name of the selected pp_power_profile_mode of the
+	// GPU, e.g. "COMPUTE".
+	PowerProfile string `json:",omitempty"`
+}
+
+// String returns the settings that are set, e.g. "power cap 500W, power
+// profile COMPUTE".
+func (s PowerSettings) String() string {
+	var settings []string
+	if s.PowerCap != nil {
+		settings = append(settings, fmt.Sprintf("power cap %gW", float64(*s.PowerCap)/1e6))
+	}
+	if s.PerformanceLevel != "" {
+		settings = append(settings, "performance level "+s.PerformanceLevel)
+	}
+	if s.PowerProfile != "" {
+		settings = append(settings, "power profile "+s.PowerProfile)
+	}
+	return strings.Join(settings, ", ")
+}
+
+// GetPowerSettings reads the current power and performance settings of the
+// GPU at a PCI address. Settings the GPU does not expose are left unset.
+func GetPowerSettings(pciAddr string, hostRootParam ...string) (PowerSettings, error) {
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+
+	var settings PowerSettings
+	if hwmon, err := hwmonPath(devicePath); err == nil {
+		powerCap, err := readSysfsInt(filepath.Join(hwmon, "power1_cap"))
+		if err != nil && !os.IsNotExist(err) {
+			return settings, err
+		}
+		if err == nil {
+			settings.PowerCap = &powerCap
+		}
+	}
+
+	level, err := readSysfsString(filepath.Join(devicePath, "power_dpm_force_performance_level"))
+	if err != nil && !os.IsNotExist(err) {
+		return settings, err
+	}
+	settings.PerformanceLevel = level
+
+	profiles, current, err := readPowerProfiles(filepath.Join(devicePath, "pp_power_profile_mode"))
+	if err != nil && !os.IsNotExist(err) {
+		return settings, err
+	}
+	if current >= 0 {
+		settings.PowerProfile = profiles[current]
+	}
+	return settings, nil
+}
+
+// GetPowerCapRange reads the range of power caps in microwatts the GPU at a
+// PCI address accepts. It returns an error wrapping os.ErrNotExist if the
+// power cap of the GPU cannot be changed.
+func GetPowerCapRange(pciAddr string, hostRootParam ...string) (min, max int64, err error) {
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+	hwmon, err := hwmonPath(devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("power cap not available for %s: %w", pciAddr, err)
+	}
+	if min, err = readSysfsInt(filepath.Join(hwmon, "power1_cap_min")); err != nil {
+		return 0, 0, fmt.Errorf("power cap not available for %s: %w", pciAddr, err)
+	}
+	if max, err = readSysfsInt(filepath.Join(hwmon, "power1_cap_max")); err != nil {
+		return 0, 0, fmt.Errorf("power cap not available for %s: %w", pciAddr, err)
+	}
+	return min, max, nil
+}
+
+// CheckPowerSettings returns an error if the GPU at a PCI address does not
+// accept the settings: a power cap outside of power1_cap_min and
+// power1_cap_max, or a power profile it does not list.
+func CheckPowerSettings(pciAddr string, settings PowerSettings, hostRootParam ...string) error {
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+
+	if settings.PowerCap != nil {
+		min, max, err := GetPowerCapRange(pciAddr, hostRootParam...)
+		if err != nil {
+			return err
+		}
+		if *settings.PowerCap < min || *settings.PowerCap > max {
+			return fmt.Errorf("power cap %gW is not supported by %s, valid range: %gW-%gW",
+				float64(*settings.PowerCap)/1e6, pciAddr, float64(min)/1e6, float64(max)/1e6)
+		}
+	}
+	if settings.PerformanceLevel != "" {
+		if _, err := os.Stat(filepath.Join(devicePath, "power_dpm_force_performance_level")); err != nil {
+			return fmt.Errorf("performance level not available for %s: %w", pciAddr, err)
+		}
+	}
+	if settings.PowerProfile != "" {
+		profiles, _, err := readPowerProfiles(filepath.Join(devicePath, "pp_power_profile_mode"))
+		if err != nil {
+			return fmt.Errorf("power profile not available for %s: %w", pciAddr, err)
+		}
+		if !slices.Contains(profiles, settings.PowerProfile) {
+			available := slices.DeleteFunc(slices.Clone(profiles), func(profile string) bool { return profile == "" })
+			return fmt.Errorf("power profile %s is not supported by %s, available profiles: %s",
+				settings.PowerProfile, pciAddr, strings.Join(available, ", "))
+		}
+	}
+	return nil
+}
+
+// SetPowerSettings applies power and performance settings to the GPU at a
+// PCI address, after checking them with CheckPowerSettings. The performance
+// level is written first, since some levels reset the power profile.
+func SetPowerSettings(pciAddr string, settings PowerSettings, hostRootParam ...string) error {
+	if err := CheckPowerSettings(pciAddr, settings, hostRootParam...); err != nil {
+		return err
+	}
+	devicePath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr)
+
+	if settings.PerformanceLevel != "" {
+		glog.Infof("Setting performance level of %s to %s", pciAddr, settings.PerformanceLevel)
+		path := filepath.Join(devicePath, "power_dpm_force_performance_level")
+		if err := os.WriteFile(path, []byte(settings.PerformanceLevel), 0644); err != nil {
+			return fmt.Errorf("failed to set performance level of %s to %s: %w", pciAddr, settings.PerformanceLevel, err)
+		}
+	}
+	if settings.PowerProfile != "" {
+		path := filepath.Join(devicePath, "pp_power_profile_mode")
+		profiles, _, err := readPowerProfiles(path)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Setting power profile of %s to %s", pciAddr, settings.PowerProfile)
+		index := slices.Index(profiles, settings.PowerProfile)
+		if err := os.WriteFile(path, []byte(strconv.Itoa(index)), 0644); err != nil {
+			return fmt.Errorf("failed to set power profile of %s to %s: %w", pciAddr, settings.PowerProfile, err)
+		}
+	}
+	if settings.PowerCap != nil {
+		hwmon, err := hwmonPath(devicePath)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Setting power cap of %s to %gW", pciAddr, float64(*settings.PowerCap)/1e6)
+		path := filepath.Join(hwmon, "power1_cap")
+		if err := os.WriteFile(path, []byte(strconv.FormatInt(*settings.PowerCap, 10)), 0644); err != nil {
+			return fmt.Errorf("failed to set power cap of %s to %gW: %w", pciAddr, float64(*settings.PowerCap)/1e6, err)
+		}
+	}
+	return nil
+}
+
+// hwmonPath returns the hwmon device of a GPU, e.g.
+// "<device>/hwmon/hwmon3".
+func hwmonPath(devicePath string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(devicePath, "hwmon", "hwmon*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no hwmon device below %s: %w", devicePath, os.ErrNotExist)
+	}
+	slices.Sort(matches)
+	return matches[0], nil
+}
+
+// readPowerProfiles parses a pp_power_profile_mode file. It returns the
+// profile names indexed by the number that selects them and the index of the
+// current profile, which is marked with a '*', or -1. Rows of a profile start
+// with its number and name, e.g. "  5        COMPUTE*:", followed by its
+// heuristics, which may continue on further lines.
+func readPowerProfiles(path string) ([]string, int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, -1, err
+	}
+	var profiles []string
+	current := -1
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil || index < 0 {
+			continue
+		}
+		name := strings.TrimRight(fields[1], "*:")
+		if name == "" {
+			continue
+		}
+		for len(profiles) <= index {
+			profiles = append(profiles, "")
+		}
+		profiles[index] = name
+		if strings.Contains(fields[1], "*") {
+			current = index
+		}
+	}
+	return profiles, current, nil
+}
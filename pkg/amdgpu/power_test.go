@@ -0,0 +1,128 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestGetPowerSettings(t *testing.T) {
+	settings, err := GetPowerSettings("0000:03:00.0", amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1))
+	require.NoError(t, err)
+	assert.Equal(t, PowerSettings{
+		PowerCap:         ptr.To[int64](750000000),
+		PerformanceLevel: "auto",
+		PowerProfile:     "BOOTUP_DEFAULT",
+	}, settings)
+
+	settings, err = GetPowerSettings("0000:2d:00.0", amdgputest.HostRoot(t, amdgputest.Radeon))
+	require.NoError(t, err)
+	assert.Equal(t, PowerSettings{}, settings)
+
+	_, _, err = GetPowerCapRange("0000:2d:00.0", amdgputest.HostRoot(t, amdgputest.Radeon))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSetPowerSettings(t *testing.T) {
+	tests := map[string]struct {
+		settings    PowerSettings
+		expected    PowerSettings
+		expectedErr string
+	}{
+		"all settings": {
+			settings: PowerSettings{
+				PowerCap:         ptr.To[int64](500000000),
+				PerformanceLevel: "manual",
+				PowerProfile:     "COMPUTE",
+			},
+			expected: PowerSettings{
+				PowerCap:         ptr.To[int64](500000000),
+				PerformanceLevel: "manual",
+				PowerProfile:     "COMPUTE",
+			},
+		},
+		"power cap only": {
+			settings: PowerSettings{PowerCap: ptr.To[int64](200000000)},
+			expected: PowerSettings{
+				PowerCap:         ptr.To[int64](200000000),
+				PerformanceLevel: "auto",
+				PowerProfile:     "BOOTUP_DEFAULT",
+			},
+		},
+		"power cap above maximum": {
+			settings: PowerSettings{
+				PowerCap:     ptr.To[int64](800000000),
+				PowerProfile: "COMPUTE",
+			},
+			expected: PowerSettings{
+				PowerCap:         ptr.To[int64](750000000),
+				PerformanceLevel: "auto",
+				PowerProfile:     "BOOTUP_DEFAULT",
+			},
+			expectedErr: "power cap 800W is not supported by 0000:03:00.0, valid range: 200W-750W",
+		},
+		"power cap below minimum": {
+			settings: PowerSettings{PowerCap: ptr.To[int64](100000000)},
+			expected: PowerSettings{
+				PowerCap:         ptr.To[int64](750000000),
+				PerformanceLevel: "auto",
+				PowerProfile:     "BOOTUP_DEFAULT",
+			},
+			expectedErr: "power cap 100W is not supported by 0000:03:00.0, valid range: 200W-750W",
+		},
+		"unknown power profile": {
+			settings: PowerSettings{PowerProfile: "MEMORY"},
+			expected: PowerSettings{
+				PowerCap:         ptr.To[int64](750000000),
+				PerformanceLevel: "auto",
+				PowerProfile:     "BOOTUP_DEFAULT",
+			},
+			expectedErr: "power profile MEMORY is not supported by 0000:03:00.0, available profiles: BOOTUP_DEFAULT, 3D_FULL_SCREEN, POWER_SAVING, VIDEO, VR, COMPUTE, CUSTOM",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := amdgputest.HostRoot(t, amdgputest.MI300XSPXNPS1)
+			err := SetPowerSettings("0000:03:00.0", test.settings, root)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// The fixture is a plain file system, the profile that was
+			// written reads back as its number.
+			settings, err := GetPowerSettings("0000:03:00.0", root)
+			require.NoError(t, err)
+			if test.settings.PowerProfile != "" && test.expectedErr == "" {
+				content, err := os.ReadFile(root + "/sys/bus/pci/devices/0000:03:00.0/pp_power_profile_mode")
+				require.NoError(t, err)
+				assert.Equal(t, "5", string(content))
+				settings.PowerProfile = test.expected.PowerProfile
+			}
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
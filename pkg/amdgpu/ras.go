@@ -0,0 +1,135 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RASErrorCount holds the error counters of a RAS block (e.g. "umc", "gfx").
+type RASErrorCount struct {
+	Uncorrectable uint64
+	Correctable   uint64
+}
+
+// RASStatus is a snapshot of the RAS (reliability, availability and
+// serviceability) counters of a GPU.
+type RASStatus struct {
+	// ErrorCounts maps a RAS block name to its counters, read from
+	// ras/<block>_err_count.
+	ErrorCounts map[string]RASErrorCount
+
+	// BadPages is the number of VRAM pages retired by the driver and
+	// PendingBadPages those waiting to be retired, read from
+	// ras/gpu_vram_bad_pages.
+	BadPages        int
+	PendingBadPages int
+}
+
+// GetRASStatus reads the RAS counters of the GPU at a PCI address. It returns
+// an error wrapping os.ErrNotExist if the GPU does not support RAS.
+func GetRASStatus(pciAddr string, hostRootParam ...string) (*RASStatus, error) {
+	rasPath := filepath.Join(getHostRoot(hostRootParam), "sys/bus/pci/devices", pciAddr, "ras")
+	if _, err := os.Stat(rasPath); err != nil {
+		return nil, fmt.Errorf("RAS not available for %s: %w", pciAddr, err)
+	}
+
+	status := &RASStatus{
+		ErrorCounts: make(map[string]RASErrorCount),
+	}
+
+	//ex: /sys/bus/pci/devices/0000:03:00.0/ras/umc_err_count
+	matches, _ := filepath.Glob(filepath.Join(rasPath, "*_err_count"))
+	for _, path := range matches {
+		count, err := parseRASErrorCount(path)
+		if err != nil {
+			return nil, err
+		}
+		status.ErrorCounts[strings.TrimSuffix(filepath.Base(path), "_err_count")] = count
+	}
+
+	badPagesPath := filepath.Join(rasPath, "gpu_vram_bad_pages")
+	if _, err := os.Stat(badPagesPath); err == nil {
+		status.BadPages, status.PendingBadPages, err = parseRASBadPages(badPagesPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// parseRASErrorCount parses a <block>_err_count file of the form
+// "ue: <n>\nce: <n>".
+func parseRASErrorCount(path string) (RASErrorCount, error) {
+	var count RASErrorCount
+
+	f, err := os.Open(path)
+	if err != nil {
+		return count, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return count, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		switch strings.TrimSpace(key) {
+		case "ue":
+			count.Uncorrectable = n
+		case "ce":
+			count.Correctable = n
+		}
+	}
+	return count, scanner.Err()
+}
+
+// parseRASBadPages counts the entries of a gpu_vram_bad_pages file. Each line
+// is "<pfn> : <size> : <flag>" where the flag is R (reserved), P (pending) or
+// F (failed to reserve). Failed pages are counted as retired.
+func parseRASBadPages(path string) (retired, pending int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		if strings.TrimSpace(fields[2]) == "P" {
+			pending++
+		} else {
+			retired++
+		}
+	}
+	return retired, pending, scanner.Err()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) Advanced Micro Devices, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the \"License\");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an \"AS IS\" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package amdgpu
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ROCm/k8s-gpu-dra-driver/pkg/amdgpu/amdgputest"
+)
+
+func TestGetRASStatus(t *testing.T) {
+	root := amdgputest.HostRoot(t, amdgputest.MI300XRAS)
+
+	tests := map[string]struct {
+		pciAddr         string
+		umc             RASErrorCount
+		sdma            RASErrorCount
+		badPages        int
+		pendingBadPages int
+	}{
+		"uncorrectable memory errors and bad pages": {
+			pciAddr:         "0000:03:00.0",
+			umc:             RASErrorCount{Uncorrectable: 2, Correctable: 12},
+			badPages:        2,
+			pendingBadPages: 1,
+		},
+		"correctable errors only": {
+			pciAddr: "0000:23:00.0",
+			sdma:    RASErrorCount{Correctable: 5},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			status, err := GetRASStatus(test.pciAddr, root)
+			require.NoError(t, err)
+			assert.Len(t, status.ErrorCounts, 7)
+			assert.Equal(t, test.umc, status.ErrorCounts["umc"])
+			assert.Equal(t, test.sdma, status.ErrorCounts["sdma"])
+			assert.Equal(t, test.badPages, status.BadPages)
+			assert.Equal(t, test.pendingBadPages, status.PendingBadPages)
+		})
+	}
+}
+
+func TestGetRASStatusUnsupported(t *testing.T) {
+	_, err := GetRASStatus("0000:2d:00.0", amdgputest.HostRoot(t, amdgputest.Radeon))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}